@@ -163,7 +163,8 @@ export async function updateRequest(pool: Pool, request: DB_Request) {
         userid = $2,
         companyname = $3,
         datarequests = $4,
-        status = $5
+        status = $5,
+        consent = $7
     WHERE requestid = $6
     RETURNING *
     `,
@@ -173,7 +174,8 @@ export async function updateRequest(pool: Pool, request: DB_Request) {
       request.companyname,
       request.datarequests,
       request.status,
-      request.requestid
+      request.requestid,
+      request.consent ?? null
     ]
   );
   return rows[0];
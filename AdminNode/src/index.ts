@@ -1,5 +1,5 @@
 import app from './app'
-import { startNode } from './p2p/node'
+import { startDiscovery, startNode } from './p2p/node'
 import '../Models'
 import { Pool } from 'pg';
 import dotenv from 'dotenv';
@@ -28,6 +28,7 @@ const pool = new Pool({
 const PORT = 5000
 async function start() {
   await startNode()
+  await startDiscovery()
 
   app.listen(PORT, () => {
     console.log(`API running at http://localhost:${PORT}`)    
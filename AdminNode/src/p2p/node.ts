@@ -3,10 +3,20 @@ import { createLibp2p, type Libp2p } from 'libp2p'
 import { tcp } from "@libp2p/tcp";
 import { tls } from '@libp2p/tls';
 import { yamux } from "@chainsafe/libp2p-yamux";
-import { privateKeyFromRaw } from '@libp2p/crypto/keys'
-import { peerIdFromPrivateKey } from '@libp2p/peer-id'
+import { identify } from '@libp2p/identify'
+import { ping } from '@libp2p/ping'
+import { kadDHT, passthroughMapper } from '@libp2p/kad-dht'
+import { privateKeyFromRaw, publicKeyFromRaw } from '@libp2p/crypto/keys'
+import type { PeerId, PrivateKey } from '@libp2p/interface'
+import { randomBytes } from 'crypto'
+import { readFileSync } from 'fs'
+import { peerIdFromPrivateKey, peerIdFromPublicKey, peerIdFromString } from '@libp2p/peer-id'
+import { base58btc } from 'multiformats/bases/base58'
+import { CID } from 'multiformats/cid'
+import * as raw from 'multiformats/codecs/raw'
+import { sha256 } from 'multiformats/hashes/sha2'
 
-import { multiaddr } from "@multiformats/multiaddr";
+import { multiaddr, type Multiaddr } from "@multiformats/multiaddr";
 
 /**
  * LIBP2P NODE FILE
@@ -18,6 +28,26 @@ import { multiaddr } from "@multiformats/multiaddr";
  */
 
 let node: Libp2p | null = null
+let nodeKey: PrivateKey | null = null
+
+// DHT namespace of the storage nodes (network.namespace in their config.yaml)
+const NAMESPACE = process.env.DSN_NAMESPACE ?? 'myapp'
+
+// role records, published in the DHT under /<namespace>/roles/<peer ID> (see StorageNode/core/Roles.go)
+const ROLE_ADMIN = 'admin'
+const ROLE_RECORD_TTL = 60 * 60 * 1000
+const ROLE_REPUBLISH = ROLE_RECORD_TTL / 4
+const DISCOVERY_INTERVAL = 60 * 1000
+
+type Capabilities = { free_space: number, protocols: string[] | null, region?: string }
+type RoleInfo = { roles: string[] | null, addrs: string[] | null, capabilities?: Capabilities }
+type RoleRecord = { peer_id: string, timestamp: number, body: RoleInfo, signature: string }
+
+// when our own record was last published
+let publishedAt = 0
+
+// verified records of the nodes we know (storage, gateway, verifier, relay), by peer ID
+const knownNodes = new Map<string, RoleRecord>()
 
 export async function startNode(): Promise<Libp2p> {
     if (node) return node
@@ -30,6 +60,7 @@ export async function startNode(): Promise<Libp2p> {
 
     const rawKey = Buffer.from(base64Key, 'base64')
     const privateKey = privateKeyFromRaw(rawKey)
+    nodeKey = privateKey
     // const peerId = await peerIdFromPrivateKey(privateKey)
     
     node = await createLibp2p({
@@ -42,8 +73,26 @@ export async function startNode(): Promise<Libp2p> {
         transports: [tcp()],
         connectionEncrypters: [tls()],
         streamMuxers: [yamux()],
+        services: {
+            identify: identify(),
+            ping: ping(),
+            //the storage nodes' DHT, only to read role records and publish ours
+            dht: kadDHT({
+                protocol: `/${NAMESPACE}/kad/1.0.0`,
+                clientMode: true,
+                peerInfoMapper: passthroughMapper,
+                validators: { [NAMESPACE]: validateRecord },
+                selectors: { [NAMESPACE]: selectRecord },
+            }),
+        },
     });
 
+    //storage nodes only let us in if our certificate is in their roster (add-member),
+    //presenting it keeps a renewed certificate current there
+    node.addEventListener('peer:connect', evt => {
+        sendMembership(evt.detail).catch(err => console.warn(`Membership presentation to ${evt.detail} failed:`, err))
+    })
+
     //print protocol
     node.handle("/print/1.0.0", ( stream ) => {
         console.log("📥 Incoming stream on /print/1.0.0");
@@ -73,6 +122,316 @@ export function getNode(): Libp2p {
     return node
 }
 
+// Storage nodes drop peers whose membership certificate they don't hold at the handshake: ours
+// (MEMBERSHIP_CERT, the json printed by sign-membership) has to be added to a storage node with
+// add-member, the members pass it on. Presenting it keeps a renewed certificate current
+export async function presentMembership(addr: string): Promise<void> {
+    await sendMembership(multiaddr(addr))
+}
+
+async function sendMembership(target: PeerId | Multiaddr): Promise<void> {
+    const cert = process.env.MEMBERSHIP_CERT
+    if (!cert) {
+        console.warn('MEMBERSHIP_CERT not set, storage nodes with membership checks will refuse us')
+        return
+    }
+
+    const node = getNode()
+    const stream = await node.dialProtocol(target, '/membership/1.0.0')
+    stream.send(new TextEncoder().encode(JSON.stringify(JSON.parse(cert)) + "\n"))
+    stream.close()
+}
+
+// Storage nodes only accept requests wrapped in an envelope signed by whoever created them, for
+// them and for the protocol it is sent on (see StorageNode/core/Envelope.go); returns the envelope
+// line ready to be sent to recipient (a peer ID) on protocol
+export async function sealEnvelope(payload: unknown, recipient: string, protocol: string): Promise<Uint8Array> {
+    const node = getNode()
+    if (!nodeKey) {
+        throw new Error('libp2p node not started')
+    }
+
+    const origin = node.peerId.toString()
+    const timestamp = Date.now()
+    const nonce = randomBytes(16).toString('base64')
+    const body = JSON.stringify(payload)
+
+    const signed = `dsn-envelope/2\n${origin}\n${recipient}\n${protocol}\n${timestamp}\n${nonce}\n${body}`
+    const signature = await nodeKey.sign(new TextEncoder().encode(signed))
+
+    //payload goes in verbatim, the signature covers these exact bytes
+    const envelope = `{"origin":${JSON.stringify(origin)},"recipient":${JSON.stringify(recipient)},` +
+        `"protocol":${JSON.stringify(protocol)},"timestamp":${timestamp},"nonce":${JSON.stringify(nonce)},` +
+        `"payload":${body},"signature":${JSON.stringify(Buffer.from(signature).toString('base64'))}}`
+
+    return new TextEncoder().encode(envelope + "\n")
+}
+
+// Peer ID named by a node reference: a did:key (multicodec 0xed01, base58btc) or a plain peer ID,
+// like ParseNodeRef in StorageNode/core/DID.go
+export function parseNodeRef(ref: string): string {
+    if (ref.startsWith('did:key:')) {
+        const data = base58btc.decode(ref.slice('did:key:'.length))
+        if (data[0] !== 0xed || data[1] !== 0x01) {
+            throw new Error('did:key is not an Ed25519 key')
+        }
+        return peerIdFromPublicKey(publicKeyFromRaw(data.subarray(2))).toString()
+    }
+    return peerIdFromString(ref).toString()
+}
+
+// the text of a top-level field of a json object as it was received, signatures cover these bytes
+function rawField(json: string, field: string): string | undefined {
+    const skipSpace = (i: number) => {
+        while (i < json.length && ' \t\n\r'.includes(json[i]!)) i++
+        return i
+    }
+    // index right after the value starting at i
+    const skipValue = (i: number): number => {
+        let depth = 0
+        let inString = false
+        for (; i < json.length; i++) {
+            const c = json[i]!
+            if (inString) {
+                if (c === '\\') i++
+                else if (c === '"') {
+                    inString = false
+                    if (depth === 0) return i + 1
+                }
+            } else if (c === '"') {
+                inString = true
+            } else if (c === '{' || c === '[') {
+                depth++
+            } else if (c === '}' || c === ']') {
+                if (depth === 0) return i
+                if (--depth === 0) return i + 1
+            } else if (depth === 0 && ', \t\n\r'.includes(c)) {
+                return i
+            }
+        }
+        return i
+    }
+
+    let i = skipSpace(0)
+    if (json[i] !== '{') return undefined
+    i = skipSpace(i + 1)
+    while (json[i] === '"') {
+        const keyEnd = skipValue(i)
+        const key = JSON.parse(json.slice(i, keyEnd)) as string
+        i = skipSpace(keyEnd)
+        if (json[i] !== ':') return undefined
+        const start = skipSpace(i + 1)
+        const end = skipValue(start)
+        if (key === field) return json.slice(start, end)
+        i = skipSpace(end)
+        if (json[i] !== ',') return undefined
+        i = skipSpace(i + 1)
+    }
+    return undefined
+}
+
+function roleSigningBytes(peerId: string, timestamp: number, body: string): Uint8Array {
+    return new TextEncoder().encode(`dsn-roles/1\n${peerId}\n${timestamp}\n${body}`)
+}
+
+function roleKey(peerId: string): Uint8Array {
+    return new TextEncoder().encode(`/${NAMESPACE}/roles/${peerId}`)
+}
+
+// our own role record: admin, with the addresses we listen on and our admin certificate
+async function signRoleRecord(): Promise<Uint8Array> {
+    const node = getNode()
+    if (!nodeKey) {
+        throw new Error('libp2p node not started')
+    }
+    const cert = process.env.MEMBERSHIP_CERT
+    if (!cert) {
+        throw new Error('MEMBERSHIP_CERT not set, storage nodes only believe admins with an admin certificate')
+    }
+
+    const peerId = node.peerId.toString()
+    const timestamp = Date.now()
+    const body = JSON.stringify({ roles: [ROLE_ADMIN], addrs: node.getMultiaddrs().map(String) })
+    const signature = await nodeKey.sign(roleSigningBytes(peerId, timestamp, body))
+
+    //body goes in verbatim, the signature covers these exact bytes
+    const record = `{"peer_id":${JSON.stringify(peerId)},"timestamp":${timestamp},"body":${body},` +
+        `"signature":${JSON.stringify(Buffer.from(signature).toString('base64'))},"cert":${JSON.stringify(JSON.parse(cert))}}`
+    return new TextEncoder().encode(record)
+}
+
+// checks a role record, as received, against the key of its peer ID; peerId is the peer it was looked up for
+async function verifyRecord(received: string, peerId?: string): Promise<RoleRecord> {
+    const record = JSON.parse(received) as RoleRecord
+    const body = rawField(received, 'body')
+    if (body === undefined) {
+        throw new Error('role record without body')
+    }
+    if (peerId && record.peer_id !== peerId) {
+        throw new Error('role record of another peer')
+    }
+    if (Math.abs(Date.now() - record.timestamp) > ROLE_RECORD_TTL) {
+        throw new Error('stale role record')
+    }
+    const publicKey = peerIdFromString(record.peer_id).publicKey
+    if (!publicKey) {
+        throw new Error(`no public key in peer ID ${record.peer_id}`)
+    }
+    if (!await publicKey.verify(roleSigningBytes(record.peer_id, record.timestamp, body), Buffer.from(record.signature, 'base64'))) {
+        throw new Error('bad role record signature')
+    }
+    return record
+}
+
+// checks a role record and remembers it when it comes from a node (not another admin)
+async function learnRecord(received: string, peerId: string): Promise<void> {
+    const record = await verifyRecord(received, peerId)
+    const known = knownNodes.get(record.peer_id)
+    if (!record.body.roles?.includes(ROLE_ADMIN) && (!known || known.timestamp < record.timestamp)) {
+        knownNodes.set(record.peer_id, record)
+    }
+}
+
+// DHT validator for our namespace: role records are checked here, the storage nodes check the rest
+async function validateRecord(key: Uint8Array, value: Uint8Array): Promise<void> {
+    const path = new TextDecoder().decode(key)
+    if (path.split('/')[2] === 'roles') {
+        await verifyRecord(new TextDecoder().decode(value), path.slice(path.lastIndexOf('/') + 1))
+    }
+}
+
+// DHT selector for our namespace: the newest role record wins
+function selectRecord(key: Uint8Array, records: Uint8Array[]): number {
+    if (new TextDecoder().decode(key).split('/')[2] !== 'roles') {
+        return 0
+    }
+    let best = 0
+    let bestTimestamp = -1
+    records.forEach((value, i) => {
+        try {
+            const timestamp = (JSON.parse(new TextDecoder().decode(value)) as RoleRecord).timestamp
+            if (timestamp > bestTimestamp) {
+                best = i
+                bestTimestamp = timestamp
+            }
+        } catch { }
+    })
+    return best
+}
+
+// rendezvous key the storage nodes advertise themselves under (see StorageNode/core/Discovery.go)
+async function rendezvousCid(): Promise<CID> {
+    return CID.createV1(raw.code, await sha256.digest(new TextEncoder().encode(`/${NAMESPACE}/storage-nodes`)))
+}
+
+/**
+ * Finds the live nodes: connects to the nodes of Bootstrap.txt, asks the DHT for the nodes
+ * advertising the rendezvous key, and looks up the role record of each one. Our own record is
+ * published again every ROLE_REPUBLISH
+ */
+export async function discoverNodes(): Promise<void> {
+    const node = getNode()
+    let bootstrap: string[] = []
+    try {
+        bootstrap = readFileSync('Bootstrap.txt', 'utf8').split("\n").map(l => l.trim()).filter(l => l !== '')
+    } catch {
+        console.warn('No Bootstrap.txt, nodes will only be found when they connect to us')
+    }
+
+    const peers = new Set<string>()
+    for (const addr of bootstrap) {
+        try {
+            //our certificate goes out on connection (see startNode)
+            await node.dial(multiaddr(addr))
+            peers.add(peerIdOf(addr))
+        } catch (err) {
+            console.warn(`Connecting to ${addr} failed:`, err)
+        }
+    }
+
+    if (Date.now() - publishedAt >= ROLE_REPUBLISH) {
+        try {
+            await node.contentRouting.put(roleKey(node.peerId.toString()), await signRoleRecord())
+            publishedAt = Date.now()
+        } catch (err) {
+            console.warn('Publishing our role record failed:', err)
+        }
+    }
+
+    try {
+        for await (const provider of node.contentRouting.findProviders(await rendezvousCid(), { signal: AbortSignal.timeout(DISCOVERY_INTERVAL) })) {
+            peers.add(provider.id.toString())
+        }
+    } catch (err) {
+        console.warn('Finding nodes in the DHT failed:', err)
+    }
+    for (const peer of node.getPeers()) {
+        peers.add(peer.toString())
+    }
+
+    for (const peerId of peers) {
+        try {
+            const value = await node.contentRouting.get(roleKey(peerId), { signal: AbortSignal.timeout(DISCOVERY_INTERVAL) })
+            await learnRecord(new TextDecoder().decode(value), peerId)
+        } catch (err) {
+            console.warn(`No role record for ${peerId}:`, err)
+        }
+    }
+    console.log(`🗄️  Nodes known: ${knownNodes.size}`)
+}
+
+// discovers nodes now and then every DISCOVERY_INTERVAL
+export async function startDiscovery(): Promise<void> {
+    await discoverNodes()
+    setInterval(() => {
+        discoverNodes().catch(err => console.error('Node discovery failed:', err))
+    }, DISCOVERY_INTERVAL)
+}
+
+type NodeSummary = { peerId: string, roles: string[], addrs: string[], capabilities: Capabilities | null, connected: boolean }
+
+// nodes with a fresh role record (with role, if given), the ones we are connected to first
+export function getNodes(role?: string): NodeSummary[] {
+    const node = getNode()
+    return [...knownNodes.values()]
+        .filter(record => Date.now() - record.timestamp <= ROLE_RECORD_TTL)
+        .filter(record => !role || (record.body.roles ?? []).includes(role))
+        .map(record => ({
+            peerId: record.peer_id,
+            roles: record.body.roles ?? [],
+            addrs: record.body.addrs ?? [],
+            capabilities: record.body.capabilities ?? null,
+            connected: node.getConnections(peerIdFromString(record.peer_id)).length > 0,
+        }))
+        .sort((a, b) => Number(b.connected) - Number(a.connected))
+}
+
+/**
+ * Address of a random live node with role that answers protocol. Nodes we are connected to come
+ * first, then the ones in our region (ADMIN_REGION) among them
+ */
+export function pickNode(role: string, protocol: string): string {
+    const live = getNodes(role).filter(n => n.addrs.length > 0 &&
+        (!n.capabilities?.protocols || n.capabilities.protocols.includes(protocol)))
+    let candidates = live.filter(n => n.connected)
+    if (candidates.length === 0) candidates = live
+
+    const region = process.env.ADMIN_REGION
+    const near = candidates.filter(n => region && n.capabilities?.region === region)
+    if (near.length > 0) candidates = near
+
+    const picked = candidates[Math.floor(Math.random() * candidates.length)]
+    if (!picked) {
+        throw new Error(`no ${role} node known for ${protocol}, check Bootstrap.txt`)
+    }
+    return `${picked.addrs[0]}/p2p/${picked.peerId}`
+}
+
+// peer ID at the end of a /p2p/ address
+export function peerIdOf(addr: string): string {
+    return addr.slice(addr.lastIndexOf('/p2p/') + '/p2p/'.length)
+}
+
 // Example action exposed to the API
 export async function dialPeer(peerId: string, message: string): Promise<void> {
     const node = getNode()
@@ -1,6 +1,6 @@
 import { Router, type Request, type Response } from 'express'
 import { multiaddr } from "@multiformats/multiaddr";
-import { getNode } from '../p2p/node'
+import { getNode, getNodes, parseNodeRef, peerIdOf, pickNode, presentMembership, sealEnvelope } from '../p2p/node'
 import { DB_Request, User } from '../../Models';
 import { createRequest, getProviderById, getRequests, getUserByEmail, updateRequest, upsertUser } from '../../Database';
 import { Pool } from 'pg';
@@ -28,15 +28,30 @@ const pool = new Pool({
 router.post('/net/upload', async (req: Request, res: Response) => {
 
   const node = getNode()
-  const payload = req.body
 
-  //dial storage network with new user protocol
-  //TODO: replace static node multiaddress to random node from peerlist
+  //gateways refuse new records without an owner: the user's did:key and its claim on the
+  //record (sign-owner), consent tokens are checked against that key
+  const { UID, user_data, mpc, owner, owner_signature, acl } = req.body ?? {}
+  if (typeof owner !== 'string' || !owner.startsWith('did:key:') || typeof owner_signature !== 'string' || !owner_signature) {
+    res.status(400).json({ error: 'owner (did:key) and owner_signature are required' })
+    return
+  }
+  const payload = { UID, user_data, mpc, owner, owner_signature, acl }
+
+  //dial a random live gateway with new user protocol
+  let storageAddr: string
+  try {
+    storageAddr = pickNode('gateway', '/upload/1.0.0')
+  } catch (err) {
+    res.status(503).json({ error: String(err) })
+    return
+  }
+  await presentMembership(storageAddr)
   const stream = await node.dialProtocol(
-    multiaddr("/ip4/127.0.0.1/tcp/4001/p2p/QmSgsmq9ty6khBSjvM7fBCynimYUPFnWKkSJNb1uvGTFZ7"),
+    multiaddr(storageAddr),
     '/upload/1.0.0'
   )
-  stream.send(new TextEncoder().encode(JSON.stringify(payload)))
+  stream.send(await sealEnvelope(payload, peerIdOf(storageAddr), '/upload/1.0.0'))
   stream.close()
 
   //Here probably mark the user as synced or fully registred in the network in the database?
@@ -57,6 +72,12 @@ router.get('/node-info', (req: Request, res: Response) => {
   })
 })
 
+// live nodes with their roles and capabilities, ?role=storage|gateway|verifier|relay to filter
+router.get('/net/nodes', (req: Request, res: Response) => {
+  const role = typeof req.query.role === 'string' ? req.query.role : undefined
+  res.json(getNodes(role))
+})
+
 router.post("/db/request-verification", async (req: Request, res: Response) => {
 
   //Get the request body
@@ -100,7 +121,26 @@ router.post("/db/resolve-requests", async (req: Request, res: Response) => {
   let updated_request = new DB_Request(db_request[0])
 
   if(request_body.accepted){
+    //storage nodes refuse to verify without a consent token signed by the user (sign-consent),
+    //it is checked there against the key the record was uploaded with, and only this node
+    //(the requester in it, by peer ID or did:key) can send the verification request carrying it
+    const consent = request_body.consent
+    let requester: string | undefined
+    try {
+      requester = parseNodeRef(String(consent?.requester))
+    } catch {
+      requester = undefined
+    }
+    if(!consent || consent.request_id !== updated_request.requestid || consent.provider_id !== updated_request.providerid || requester !== getNode().peerId.toString() || !consent.signature){
+      res.status(400).json({
+        reply: "A consent token signed by the user for this request is required"
+      })
+      return
+    }
+    updated_request.consent = consent
+
     //HERE IS WHERE WE DIAL THE NODE TO START THE VERIFICATION PROCESS
+    //(a verifier, e.g. pickNode('verifier', '/verify/1.0.0'))
   }
   
   updated_request.status = request_body.accepted ? "Accepted" : "Rejected"
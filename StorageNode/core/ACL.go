@@ -0,0 +1,191 @@
+/*
+# ACL.go
+
+Per-manifest access control lists, signed by the record owner.
+
+An ACL lists which nodes (DIDs or peer IDs) may do what with a record:
+
+	verify   -> run verifications (and get credentials), as the node that signs the request
+	retrieve -> fetch stored pieces directly
+	delete   -> erase stored pieces
+
+The first ACL can come with the upload and is kept in the manifest. The owner replaces it
+by publishing a newer version in the DHT record store, under the node's custom namespace:
+	/
+	├── <namespace>/
+	│     ├── acl/
+	│     │     ├── <manifest id> : ACL json
+
+The highest version signed by the manifest owner is the one enforced. The node that
+publishes an ACL, and the gateway of the manifest, keep it published (see adoptACL). Records without an
+ACL keep the default behaviour: consent for reads (see Consent.go), and deletion only by
+admin members, or by the gateway that signed the record when it has no owner.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// operations an ACL can grant
+const (
+	ACL_VERIFY   = "verify"
+	ACL_RETRIEVE = "retrieve"
+	ACL_DELETE   = "delete"
+)
+
+type ACL struct {
+	ManifestID string     `json:"manifest_id"`
+	Owner      string     `json:"owner"` // did:key of the record owner
+	Version    int        `json:"version"`
+	Entries    []ACLEntry `json:"entries"`
+	Signature  []byte     `json:"signature,omitempty"` // by the owner key
+}
+
+type ACLEntry struct {
+	Identity   string   `json:"identity"` // DID or peer ID of a node
+	Operations []string `json:"operations"`
+}
+
+// Signs an ACL with the owner key (also sets the owner)
+func SignACL(owner crypto.PrivKey, acl *ACL) error {
+	did, err := DIDFromPubKey(owner.GetPublic())
+	if err != nil {
+		return err
+	}
+	acl.Owner = did
+	acl.Signature = nil
+
+	msg, err := canonicalJSON(acl)
+	if err != nil {
+		return err
+	}
+	acl.Signature, err = owner.Sign(msg)
+	return err
+}
+
+// Checks the signature against the owner did:key
+func (acl *ACL) Verify() error {
+	pub, err := PubKeyFromDID(acl.Owner)
+	if err != nil {
+		return fmt.Errorf("acl owner: %v", err)
+	}
+
+	unsigned := *acl
+	unsigned.Signature = nil
+	msg, err := canonicalJSON(unsigned)
+	if err != nil {
+		return err
+	}
+	if ok, err := pub.Verify(msg, acl.Signature); err != nil || !ok {
+		return errors.New("acl not signed by its owner")
+	}
+	return nil
+}
+
+// true if identity was granted the operation
+func (acl *ACL) Allows(identity string, operation string) bool {
+	id := canonicalIdentity(identity)
+	for _, e := range acl.Entries {
+		if canonicalIdentity(e.Identity) != id {
+			continue
+		}
+		for _, op := range e.Operations {
+			if op == operation {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DIDs and peer IDs of the same node compare equal, other identities as they are
+func canonicalIdentity(identity string) string {
+	if pid, err := ParseNodeRef(identity); err == nil {
+		return pid.String()
+	}
+	return identity
+}
+
+// true if acl is a valid ACL of m
+func (acl *ACL) validFor(m *Manifest) bool {
+	return acl != nil && m.Owner != "" && acl.Owner == m.Owner && acl.ManifestID == m.ID && acl.Verify() == nil
+}
+
+/*
+Returns the ACL in force for a manifest: the newest valid one between the one in the
+manifest and the published one. nil if the record has none.
+*/
+func EffectiveACL(m *Manifest, published *ACL) *ACL {
+	var best *ACL
+	for _, acl := range []*ACL{m.ACL, published} {
+		if acl.validFor(m) && (best == nil || acl.Version > best.Version) {
+			best = acl
+		}
+	}
+	return best
+}
+
+/*-------------------------- DHT RECORDS -----------------------------------*/
+
+func aclKey(namespace string, manifestID string) string {
+	return fmt.Sprintf("/%s/acl/%s", namespace, manifestID)
+}
+
+// Puts a signed ACL in the DHT record store and keeps it published (see RepublishRecords)
+func (sm *StreamsMaster) PublishACL(ctx context.Context, acl *ACL) error {
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	return sm.publishRecord(ctx, aclKey(sm.namespace, acl.ManifestID), data)
+}
+
+// Gets the published ACL of a manifest, nil (and no error) if there is none
+func FetchACL(ctx context.Context, kadDHT *dht.IpfsDHT, namespace string, manifestID string) (*ACL, error) {
+	data, err := kadDHT.GetValue(ctx, aclKey(namespace, manifestID))
+	if err != nil {
+		return nil, nil
+	}
+	acl := &ACL{}
+	if err := json.Unmarshal(data, acl); err != nil {
+		return nil, fmt.Errorf("invalid acl for %s: %v", manifestID, err)
+	}
+	return acl, nil
+}
+
+// the acl key of a manifest we published, "" for other records and manifests without an owner
+func (sm *StreamsMaster) aclKeyOf(rec PublishedRecord) string {
+	if !strings.HasPrefix(rec.Key, manifestKey(sm.namespace, "")) {
+		return ""
+	}
+	m := Manifest{}
+	if err := json.Unmarshal(rec.Value, &m); err != nil || m.Owner == "" {
+		return ""
+	}
+	return aclKey(sm.namespace, m.ID)
+}
+
+/*
+Keeps published the ACL an owner put for one of the manifests we published: from then on
+it is republished with our own records, so grants don't expire with the DHT record.
+*/
+func (sm *StreamsMaster) adoptACL(ctx context.Context, key string) {
+	getCtx, cancel := context.WithTimeout(ctx, sm.cfg.Timeouts.Request)
+	defer cancel()
+	value, err := RepublishRecord(getCtx, sm.dht, key, nil)
+	if err != nil || value == nil {
+		return
+	}
+	if err := sm.db.SavePublished(key, value); err != nil {
+		fmt.Println("Error saving published record:", err)
+	}
+}
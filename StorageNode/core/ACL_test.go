@@ -0,0 +1,153 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// an ACL of m at version, signed by owner
+func testACL(t *testing.T, owner crypto.PrivKey, m *Manifest, version int, entries ...ACLEntry) *ACL {
+	t.Helper()
+	acl := &ACL{ManifestID: m.ID, Version: version, Entries: entries}
+	if err := SignACL(owner, acl); err != nil {
+		t.Fatalf("SignACL: %v", err)
+	}
+	return acl
+}
+
+func TestACLSignature(t *testing.T) {
+	m, owner := ownedTestManifest(t)
+	entry := ACLEntry{Identity: testPeerID(t).String(), Operations: []string{ACL_VERIFY}}
+	if err := testACL(t, owner, m, 1, entry).Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	cases := map[string]func(acl *ACL){
+		"entries":  func(acl *ACL) { acl.Entries[0].Operations = append(acl.Entries[0].Operations, ACL_DELETE) },
+		"version":  func(acl *ACL) { acl.Version++ },
+		"manifest": func(acl *ACL) { acl.ManifestID = "manifest-2" },
+		"owner":    func(acl *ACL) { acl.Owner, _ = DIDFromPubKey(testKey(t).GetPublic()) },
+	}
+	for name, tamper := range cases {
+		acl := testACL(t, owner, m, 1, ACLEntry{Identity: entry.Identity, Operations: []string{ACL_VERIFY}})
+		tamper(acl)
+		if err := acl.Verify(); err == nil {
+			t.Errorf("%s: tampered acl verified", name)
+		}
+	}
+}
+
+func TestACLAllows(t *testing.T) {
+	m, owner := ownedTestManifest(t)
+	verifier, other := testPeerID(t), testPeerID(t)
+	did, err := DIDFromPeerID(verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := testACL(t, owner, m, 1, ACLEntry{Identity: did, Operations: []string{ACL_VERIFY, ACL_RETRIEVE}})
+
+	//granted by DID, asked by peer ID
+	if !acl.Allows(verifier.String(), ACL_VERIFY) || !acl.Allows(verifier.String(), ACL_RETRIEVE) {
+		t.Error("granted operations refused")
+	}
+	if acl.Allows(verifier.String(), ACL_DELETE) {
+		t.Error("allowed an operation that was not granted")
+	}
+	if acl.Allows(other.String(), ACL_VERIFY) {
+		t.Error("allowed a node that is not listed")
+	}
+}
+
+func TestEffectiveACL(t *testing.T) {
+	m, owner := ownedTestManifest(t)
+	m.ACL = testACL(t, owner, m, 1)
+	newer := testACL(t, owner, m, 2)
+
+	if got := EffectiveACL(m, newer); got != newer {
+		t.Errorf("EffectiveACL = %+v, want the published version 2", got)
+	}
+	if got := EffectiveACL(m, nil); got != m.ACL {
+		t.Errorf("EffectiveACL without a published acl = %+v", got)
+	}
+
+	//published by someone else, or for another record
+	otherRecord := &Manifest{ID: "manifest-2", Owner: m.Owner}
+	for name, published := range map[string]*ACL{
+		"other owner":  testACL(t, testKey(t), m, 9),
+		"other record": testACL(t, owner, otherRecord, 9),
+	} {
+		if got := EffectiveACL(m, published); got != m.ACL {
+			t.Errorf("%s: EffectiveACL = %+v", name, got)
+		}
+	}
+
+	//records without an owner have no acl
+	if got := EffectiveACL(&Manifest{ID: m.ID, ACL: m.ACL}, newer); got != nil {
+		t.Errorf("EffectiveACL of a record without owner = %+v", got)
+	}
+}
+
+func TestACLValidator(t *testing.T) {
+	m, owner := ownedTestManifest(t)
+	v := RecordValidator{}
+	raw, _ := json.Marshal(testACL(t, owner, m, 1))
+
+	if err := v.Validate("/ns/acl/"+m.ID, raw); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if err := v.Validate("/ns/acl/manifest-2", raw); err == nil {
+		t.Error("accepted an acl under the key of another record")
+	}
+
+	newer, _ := json.Marshal(testACL(t, owner, m, 2))
+	if best, err := v.Select("/ns/acl/"+m.ID, [][]byte{raw, newer}); err != nil || best != 1 {
+		t.Errorf("Select = %d, %v", best, err)
+	}
+}
+
+// the gateway keeps an ACL the owner published alive past the record's max age
+func TestACLRepublish(t *testing.T) {
+	const maxAge = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	m, owner := ownedTestManifest(t)
+	sm := &StreamsMaster{namespace: "ns"}
+	manifestData, _ := json.Marshal(m)
+	key := sm.aclKeyOf(PublishedRecord{Key: manifestKey("ns", m.ID), Value: manifestData})
+	if key != aclKey("ns", m.ID) {
+		t.Fatalf("acl key of a manifest: %q", key)
+	}
+	if other := sm.aclKeyOf(PublishedRecord{Key: successionKey("ns", "old"), Value: manifestData}); other != "" {
+		t.Errorf("acl key of a succession: %q", other)
+	}
+	ownerless, _ := json.Marshal(&Manifest{ID: m.ID})
+	if other := sm.aclKeyOf(PublishedRecord{Key: manifestKey("ns", m.ID), Value: ownerless}); other != "" {
+		t.Errorf("acl key of a manifest without owner: %q", other)
+	}
+
+	gateway := testDHT(t, maxAge)
+	ownerNode := testDHT(t, maxAge, gateway)
+	acl, _ := json.Marshal(testACL(t, owner, m, 1))
+	if err := ownerNode.PutValue(ctx, key, acl); err != nil {
+		t.Fatal(err)
+	}
+
+	//refreshed before it expires, without the gateway holding a copy of its own
+	time.Sleep(maxAge / 2)
+	value, err := RepublishRecord(ctx, gateway, key, nil)
+	if err != nil || string(value) != string(acl) {
+		t.Fatalf("RepublishRecord = %s, %v", value, err)
+	}
+
+	time.Sleep(maxAge * 3 / 4)
+	reader := testDHT(t, maxAge, gateway, ownerNode)
+	got, err := FetchACL(ctx, reader, "ns", m.ID)
+	if err != nil || got == nil || got.Version != 1 {
+		t.Errorf("republished acl: %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+# AddressBook.go
+
+Persistent address book of the peers we have connected to, kept in Peers.json (in the
+node home) and keyed by peer ID. Every peer keeps several addresses, most recently
+working first, with the time it was last connected to and its success/failure counts.
+
+Peers that have not been connected to for ADDRESS_BOOK_MAX_AGE, or that keep failing,
+are pruned. Bootstrap.txt stays an import/export format: it is merged into the book at
+start, and rewritten from it (with our own addresses) when the book is saved.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// peers not connected to for this long are pruned
+	ADDRESS_BOOK_MAX_AGE = 7 * 24 * time.Hour
+	// peers failing this many dials in a row are pruned, even if seen recently
+	ADDRESS_BOOK_MAX_FAILURES = 50
+	// addresses kept per peer, the ones that worked last first
+	ADDRESS_BOOK_MAX_ADDRS = 8
+	// how often a changed book is written to disk
+	ADDRESS_BOOK_SAVE_INTERVAL = time.Minute
+)
+
+var peersFile = "Peers.json"
+
+type PeerRecord struct {
+	Addrs     []string  `json:"addrs"`
+	Added     time.Time `json:"added"`
+	LastSeen  time.Time `json:"last_seen"` // last successful connection
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"` // failed dials since the last success
+}
+
+type AddressBook struct {
+	self  peer.ID
+	mu    sync.Mutex
+	peers map[peer.ID]*PeerRecord
+	dirty bool
+}
+
+/*
+Loads Peers.json and merges Bootstrap.txt into it. A missing Peers.json gives an empty
+book; a corrupted one is reported and started over, Bootstrap.txt still being imported.
+*/
+func OpenAddressBook(self peer.ID) *AddressBook {
+	b := &AddressBook{self: self, peers: make(map[peer.ID]*PeerRecord)}
+
+	data, err := os.ReadFile(HomePath(peersFile))
+	if err == nil {
+		stored := map[string]*PeerRecord{}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			fmt.Println("Error reading address book, starting a new one:", err)
+		}
+		for id, rec := range stored {
+			p, err := peer.Decode(id)
+			if err != nil || p == self || rec == nil {
+				continue
+			}
+			b.peers[p] = rec
+		}
+	} else if !os.IsNotExist(err) {
+		fmt.Println("Error reading address book:", err)
+	}
+
+	b.Import(ReadBootstrapPeers())
+	b.Prune()
+	return b
+}
+
+// merges p2p multiaddrs (…/p2p/<peer ID>) into the book, returns how many were new
+func (b *AddressBook) Import(addrs []string) int {
+	added := 0
+	for _, addr := range addrs {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			fmt.Println("Invalid multiaddr:", addr)
+			continue
+		}
+		pi, err := peer.AddrInfoFromP2pAddr(ma)
+		if err != nil {
+			fmt.Println("Invalid peer info:", addr)
+			continue
+		}
+		added += b.Add(pi.ID, pi.Addrs...)
+	}
+	return added
+}
+
+// adds addresses of p (behind the known ones), returns how many were new
+func (b *AddressBook) Add(p peer.ID, addrs ...multiaddr.Multiaddr) int {
+	if p == b.self || len(addrs) == 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rec := b.record(p)
+	added := 0
+	for _, a := range addrs {
+		s := a.String()
+		if !contains(rec.Addrs, s) && len(rec.Addrs) < ADDRESS_BOOK_MAX_ADDRS {
+			rec.Addrs = append(rec.Addrs, s)
+			added++
+		}
+	}
+	if added > 0 {
+		b.dirty = true
+	}
+	return added
+}
+
+// records a successful connection to p through addr, moving it to the front
+func (b *AddressBook) Success(p peer.ID, addr multiaddr.Multiaddr) {
+	if p == b.self {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rec := b.record(p)
+	s := addr.String()
+	addrs := []string{s}
+	for _, a := range rec.Addrs {
+		if a != s && len(addrs) < ADDRESS_BOOK_MAX_ADDRS {
+			addrs = append(addrs, a)
+		}
+	}
+	rec.Addrs = addrs
+	rec.LastSeen = time.Now()
+	rec.Successes++
+	rec.Failures = 0
+	b.dirty = true
+}
+
+// records a failed dial to p
+func (b *AddressBook) Failure(p peer.ID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rec, ok := b.peers[p]; ok {
+		rec.Failures++
+		b.dirty = true
+	}
+}
+
+// record of p, created if missing (b.mu held)
+func (b *AddressBook) record(p peer.ID) *PeerRecord {
+	rec, ok := b.peers[p]
+	if !ok {
+		rec = &PeerRecord{Added: time.Now()}
+		b.peers[p] = rec
+	}
+	return rec
+}
+
+// removes stale and failing peers, returns how many
+func (b *AddressBook) Prune() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pruned := 0
+	for p, rec := range b.peers {
+		last := rec.LastSeen
+		if last.IsZero() {
+			last = rec.Added
+		}
+		if len(rec.Addrs) == 0 || time.Since(last) > ADDRESS_BOOK_MAX_AGE || rec.Failures >= ADDRESS_BOOK_MAX_FAILURES {
+			delete(b.peers, p)
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		b.dirty = true
+		fmt.Printf("🧹 Pruned %d stale peers from the address book\n", pruned)
+	}
+	return pruned
+}
+
+// known peers with their addresses, the most recently seen first
+func (b *AddressBook) Peers() []peer.AddrInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ids := make([]peer.ID, 0, len(b.peers))
+	for p := range b.peers {
+		ids = append(ids, p)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return b.peers[ids[i]].LastSeen.After(b.peers[ids[j]].LastSeen)
+	})
+
+	infos := make([]peer.AddrInfo, 0, len(ids))
+	for _, p := range ids {
+		pi := peer.AddrInfo{ID: p}
+		for _, a := range b.peers[p].Addrs {
+			if ma, err := multiaddr.NewMultiaddr(a); err == nil {
+				pi.Addrs = append(pi.Addrs, ma)
+			}
+		}
+		infos = append(infos, pi)
+	}
+	return infos
+}
+
+/*
+Writes Peers.json (through a temporary file, so a crash never leaves half a book) and
+exports the book to Bootstrap.txt, with our own addresses first so nodes sharing the
+file can find us. Does nothing when nothing changed, unless force.
+*/
+func (b *AddressBook) Save(selfAddrs []multiaddr.Multiaddr, force bool) error {
+	b.mu.Lock()
+	if !b.dirty && !force {
+		b.mu.Unlock()
+		return nil
+	}
+	stored := make(map[string]*PeerRecord, len(b.peers))
+	for p, rec := range b.peers {
+		copied := *rec
+		stored[p.String()] = &copied
+	}
+	b.dirty = false
+	b.mu.Unlock()
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(HomePath(peersFile), data); err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, a := range selfAddrs {
+		lines = append(lines, fmt.Sprintf("%s/p2p/%s", a, b.self))
+	}
+	for _, pi := range b.Peers() {
+		for _, a := range pi.Addrs {
+			lines = append(lines, fmt.Sprintf("%s/p2p/%s", a, pi.ID))
+		}
+	}
+	out := ""
+	for _, l := range lines {
+		out += l + "\n"
+	}
+	return writeFileAtomic(HomePath(bootstrapFile), []byte(out))
+}
+
+// writes path through a temporary file renamed over it
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
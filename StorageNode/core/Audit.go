@@ -0,0 +1,329 @@
+/*
+# Audit.go
+
+Tamper-evident local log of data access.
+
+Every stored, read, deleted or evaluated piece is appended to Audit.log as one json line
+holding who asked (actor peer ID), the CID of the piece, the manifest it belongs to (when
+known), the operation and its result. Each entry carries
+
+	hash = sha256(previous hash || canonical json of the entry without hash/signature)
+
+so changing or removing an entry breaks every hash after it. Every AUDIT_CHECKPOINT_EVERY
+entries (and every AUDIT_CHECKPOINT_INTERVAL if anything was logged) a checkpoint entry is
+signed with the node key, so the chain up to it can't be rebuilt by someone without the key.
+*/
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	AUDIT_CHECKPOINT_EVERY    = 100
+	AUDIT_CHECKPOINT_INTERVAL = time.Hour
+
+	// operations
+	AUDIT_STORE      = "store"
+	AUDIT_RETRIEVE   = "retrieve"
+	AUDIT_DELETE     = "delete"
+	AUDIT_DECRYPT    = "decrypt"
+	AUDIT_MPC        = "mpc"
+	AUDIT_VERIFY     = "verify"
+	AUDIT_CREDENTIAL = "credential"
+	AUDIT_CHECKPOINT = "checkpoint"
+)
+
+// file holding the audit log
+var auditFile = "Audit.log"
+
+type AuditEntry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`              // peer ID of the requester
+	CID       string    `json:"cid,omitempty"`      // hash of the piece
+	Manifest  string    `json:"manifest,omitempty"` // manifest the piece belongs to, when known
+	Operation string    `json:"operation"`
+	Result    string    `json:"result"` // "ok" or the error
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+	Signature []byte    `json:"signature,omitempty"` // checkpoints only, by the node key
+}
+
+// hash of an entry chained to the previous one
+func (e *AuditEntry) chainHash() (string, error) {
+	unsigned := *e
+	unsigned.Hash, unsigned.Signature = "", nil
+	body, err := canonicalJSON(unsigned)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(e.Prev), body...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/*-------------------------- WRITING -----------------------------------*/
+
+// Append-only audit log of this node
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	priv crypto.PrivKey
+
+	seq            int64
+	last           string // hash of the last entry
+	uncheckpointed int
+}
+
+// Opens (or creates) the audit log, continuing the chain where it ended
+func OpenAuditLog(path string, priv crypto.PrivKey) (*AuditLog, error) {
+	l := &AuditLog{priv: priv}
+
+	err := readAuditLog(path, func(e *AuditEntry) error {
+		l.seq, l.last = e.Seq, e.Hash
+		if e.Operation == AUDIT_CHECKPOINT {
+			l.uncheckpointed = 0
+		} else {
+			l.uncheckpointed++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Appends one event; errors are printed, a failing log must not stop the node
+func (l *AuditLog) Record(actor peer.ID, cid string, manifestID string, operation string, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.append(&AuditEntry{Actor: actor.String(), CID: cid, Manifest: manifestID, Operation: operation, Result: result}); err != nil {
+		fmt.Println("Error writing audit log:", err)
+		return
+	}
+	l.uncheckpointed++
+	if l.uncheckpointed >= AUDIT_CHECKPOINT_EVERY {
+		l.checkpoint()
+	}
+}
+
+// Signs checkpoints every AUDIT_CHECKPOINT_INTERVAL while there are new entries
+func (l *AuditLog) Run(ctx context.Context) {
+	ticker := time.NewTicker(AUDIT_CHECKPOINT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.uncheckpointed > 0 {
+				l.checkpoint()
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// writes a signed checkpoint, must hold l.mu
+func (l *AuditLog) checkpoint() {
+	self, err := peer.IDFromPrivateKey(l.priv)
+	if err != nil {
+		fmt.Println("Error writing audit checkpoint:", err)
+		return
+	}
+	if err := l.append(&AuditEntry{Actor: self.String(), Operation: AUDIT_CHECKPOINT, Result: "ok"}); err != nil {
+		fmt.Println("Error writing audit checkpoint:", err)
+		return
+	}
+	l.uncheckpointed = 0
+}
+
+// chains, signs (checkpoints) and writes an entry, must hold l.mu
+func (l *AuditLog) append(e *AuditEntry) error {
+	e.Seq = l.seq + 1
+	e.Time = time.Now().UTC()
+	e.Prev = l.last
+
+	hash, err := e.chainHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	if e.Operation == AUDIT_CHECKPOINT {
+		if e.Signature, err = l.priv.Sign([]byte(hash)); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.seq, l.last = e.Seq, e.Hash
+	return nil
+}
+
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.uncheckpointed > 0 {
+		l.checkpoint()
+	}
+	return l.file.Close()
+}
+
+/*-------------------------- READING -----------------------------------*/
+
+// calls fn for every entry of the log, in order; a missing log is empty
+func readAuditLog(path string, fn func(*AuditEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		e := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := fn(e); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// result of an audit log check
+type AuditReport struct {
+	Entries     int
+	Checkpoints int
+	Unsigned    int // entries after the last checkpoint, only protected by the chain
+}
+
+/*
+Checks the hash chain of the log and the signature of every checkpoint. Checkpoints must
+be signed by one of signers (the node, and the identities it succeeded).
+
+Entries after the last checkpoint could have been cut off without a trace; the report
+says how many there are.
+*/
+func VerifyAuditLog(path string, signers []peer.ID) (*AuditReport, error) {
+	report := &AuditReport{}
+	var seq int64
+	prev := ""
+
+	err := readAuditLog(path, func(e *AuditEntry) error {
+		if e.Seq != seq+1 {
+			return fmt.Errorf("entry %d follows entry %d", e.Seq, seq)
+		}
+		if e.Prev != prev {
+			return fmt.Errorf("entry %d is not chained to the previous one", e.Seq)
+		}
+		hash, err := e.chainHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("entry %d was modified", e.Seq)
+		}
+
+		if e.Operation == AUDIT_CHECKPOINT {
+			signer := ""
+			for _, id := range signers {
+				if id.String() == e.Actor {
+					signer = e.Actor
+				}
+			}
+			if signer == "" {
+				return fmt.Errorf("checkpoint %d signed by unknown node %s", e.Seq, e.Actor)
+			}
+			pid, err := peer.Decode(signer)
+			if err != nil {
+				return err
+			}
+			pub, err := pid.ExtractPublicKey()
+			if err != nil {
+				return err
+			}
+			if ok, err := pub.Verify([]byte(e.Hash), e.Signature); err != nil || !ok {
+				return fmt.Errorf("checkpoint %d has a bad signature", e.Seq)
+			}
+			report.Checkpoints++
+			report.Unsigned = 0
+		} else {
+			report.Unsigned++
+		}
+
+		report.Entries++
+		seq, prev = e.Seq, e.Hash
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if report.Entries == 0 {
+		return report, errors.New("audit log is empty")
+	}
+	return report, nil
+}
+
+/*
+Returns the entries about a manifest: the ones naming it, and the ones about pieces
+that were stored for it (reads and deletions only know the CID).
+*/
+func ExportAuditEntries(path string, manifestID string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	cids := make(map[string]bool)
+
+	err := readAuditLog(path, func(e *AuditEntry) error {
+		if e.Manifest == manifestID && e.CID != "" {
+			cids[e.CID] = true
+		}
+		if e.Manifest == manifestID || (e.CID != "" && cids[e.CID]) {
+			entries = append(entries, *e)
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// a closed audit log with a few entries (and the checkpoint Close signs), its path and the node key
+func writeTestAuditLog(t *testing.T) (string, crypto.PrivKey) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "Audit.log")
+	priv := testKey(t)
+	actor := testPeerID(t)
+
+	l, err := OpenAuditLog(path, priv)
+	if err != nil {
+		t.Fatalf("OpenAuditLog: %v", err)
+	}
+	l.Record(actor, "cid-1", "manifest-1", AUDIT_STORE, nil)
+	l.Record(actor, "cid-2", "manifest-2", AUDIT_STORE, nil)
+	l.Record(actor, "cid-1", "", AUDIT_RETRIEVE, nil)
+	l.Record(actor, "cid-1", "", AUDIT_DELETE, errors.New("not allowed"))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path, priv
+}
+
+func testSigners(t *testing.T, priv crypto.PrivKey) []peer.ID {
+	t.Helper()
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []peer.ID{id}
+}
+
+// rewrites the log lines with edit
+func editAuditLog(t *testing.T, path string, edit func(lines []string) []string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if err := os.WriteFile(path, []byte(strings.Join(edit(lines), "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditLogChain(t *testing.T) {
+	path, priv := writeTestAuditLog(t)
+
+	report, err := VerifyAuditLog(path, testSigners(t, priv))
+	if err != nil {
+		t.Fatalf("VerifyAuditLog: %v", err)
+	}
+	if report.Entries != 5 || report.Checkpoints != 1 || report.Unsigned != 0 {
+		t.Errorf("report = %+v", report)
+	}
+
+	//reopening continues the chain
+	l, err := OpenAuditLog(path, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(testPeerID(t), "cid-3", "manifest-1", AUDIT_STORE, nil)
+	l.file.Close()
+	report, err = VerifyAuditLog(path, testSigners(t, priv))
+	if err != nil {
+		t.Fatalf("VerifyAuditLog after reopening: %v", err)
+	}
+	if report.Entries != 6 || report.Unsigned != 1 {
+		t.Errorf("report after reopening = %+v", report)
+	}
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	cases := map[string]func(lines []string) []string{
+		"edited": func(lines []string) []string {
+			lines[3] = strings.Replace(lines[3], "not allowed", "ok", 1)
+			return lines
+		},
+		"removed": func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		},
+		"reordered": func(lines []string) []string {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		},
+		"checkpoint": func(lines []string) []string {
+			last := len(lines) - 1
+			lines[last] = strings.Replace(lines[last], `"signature":"`, `"signature":"AA`, 1)
+			return lines
+		},
+	}
+	for name, edit := range cases {
+		path, priv := writeTestAuditLog(t)
+		editAuditLog(t, path, edit)
+		if _, err := VerifyAuditLog(path, testSigners(t, priv)); err == nil {
+			t.Errorf("%s: tampered log verified", name)
+		}
+	}
+
+	//a whole log rebuilt by someone without the node key
+	path, _ := writeTestAuditLog(t)
+	if _, err := VerifyAuditLog(path, testSigners(t, testKey(t))); err == nil {
+		t.Error("accepted checkpoints of another node")
+	}
+}
+
+func TestAuditExport(t *testing.T) {
+	path, _ := writeTestAuditLog(t)
+
+	entries, err := ExportAuditEntries(path, "manifest-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, e := range entries {
+		ops = append(ops, e.Operation)
+	}
+	if got := strings.Join(ops, ","); got != "store,retrieve,delete" {
+		t.Errorf("entries of manifest-1 = %s", got)
+	}
+}
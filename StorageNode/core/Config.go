@@ -0,0 +1,380 @@
+/*
+# Config.go
+
+Node configuration file (config.yaml), written by init and loaded by every command that
+starts a node. Keys missing from the file keep their default value:
+
+	version: 1
+	roles: [storage, gateway, verifier]  # what the node serves: storage, gateway, verifier, relay (see Roles.go)
+	region: ""                        # advertised to peers, e.g. eu-west
+	network:
+	  namespace: myapp                # DHT namespace and protocol prefix
+	  listen:                         # multiaddrs to listen on
+	    - /ip4/127.0.0.1/tcp/4001
+	    - /ip4/127.0.0.1/udp/4001/quic-v1
+	  announce: []                    # addresses advertised instead of the listen ones
+	  mdns: false                     # find nodes of the namespace on the local network
+	  discovery:                      # find nodes through the DHT (see Discovery.go)
+	    enabled: true
+	    target_peers: 8               # connections to keep
+	    interval: 1m                  # time between lookups
+	  connections:                    # see Connections.go
+	    low_water: 32                 # connections kept when trimming
+	    high_water: 96                # trimming starts above this
+	    grace_period: 30s             # new connections are not trimmed before this
+	    backoff_min: 1s               # first wait before redialing a bootstrap peer
+	    backoff_max: 5m               # longest wait between redials
+	  nat:                            # NAT traversal, all off by default (see NAT.go)
+	    autonat: false
+	    port_mapping: false
+	    relay_client: false
+	    relay_service: false
+	    hole_punching: false
+	    relays: []                    # relay multiaddrs with /p2p/<peer ID>, for relay_client
+	storage:
+	  backend: mongodb
+	  uri: mongodb://localhost:27017  # the MONGO_URI environment variable overrides it
+	  database: didn_storage
+	thresholds:
+	  fragments: 5                    # n: key fragments (and MPC shares) per record, at most 255
+	  threshold: 3                    # k: fragments needed to rebuild the key, at least 2
+	timeouts:
+	  startup: 10s                    # time to connect to peers before serving
+	  request: 10s                    # one protocol request
+	  lookup: 5s                      # one DHT record lookup
+	  shutdown: 30s                   # in-flight requests may finish on SIGINT/SIGTERM
+	admins: []                        # admin node peer IDs or DIDs, never picked to store data
+	                                  # (admins advertising their role are found without it)
+
+Unknown keys and invalid values are errors naming the key (and its line in the file).
+*/
+
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"gopkg.in/yaml.v3"
+)
+
+// version of the config format this node reads and writes
+const CONFIG_VERSION = 1
+
+type Config struct {
+	Version    int             `yaml:"version"`
+	Roles      []string        `yaml:"roles,flow"`
+	Region     string          `yaml:"region"`
+	Network    NetworkConfig   `yaml:"network"`
+	Storage    StorageConfig   `yaml:"storage"`
+	Thresholds ThresholdConfig `yaml:"thresholds"`
+	Timeouts   TimeoutConfig   `yaml:"timeouts"`
+	Admins     []string        `yaml:"admins"`
+}
+
+type NetworkConfig struct {
+	Namespace   string            `yaml:"namespace"`
+	Listen      []string          `yaml:"listen"`
+	Announce    []string          `yaml:"announce"`
+	MDNS        bool              `yaml:"mdns"`
+	Discovery   DiscoveryConfig   `yaml:"discovery"`
+	Connections ConnectionsConfig `yaml:"connections"`
+	NAT         NATConfig         `yaml:"nat"`
+}
+
+type StorageConfig struct {
+	Backend  string `yaml:"backend"`
+	URI      string `yaml:"uri"`
+	Database string `yaml:"database"`
+}
+
+type ThresholdConfig struct {
+	Fragments int `yaml:"fragments"`
+	Threshold int `yaml:"threshold"`
+}
+
+type TimeoutConfig struct {
+	Startup  time.Duration `yaml:"startup"`
+	Request  time.Duration `yaml:"request"`
+	Lookup   time.Duration `yaml:"lookup"`
+	Shutdown time.Duration `yaml:"shutdown"` // how long in-flight requests may take to finish
+}
+
+// configuration of a node without config file
+func DefaultConfig() *Config {
+	return &Config{
+		Version: CONFIG_VERSION,
+		Roles:   []string{ROLE_STORAGE, ROLE_GATEWAY, ROLE_VERIFIER},
+		Network: NetworkConfig{
+			Namespace: "myapp",
+			Listen:    []string{"/ip4/127.0.0.1/tcp/4001", "/ip4/127.0.0.1/udp/4001/quic-v1"},
+			Announce:  []string{},
+			Discovery: DiscoveryConfig{Enabled: true, TargetPeers: 8, Interval: time.Minute},
+			Connections: ConnectionsConfig{
+				LowWater:    32,
+				HighWater:   96,
+				GracePeriod: 30 * time.Second,
+				BackoffMin:  time.Second,
+				BackoffMax:  5 * time.Minute,
+			},
+			NAT: NATConfig{Relays: []string{}},
+		},
+		Storage: StorageConfig{
+			Backend:  "mongodb",
+			URI:      "mongodb://localhost:27017",
+			Database: "didn_storage",
+		},
+		Thresholds: ThresholdConfig{Fragments: 5, Threshold: 3},
+		Timeouts: TimeoutConfig{
+			Startup:  10 * time.Second,
+			Request:  10 * time.Second,
+			Lookup:   5 * time.Second,
+			Shutdown: 30 * time.Second,
+		},
+		Admins: []string{},
+	}
+}
+
+// Writes a configuration to path
+func WriteConfig(path string, cfg *Config) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	header := "# Node configuration, keys left out take their default value\n"
+	return os.WriteFile(path, append([]byte(header), data...), 0644)
+}
+
+// Reads and validates a config file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultConfig()
+	cfg.Version = 0
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		var keyErr *ConfigError
+		if errors.As(err, &keyErr) {
+			keyErr.Line = configLine(data, keyErr.Key)
+			keyErr.File = path
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// invalid value in the configuration
+type ConfigError struct {
+	File string
+	Line int
+	Key  string // dotted path, e.g. network.listen[1]
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	switch {
+	case e.File != "" && e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Key, e.Msg)
+	case e.File != "":
+		return fmt.Sprintf("%s: %s: %s", e.File, e.Key, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Key, e.Msg)
+}
+
+func keyError(key string, format string, args ...interface{}) error {
+	return &ConfigError{Key: key, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Checks every value, returning a *ConfigError for the first invalid one
+func (c *Config) Validate() error {
+	switch {
+	case c.Version == 0:
+		return keyError("version", "missing")
+	case c.Version > CONFIG_VERSION:
+		return keyError("version", "%d is newer than this node supports (%d)", c.Version, CONFIG_VERSION)
+	case c.Version < 0:
+		return keyError("version", "invalid version %d", c.Version)
+	}
+
+	if c.Network.Namespace == "" || strings.ContainsAny(c.Network.Namespace, "/ ") {
+		return keyError("network.namespace", "must be a non-empty name without '/' or spaces")
+	}
+	if len(c.Network.Listen) == 0 {
+		return keyError("network.listen", "at least one address is needed")
+	}
+	for i, addr := range c.Network.Listen {
+		if _, err := multiaddr.NewMultiaddr(addr); err != nil {
+			return keyError(fmt.Sprintf("network.listen[%d]", i), "invalid multiaddr %q: %v", addr, err)
+		}
+	}
+	for i, addr := range c.Network.Announce {
+		if _, err := multiaddr.NewMultiaddr(addr); err != nil {
+			return keyError(fmt.Sprintf("network.announce[%d]", i), "invalid multiaddr %q: %v", addr, err)
+		}
+	}
+	if c.Network.Discovery.TargetPeers < 1 {
+		return keyError("network.discovery.target_peers", "must be at least 1")
+	}
+	if c.Network.Discovery.Interval <= 0 {
+		return keyError("network.discovery.interval", "must be a positive duration (e.g. 1m)")
+	}
+
+	conns := c.Network.Connections
+	if conns.LowWater < 1 {
+		return keyError("network.connections.low_water", "must be at least 1")
+	}
+	if conns.HighWater <= conns.LowWater {
+		return keyError("network.connections.high_water", "must be above low_water (%d)", conns.LowWater)
+	}
+	if conns.GracePeriod < 0 {
+		return keyError("network.connections.grace_period", "must not be negative")
+	}
+	if conns.BackoffMin <= 0 {
+		return keyError("network.connections.backoff_min", "must be a positive duration (e.g. 1s)")
+	}
+	if conns.BackoffMax < conns.BackoffMin {
+		return keyError("network.connections.backoff_max", "must not be below backoff_min (%s)", conns.BackoffMin)
+	}
+
+	for i, addr := range c.Network.NAT.Relays {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err == nil {
+			_, err = peer.AddrInfoFromP2pAddr(ma)
+		}
+		if err != nil {
+			return keyError(fmt.Sprintf("network.nat.relays[%d]", i), "not a relay multiaddr with /p2p/<peer ID> %q: %v", addr, err)
+		}
+	}
+	if c.Network.NAT.RelayClient && len(c.Network.NAT.Relays) == 0 {
+		return keyError("network.nat.relays", "relay_client needs at least one relay")
+	}
+
+	if c.Storage.Backend != "mongodb" {
+		return keyError("storage.backend", "unsupported backend %q (only mongodb)", c.Storage.Backend)
+	}
+	if !strings.HasPrefix(c.Storage.URI, "mongodb://") && !strings.HasPrefix(c.Storage.URI, "mongodb+srv://") {
+		return keyError("storage.uri", "not a mongodb:// URI")
+	}
+	if c.Storage.Database == "" {
+		return keyError("storage.database", "missing")
+	}
+
+	//a single fragment would let one holder decrypt alone
+	if c.Thresholds.Fragments < 2 || c.Thresholds.Fragments > MAX_SHARES {
+		return keyError("thresholds.fragments", "must be between 2 and %d", MAX_SHARES)
+	}
+	if c.Thresholds.Threshold < 2 || c.Thresholds.Threshold > c.Thresholds.Fragments {
+		return keyError("thresholds.threshold", "must be between 2 and fragments (%d)", c.Thresholds.Fragments)
+	}
+
+	for key, d := range map[string]time.Duration{
+		"timeouts.startup":  c.Timeouts.Startup,
+		"timeouts.request":  c.Timeouts.Request,
+		"timeouts.lookup":   c.Timeouts.Lookup,
+		"timeouts.shutdown": c.Timeouts.Shutdown,
+	} {
+		if d <= 0 {
+			return keyError(key, "must be a positive duration (e.g. 10s)")
+		}
+	}
+
+	for i, ref := range c.Admins {
+		if _, err := ParseNodeRef(ref); err != nil {
+			return keyError(fmt.Sprintf("admins[%d]", i), "not a peer ID or did:key: %v", err)
+		}
+	}
+
+	if len(c.Roles) == 0 {
+		return keyError("roles", "at least one role is needed (%s)", strings.Join(NODE_ROLES, ", "))
+	}
+	for i, role := range c.Roles {
+		if !hasRole(NODE_ROLES, role) {
+			return keyError(fmt.Sprintf("roles[%d]", i), "unknown role %q, expected one of %s", role, strings.Join(NODE_ROLES, ", "))
+		}
+		if hasRole(c.Roles[:i], role) {
+			return keyError(fmt.Sprintf("roles[%d]", i), "role %q listed twice", role)
+		}
+	}
+	return nil
+}
+
+// NAT settings, with the relay service on for the relay role
+func (c *Config) NATSettings() NATConfig {
+	nat := c.Network.NAT
+	if hasRole(c.Roles, ROLE_RELAY) {
+		nat.RelayService = true
+	}
+	return nat
+}
+
+// peer IDs of the admin nodes
+func (c *Config) AdminIDs() map[peer.ID]bool {
+	admins := make(map[peer.ID]bool)
+	for _, ref := range c.Admins {
+		if pid, err := ParseNodeRef(ref); err == nil {
+			admins[pid] = true
+		}
+	}
+	return admins
+}
+
+// line of a dotted key (with [i] indexes) in a yaml document, 0 if not found
+func configLine(data []byte, key string) int {
+	root := yaml.Node{}
+	if err := yaml.Unmarshal(data, &root); err != nil || len(root.Content) == 0 {
+		return 0
+	}
+
+	node := root.Content[0]
+	for _, part := range strings.Split(key, ".") {
+		name, index := part, -1
+		if i := strings.Index(part, "["); i >= 0 && strings.HasSuffix(part, "]") {
+			name = part[:i]
+			n, err := strconv.Atoi(part[i+1 : len(part)-1])
+			if err != nil {
+				return 0
+			}
+			index = n
+		}
+
+		if node.Kind != yaml.MappingNode {
+			return 0
+		}
+		var value *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == name {
+				value = node.Content[i+1]
+				if index < 0 && value.Kind != yaml.MappingNode {
+					//point at the key itself
+					return node.Content[i].Line
+				}
+			}
+		}
+		if value == nil {
+			return 0
+		}
+		node = value
+		if index >= 0 {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return node.Line
+			}
+			node = node.Content[index]
+		}
+	}
+	return node.Line
+}
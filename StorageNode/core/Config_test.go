@@ -0,0 +1,62 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+}
+
+func TestConfigThresholds(t *testing.T) {
+	cases := []struct {
+		fragments, threshold int
+		key                  string // offending key, "" if valid
+	}{
+		{5, 3, ""},
+		{2, 2, ""},
+		{MAX_SHARES, MAX_SHARES, ""},
+		{5, 1, "thresholds.threshold"},
+		{5, 0, "thresholds.threshold"},
+		{3, 4, "thresholds.threshold"},
+		{1, 1, "thresholds.fragments"},
+		{MAX_SHARES + 1, 3, "thresholds.fragments"},
+	}
+	for _, c := range cases {
+		cfg := DefaultConfig()
+		cfg.Thresholds = ThresholdConfig{Fragments: c.fragments, Threshold: c.threshold}
+		err := cfg.Validate()
+
+		var keyErr *ConfigError
+		switch {
+		case c.key == "" && err != nil:
+			t.Errorf("%d of %d: %v", c.threshold, c.fragments, err)
+		case c.key != "" && !errors.As(err, &keyErr):
+			t.Errorf("%d of %d: accepted (%v)", c.threshold, c.fragments, err)
+		case c.key != "" && keyErr.Key != c.key:
+			t.Errorf("%d of %d: error on %s, want %s", c.threshold, c.fragments, keyErr.Key, c.key)
+		}
+	}
+}
+
+func TestLoadConfigErrorLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "version: 1\nthresholds:\n  fragments: 5\n  threshold: 1\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadConfig(path)
+	var keyErr *ConfigError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if keyErr.Key != "thresholds.threshold" || keyErr.Line != 4 || keyErr.File != path {
+		t.Errorf("error = %+v", keyErr)
+	}
+}
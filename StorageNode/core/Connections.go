@@ -0,0 +1,238 @@
+/*
+# Connections.go
+
+Connection management.
+
+The libp2p connection manager keeps the number of connections between the low and high
+watermarks of network.connections in config.yaml, trimming the least useful ones first.
+Bootstrap and admin peers are protected from trimming.
+
+The peers of the address book (see AddressBook.go) are dialed once at start and again
+only when the last connection to one of them closes, waiting longer after every failed
+dial (exponential backoff per peer, reset when a connection succeeds). Outbound
+connections and failed dials are recorded in the book, which is saved periodically.
+A status line is printed when the number of peers or the reachability changes.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+)
+
+const (
+	// how often the status line is checked for changes
+	CONNECTIONS_STATUS_INTERVAL = 30 * time.Second
+	// tags protecting connections from trimming
+	PROTECT_BOOTSTRAP = "bootstrap"
+	PROTECT_ADMIN     = "admin"
+)
+
+type ConnectionsConfig struct {
+	LowWater    int           `yaml:"low_water"`
+	HighWater   int           `yaml:"high_water"`
+	GracePeriod time.Duration `yaml:"grace_period"`
+	BackoffMin  time.Duration `yaml:"backoff_min"`
+	BackoffMax  time.Duration `yaml:"backoff_max"`
+}
+
+// libp2p connection manager with the configured watermarks
+func ConnManagerOption(cfg ConnectionsConfig) (libp2p.Option, error) {
+	cm, err := connmgr.NewConnManager(cfg.LowWater, cfg.HighWater, connmgr.WithGracePeriod(cfg.GracePeriod))
+	if err != nil {
+		return nil, err
+	}
+	return libp2p.ConnectionManager(cm), nil
+}
+
+// Keeps the node connected to the peers of its address book until ctx is done
+type Connector struct {
+	ctx   context.Context
+	h     host.Host
+	cfg   ConnectionsConfig
+	book  *AddressBook
+	peers map[peer.ID]peer.AddrInfo
+	saved chan struct{} // closed after the last save of the book
+
+	mu      sync.Mutex
+	backoff map[peer.ID]time.Duration // delay before the next dial, 0 after a success
+	pending map[peer.ID]bool          // a dial is scheduled or running
+}
+
+/*
+Protects the known and admin peers, dials the known peers and redials them when they
+are lost. Returns at once; everything stops with ctx, after a last save of the book.
+*/
+func KeepConnected(ctx context.Context, h host.Host, book *AddressBook, cfg *Config) *Connector {
+	c := &Connector{
+		ctx:     ctx,
+		h:       h,
+		cfg:     cfg.Network.Connections,
+		book:    book,
+		peers:   make(map[peer.ID]peer.AddrInfo),
+		saved:   make(chan struct{}),
+		backoff: make(map[peer.ID]time.Duration),
+		pending: make(map[peer.ID]bool),
+	}
+	for _, pi := range book.Peers() {
+		c.peers[pi.ID] = pi
+	}
+
+	for id := range c.peers {
+		h.ConnManager().Protect(id, PROTECT_BOOTSTRAP)
+	}
+	for id := range cfg.AdminIDs() {
+		h.ConnManager().Protect(id, PROTECT_ADMIN)
+	}
+
+	notifiee := &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			//the remote address of inbound connections is not one we could dial
+			if conn.Stat().Direction == network.DirOutbound {
+				book.Success(conn.RemotePeer(), conn.RemoteMultiaddr())
+			}
+			c.connected(conn.RemotePeer())
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			p := conn.RemotePeer()
+			if _, ok := c.peers[p]; ok && n.Connectedness(p) != network.Connected {
+				c.schedule(p)
+			}
+		},
+	}
+	h.Network().Notify(notifiee)
+
+	for id := range c.peers {
+		c.schedule(id)
+	}
+
+	go c.saveBook()
+	go func() {
+		c.status()
+		h.Network().StopNotify(notifiee)
+	}()
+	return c
+}
+
+// waits for the last save of the address book, once ctx is done
+func (c *Connector) Wait() {
+	<-c.saved
+}
+
+// saves the address book when it changed, and once more when ctx is done
+func (c *Connector) saveBook() {
+	defer close(c.saved)
+	ticker := time.NewTicker(ADDRESS_BOOK_SAVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			if err := c.book.Save(c.h.Addrs(), true); err != nil {
+				fmt.Println("Error saving address book:", err)
+			}
+			return
+		case <-ticker.C:
+			c.book.Prune()
+			if err := c.book.Save(c.h.Addrs(), false); err != nil {
+				fmt.Println("Error saving address book:", err)
+			}
+		}
+	}
+}
+
+// resets the backoff of a known peer we got connected to
+func (c *Connector) connected(p peer.ID) {
+	if _, ok := c.peers[p]; !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backoff[p] = 0
+}
+
+// dials p after its current backoff, unless a dial is already on the way
+func (c *Connector) schedule(p peer.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[p] || c.ctx.Err() != nil {
+		return
+	}
+	c.pending[p] = true
+	time.AfterFunc(c.backoff[p], func() { c.dial(p) })
+}
+
+func (c *Connector) dial(p peer.ID) {
+	if c.ctx.Err() != nil {
+		return
+	}
+	err := error(nil)
+	if c.h.Network().Connectedness(p) != network.Connected {
+		err = c.h.Connect(c.ctx, c.peers[p])
+		ExplainDialError(p, err)
+		if err != nil {
+			c.book.Failure(p)
+		}
+	}
+
+	c.mu.Lock()
+	c.pending[p] = false
+	if err == nil {
+		c.backoff[p] = 0
+		c.mu.Unlock()
+		return
+	}
+	c.backoff[p] = c.nextBackoff(c.backoff[p])
+	c.mu.Unlock()
+	c.schedule(p)
+}
+
+// doubles the delay (with some jitter so peers don't dial in lockstep), within the bounds
+func (c *Connector) nextBackoff(last time.Duration) time.Duration {
+	next := 2 * last
+	if next < c.cfg.BackoffMin {
+		next = c.cfg.BackoffMin
+	}
+	if next > c.cfg.BackoffMax {
+		next = c.cfg.BackoffMax
+	}
+	jitter := time.Duration(rand.Int63n(int64(next)/5 + 1))
+	return next - next/10 + jitter
+}
+
+// prints the status line when it changes, until ctx is done
+func (c *Connector) status() {
+	ticker := time.NewTicker(CONNECTIONS_STATUS_INTERVAL)
+	defer ticker.Stop()
+
+	last := ""
+	for {
+		connected := 0
+		for id := range c.peers {
+			if c.h.Network().Connectedness(id) == network.Connected {
+				connected++
+			}
+		}
+		line := fmt.Sprintf("📶 Peers: %d (known %d/%d) | Reachability: %s",
+			len(c.h.Network().Peers()), connected, len(c.peers), Reachability())
+		if line != last {
+			fmt.Println(line)
+			last = line
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
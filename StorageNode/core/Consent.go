@@ -0,0 +1,165 @@
+/*
+# Consent.go
+
+Consent tokens signed by the user a record belongs to.
+
+A record uploaded with an owner key (a did:key in the upload payload, kept in the
+manifest) can only be reconstructed or evaluated when the request carries a consent
+token signed by that key. The token names the verification request it answers, the
+provider that asked, the requester (the node that sends the verification request for
+it), the manifest, the hash of the criteria (see CriteriaHash) and an expiry, and is
+signed over its canonical json without the signature.
+
+The consent travels inside the verification request (VerifyRequest, CredentialRequest),
+and the node serving it forwards that request, exactly as the requester signed it, to
+the fragment and share holders it asks for help. So every node touching the record
+checks the same things: the owner signature, the manifest, the expiry, that the request
+was signed by the requester named in the token and sent to the node now asking, and that
+its criteria are the consented ones. A stolen token is useless to anyone but its
+requester, and only for the criteria the user saw.
+
+Key rotation has no user in the loop: holders accept requests without consent from
+members whose certificate has the "admin" role.
+
+Every record placed since consent has an owner key (the upload is refused without one).
+Records without one predate consent (see MANIFEST_FORMAT_LEGACY) and are not checked. A
+manifest can't lose its owner or format once it has one, see the manifest rules in
+Validators.go.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// membership role allowed to reconstruct owned records without consent (key rotation)
+const CONSENT_EXEMPT_ROLE = "admin"
+
+type ConsentToken struct {
+	RequestID    string    `json:"request_id"`  // verification request the user accepted
+	ProviderID   string    `json:"provider_id"` // provider that asked for it, its DID when it has one
+	Requester    string    `json:"requester"`   // did:key (or peer ID) of the node sending the verification request
+	ManifestID   string    `json:"manifest_id"`
+	CriteriaHash string    `json:"criteria_hash"`
+	Expiry       time.Time `json:"expiry"`
+	Signature    []byte    `json:"signature,omitempty"` // by the record owner key
+}
+
+// Signs a consent token with the owner key
+func SignConsent(owner crypto.PrivKey, c *ConsentToken) error {
+	c.Expiry = c.Expiry.UTC()
+	c.Signature = nil
+
+	msg, err := canonicalJSON(c)
+	if err != nil {
+		return err
+	}
+	c.Signature, err = owner.Sign(msg)
+	return err
+}
+
+// Checks the token signature (against the owner did:key), the manifest and the expiry
+func (c *ConsentToken) Verify(owner string, manifestID string) error {
+	pub, err := PubKeyFromDID(owner)
+	if err != nil {
+		return fmt.Errorf("record owner: %v", err)
+	}
+
+	unsigned := *c
+	unsigned.Signature = nil
+	msg, err := canonicalJSON(unsigned)
+	if err != nil {
+		return err
+	}
+	if ok, err := pub.Verify(msg, c.Signature); err != nil || !ok {
+		return errors.New("consent not signed by the record owner")
+	}
+
+	if c.ManifestID != manifestID {
+		return errors.New("consent given for another record")
+	}
+	if time.Now().After(c.Expiry) {
+		return errors.New("consent expired")
+	}
+	return nil
+}
+
+// the fields of a verification request (VerifyRequest, CredentialRequest) consent is about
+type consentedRequest struct {
+	ManifestID string        `json:"manifest_id"`
+	Criteria   Criteria      `json:"criteria"`
+	Consent    *ConsentToken `json:"consent,omitempty"`
+}
+
+// a verification request whose consent was checked, see CheckConsent
+type ConsentedRequest struct {
+	Requester    peer.ID
+	Consent      *ConsentToken
+	CriteriaHash string
+}
+
+/*
+Checks that a verification request allows touching the record behind m.
+
+request is the envelope the requester sent to the node serving the verification (via):
+holders get it forwarded by via, which checks it as received. Its nonce was used by via,
+so only its signature, recipient, protocol and freshness are checked here.
+
+Returns nil (and no error) for records placed before consent without an owner.
+*/
+func CheckConsent(m *Manifest, request *Envelope, via peer.ID) (*ConsentedRequest, error) {
+	if m.Owner == "" {
+		if m.Format != MANIFEST_FORMAT_LEGACY {
+			return nil, errors.New("record has no owner")
+		}
+		return nil, nil
+	}
+	if request == nil {
+		return nil, errors.New("consent required")
+	}
+
+	var requester peer.ID
+	var err error
+	switch protocol.ID(request.Protocol) {
+	case VERIFY_PROTOCOL, CREDENTIAL_PROTOCOL:
+		requester, err = request.check(via, protocol.ID(request.Protocol))
+	default:
+		err = errors.New("not a verification request")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("verification request: %v", err)
+	}
+
+	req := consentedRequest{}
+	if err := json.Unmarshal(request.Payload, &req); err != nil {
+		return nil, fmt.Errorf("verification request: %v", err)
+	}
+	if req.Consent == nil {
+		return nil, errors.New("consent required")
+	}
+	if req.ManifestID != m.ID {
+		return nil, errors.New("verification request for another record")
+	}
+	if err := req.Consent.Verify(m.Owner, m.ID); err != nil {
+		return nil, err
+	}
+
+	bound, err := ParseNodeRef(req.Consent.Requester)
+	if err != nil || bound != requester {
+		return nil, errors.New("consent given to another requester")
+	}
+	criteriaHash, err := CriteriaHash(req.Criteria)
+	if err != nil || req.Consent.CriteriaHash != criteriaHash {
+		return nil, errors.New("consent given for another criteria")
+	}
+
+	return &ConsentedRequest{Requester: requester, Consent: req.Consent, CriteriaHash: criteriaHash}, nil
+}
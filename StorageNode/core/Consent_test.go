@@ -0,0 +1,146 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var testCriteria = Criteria{All: []Rule{{Field: "DOB.year", Type: "less", Value: float64(2007)}}}
+
+// a record owned by a fresh key, and that key
+func ownedTestManifest(t *testing.T) (*Manifest, crypto.PrivKey) {
+	t.Helper()
+	owner := testKey(t)
+	did, err := DIDFromPubKey(owner.GetPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Manifest{ID: "manifest-1", Owner: did}, owner
+}
+
+// a consent for requester on c, signed by owner for m
+func testConsent(t *testing.T, owner crypto.PrivKey, m *Manifest, requester crypto.PrivKey, c Criteria) *ConsentToken {
+	t.Helper()
+	id, err := peer.IDFromPrivateKey(requester)
+	if err != nil {
+		t.Fatal(err)
+	}
+	criteriaHash, err := CriteriaHash(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := &ConsentToken{
+		RequestID:    "request-1",
+		ProviderID:   "provider",
+		Requester:    nodeRef(id),
+		ManifestID:   m.ID,
+		CriteriaHash: criteriaHash,
+		Expiry:       time.Now().Add(time.Hour),
+	}
+	if err := SignConsent(owner, token); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// the verification request requester sends to verifier
+func testVerifyRequest(t *testing.T, requester crypto.PrivKey, verifier peer.ID, m *Manifest, c Criteria, consent *ConsentToken) *Envelope {
+	t.Helper()
+	env, err := SealEnvelope(requester, verifier, VERIFY_PROTOCOL, VerifyRequest{ManifestID: m.ID, Criteria: c, Consent: consent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestConsentForwarded(t *testing.T) {
+	m, owner := ownedTestManifest(t)
+	requester, verifier := testKey(t), testPeerID(t)
+	env := testVerifyRequest(t, requester, verifier, m, testCriteria, testConsent(t, owner, m, requester, testCriteria))
+
+	consented, err := CheckConsent(m, env, verifier)
+	if err != nil {
+		t.Fatalf("CheckConsent: %v", err)
+	}
+	if want, _ := peer.IDFromPrivateKey(requester); consented.Requester != want {
+		t.Errorf("requester = %s, want %s", consented.Requester, want)
+	}
+	if want, _ := CriteriaHash(testCriteria); consented.CriteriaHash != want {
+		t.Errorf("criteria hash = %s", consented.CriteriaHash)
+	}
+
+	//holders checking it as forwarded by another node
+	if _, err := CheckConsent(m, env, testPeerID(t)); err == nil {
+		t.Error("accepted a request sent to another node")
+	}
+}
+
+func TestConsentBinding(t *testing.T) {
+	m, owner := ownedTestManifest(t)
+	requester, verifier := testKey(t), testPeerID(t)
+	other := Criteria{All: []Rule{{Field: "Gender", Type: "equal", Value: "female"}}}
+
+	cases := map[string]*Envelope{
+		//a stolen token sent by someone else
+		"requester": testVerifyRequest(t, testKey(t), verifier, m, testCriteria, testConsent(t, owner, m, requester, testCriteria)),
+		"criteria":  testVerifyRequest(t, requester, verifier, m, other, testConsent(t, owner, m, requester, testCriteria)),
+		"owner":     testVerifyRequest(t, requester, verifier, m, testCriteria, testConsent(t, testKey(t), m, requester, testCriteria)),
+		"missing":   testVerifyRequest(t, requester, verifier, m, testCriteria, nil),
+	}
+	for name, env := range cases {
+		if _, err := CheckConsent(m, env, verifier); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	//a token for another record
+	otherRecord := &Manifest{ID: "manifest-2", Owner: m.Owner}
+	env := testVerifyRequest(t, requester, verifier, m, testCriteria, testConsent(t, owner, otherRecord, requester, testCriteria))
+	if _, err := CheckConsent(m, env, verifier); err == nil {
+		t.Error("accepted a consent for another record")
+	}
+
+	//the same payload sealed for a protocol that is not a verification
+	env, err := SealEnvelope(requester, verifier, RETRIEVE_PROTOCOL, VerifyRequest{ManifestID: m.ID, Criteria: testCriteria, Consent: testConsent(t, owner, m, requester, testCriteria)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckConsent(m, env, verifier); err == nil {
+		t.Error("accepted a request that is not a verification")
+	}
+}
+
+func TestConsentExpired(t *testing.T) {
+	m, owner := ownedTestManifest(t)
+	requester, verifier := testKey(t), testPeerID(t)
+
+	consent := testConsent(t, owner, m, requester, testCriteria)
+	consent.Expiry = time.Now().Add(-time.Minute)
+	if err := SignConsent(owner, consent); err != nil {
+		t.Fatal(err)
+	}
+	env := testVerifyRequest(t, requester, verifier, m, testCriteria, consent)
+	if _, err := CheckConsent(m, env, verifier); err == nil || err.Error() != "consent expired" {
+		t.Errorf("CheckConsent of an expired consent: %v", err)
+	}
+}
+
+func TestConsentOwnerless(t *testing.T) {
+	consented, err := CheckConsent(&Manifest{ID: "manifest-1"}, nil, testPeerID(t))
+	if err != nil || consented != nil {
+		t.Errorf("CheckConsent of a record without owner: %v %v", consented, err)
+	}
+
+	placed := &Manifest{ID: "manifest-1", Format: MANIFEST_FORMAT_CONSENT}
+	if _, err := CheckConsent(placed, nil, testPeerID(t)); err == nil {
+		t.Error("exempted a record placed since consent")
+	}
+
+	m, _ := ownedTestManifest(t)
+	if _, err := CheckConsent(m, nil, testPeerID(t)); err == nil {
+		t.Error("accepted no request for an owned record")
+	}
+}
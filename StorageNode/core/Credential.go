@@ -0,0 +1,197 @@
+/*
+# Credential.go
+
+Verification verdicts emitted as W3C Verifiable Credentials.
+
+The issuer is the did:key of the node's Ed25519 identity key, and the proof is a
+DataIntegrityProof using the eddsa-jcs-2022 cryptosuite: the Ed25519 signature covers
+sha256(canonical proof options) || sha256(canonical credential without proof).
+
+Because the issuer DID contains the public key, a provider can check a credential
+offline with VerifyCredential, without trusting our databases.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/multiformats/go-multibase"
+)
+
+// how long a verification verdict is valid
+const CREDENTIAL_TTL = 30 * 24 * time.Hour
+
+type VerifiableCredential struct {
+	Context           []string          `json:"@context"`
+	Type              []string          `json:"type"`
+	Issuer            string            `json:"issuer"`
+	ValidFrom         string            `json:"validFrom"`
+	ValidUntil        string            `json:"validUntil"`
+	CredentialSubject VerificationClaim `json:"credentialSubject"`
+	Proof             *DataProof        `json:"proof,omitempty"`
+}
+
+// what the credential states: the record behind a manifest did (not) meet a criteria
+type VerificationClaim struct {
+	ID           string `json:"id"`           // manifest the verification ran on
+	CriteriaHash string `json:"criteriaHash"` // see CriteriaHash
+	Result       bool   `json:"result"`
+}
+
+type DataProof struct {
+	Type               string `json:"type"`
+	Cryptosuite        string `json:"cryptosuite"`
+	Created            string `json:"created"`
+	VerificationMethod string `json:"verificationMethod"`
+	ProofPurpose       string `json:"proofPurpose"`
+	ProofValue         string `json:"proofValue,omitempty"`
+}
+
+// Issues a signed verification verdict
+func IssueVerificationCredential(priv crypto.PrivKey, manifestID string, criteriaHash string, result bool) (*VerifiableCredential, error) {
+	issuer, err := DIDFromPubKey(priv.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	vc := &VerifiableCredential{
+		Context:    []string{"https://www.w3.org/ns/credentials/v2"},
+		Type:       []string{"VerifiableCredential", "VerificationResultCredential"},
+		Issuer:     issuer,
+		ValidFrom:  now.Format(time.RFC3339),
+		ValidUntil: now.Add(CREDENTIAL_TTL).Format(time.RFC3339),
+		CredentialSubject: VerificationClaim{
+			ID:           manifestID,
+			CriteriaHash: criteriaHash,
+			Result:       result,
+		},
+	}
+
+	proof := &DataProof{
+		Type:               "DataIntegrityProof",
+		Cryptosuite:        "eddsa-jcs-2022",
+		Created:            now.Format(time.RFC3339),
+		VerificationMethod: issuer + "#" + strings.TrimPrefix(issuer, "did:key:"),
+		ProofPurpose:       "assertionMethod",
+	}
+
+	input, err := proofInput(vc, proof)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := priv.Sign(input)
+	if err != nil {
+		return nil, err
+	}
+	proof.ProofValue, err = multibase.Encode(multibase.Base58BTC, sig)
+	if err != nil {
+		return nil, err
+	}
+
+	vc.Proof = proof
+	return vc, nil
+}
+
+// Checks the proof and validity period of a verification credential
+func VerifyCredential(vc *VerifiableCredential) error {
+	if vc.Proof == nil {
+		return errors.New("credential has no proof")
+	}
+	if vc.Proof.Type != "DataIntegrityProof" || vc.Proof.Cryptosuite != "eddsa-jcs-2022" {
+		return fmt.Errorf("unsupported proof %s/%s", vc.Proof.Type, vc.Proof.Cryptosuite)
+	}
+	if !strings.HasPrefix(vc.Proof.VerificationMethod, vc.Issuer+"#") {
+		return errors.New("proof not made by the issuer")
+	}
+
+	pub, err := PubKeyFromDID(vc.Issuer)
+	if err != nil {
+		return err
+	}
+
+	_, sig, err := multibase.Decode(vc.Proof.ProofValue)
+	if err != nil {
+		return fmt.Errorf("invalid proof value: %v", err)
+	}
+
+	unsigned := *vc.Proof
+	unsigned.ProofValue = ""
+	input, err := proofInput(vc, &unsigned)
+	if err != nil {
+		return err
+	}
+	if ok, err := pub.Verify(input, sig); err != nil || !ok {
+		return errors.New("bad credential signature")
+	}
+
+	now := time.Now().UTC()
+	from, err := time.Parse(time.RFC3339, vc.ValidFrom)
+	if err != nil || now.Before(from) {
+		return errors.New("credential not valid yet")
+	}
+	until, err := time.Parse(time.RFC3339, vc.ValidUntil)
+	if err != nil || now.After(until) {
+		return errors.New("credential expired")
+	}
+	return nil
+}
+
+/*-------------------------- HELPERS -----------------------------------*/
+
+// signing input of a credential proof
+func proofInput(vc *VerifiableCredential, proof *DataProof) ([]byte, error) {
+	doc := *vc
+	doc.Proof = nil
+	return jcsProofInput(vc.Context, proof, doc)
+}
+
+// eddsa-jcs-2022 signing input: sha256(proof options) || sha256(document without proof)
+func jcsProofInput(context []string, proof *DataProof, doc interface{}) ([]byte, error) {
+	options := struct {
+		Context []string `json:"@context"`
+		*DataProof
+	}{context, proof}
+
+	canonOptions, err := canonicalJSON(options)
+	if err != nil {
+		return nil, err
+	}
+	canonDoc, err := canonicalJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	optionsHash := sha256.Sum256(canonOptions)
+	docHash := sha256.Sum256(canonDoc)
+	return append(optionsHash[:], docHash[:]...), nil
+}
+
+// json with sorted keys and no html escaping (JCS for the values we produce: strings, bools, ints)
+func canonicalJSON(v interface{}) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multibase"
+)
+
+func TestCredentialRoundTrip(t *testing.T) {
+	vc, err := IssueVerificationCredential(testKey(t), "manifest-1", "criteria-1", true)
+	if err != nil {
+		t.Fatalf("IssueVerificationCredential: %v", err)
+	}
+
+	//providers get it as json
+	raw, err := json.Marshal(vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := &VerifiableCredential{}
+	if err := json.Unmarshal(raw, received); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyCredential(received); err != nil {
+		t.Fatalf("VerifyCredential: %v", err)
+	}
+}
+
+func TestCredentialTampering(t *testing.T) {
+	issue := func() *VerifiableCredential {
+		vc, err := IssueVerificationCredential(testKey(t), "manifest-1", "criteria-1", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vc
+	}
+	other, err := DIDFromPubKey(testKey(t).GetPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]func(vc *VerifiableCredential){
+		"result":   func(vc *VerifiableCredential) { vc.CredentialSubject.Result = true },
+		"subject":  func(vc *VerifiableCredential) { vc.CredentialSubject.ID = "manifest-2" },
+		"criteria": func(vc *VerifiableCredential) { vc.CredentialSubject.CriteriaHash = "criteria-2" },
+		"expiry": func(vc *VerifiableCredential) {
+			vc.ValidUntil = time.Now().Add(365 * 24 * time.Hour).UTC().Format(time.RFC3339)
+		},
+		"issuer": func(vc *VerifiableCredential) { vc.Issuer = other },
+		"method": func(vc *VerifiableCredential) { vc.Proof.VerificationMethod = other + "#key" },
+		"proof":  func(vc *VerifiableCredential) { vc.Proof = nil },
+		"suite":  func(vc *VerifiableCredential) { vc.Proof.Cryptosuite = "eddsa-rdfc-2022" },
+	}
+	for name, tamper := range cases {
+		vc := issue()
+		tamper(vc)
+		if err := VerifyCredential(vc); err == nil {
+			t.Errorf("%s: tampered credential verified", name)
+		}
+	}
+}
+
+func TestCredentialExpired(t *testing.T) {
+	priv := testKey(t)
+	vc, err := IssueVerificationCredential(priv, "manifest-1", "criteria-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//re-sign an already expired credential, so only the validity period is wrong
+	past := time.Now().Add(-2 * CREDENTIAL_TTL).UTC()
+	vc.ValidFrom = past.Format(time.RFC3339)
+	vc.ValidUntil = past.Add(CREDENTIAL_TTL).Format(time.RFC3339)
+	vc.Proof.ProofValue = ""
+	input, err := proofInput(vc, vc.Proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := priv.Sign(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vc.Proof.ProofValue, err = multibase.Encode(multibase.Base58BTC, sig); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyCredential(vc); err == nil || err.Error() != "credential expired" {
+		t.Fatalf("VerifyCredential of an expired credential: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+# Criteria.go
+
+Evaluation of a provider's Criteria against a user's identity data.
+
+Rule fields are paths into UserInfo ("Name", "DOB.year", ...), and rule types are:
+	equal   -> field == value
+	greater -> field > value (numbers only)
+	less    -> field < value (numbers only)
+	in      -> field is one of the values in the value list
+*/
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Checks that every rule in All and at least one rule in Any (if there are any) holds for info
+func EvaluateCriteria(info UserInfo, c Criteria) (bool, error) {
+	fields, err := flattenUserInfo(info)
+	if err != nil {
+		return false, err
+	}
+
+	for _, r := range c.All {
+		ok, err := evaluateRule(fields, r)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	if len(c.Any) == 0 {
+		return true, nil
+	}
+	for _, r := range c.Any {
+		ok, err := evaluateRule(fields, r)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sha256 (hex) of the canonical json of a criteria, used to refer to it in credentials and tokens
+func CriteriaHash(c Criteria) (string, error) {
+	canon, err := canonicalJSON(c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canon)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func evaluateRule(fields map[string]interface{}, r Rule) (bool, error) {
+	value, ok := fields[r.Field]
+	if !ok {
+		return false, fmt.Errorf("unknown field %q", r.Field)
+	}
+
+	switch r.Type {
+	case "equal":
+		return equalValues(value, r.Value), nil
+	case "greater", "less":
+		a, okA := value.(float64)
+		b, okB := r.Value.(float64)
+		if !okA || !okB {
+			if n, isInt := r.Value.(int); isInt && okA {
+				b, okB = float64(n), true
+			}
+		}
+		if !okA || !okB {
+			return false, fmt.Errorf("rule %q on %q needs numbers", r.Type, r.Field)
+		}
+		if r.Type == "greater" {
+			return a > b, nil
+		}
+		return a < b, nil
+	case "in":
+		list, ok := r.Value.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("rule \"in\" on %q needs a list", r.Field)
+		}
+		for _, v := range list {
+			if equalValues(value, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown rule type %q", r.Type)
+	}
+}
+
+func equalValues(a, b interface{}) bool {
+	if n, ok := b.(int); ok {
+		b = float64(n)
+	}
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			return strings.EqualFold(strings.TrimSpace(sa), strings.TrimSpace(sb))
+		}
+	}
+	return a == b
+}
+
+// turns UserInfo into "Name", "DOB.year", ... -> value (numbers as float64, like decoded json)
+func flattenUserInfo(info UserInfo) (map[string]interface{}, error) {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]interface{})
+	var walk func(prefix string, node map[string]interface{})
+	walk = func(prefix string, node map[string]interface{}) {
+		for k, v := range node {
+			if child, ok := v.(map[string]interface{}); ok {
+				walk(prefix+k+".", child)
+				continue
+			}
+			fields[prefix+k] = v
+		}
+	}
+	walk("", tree)
+	return fields, nil
+}
@@ -54,23 +54,31 @@ func Encrypt(plaintext []byte) ([]byte, []byte, error) {
 		return nil, nil, err
 	}
 
-	block, err := aes.NewCipher(key)
+	ciphertext, err := EncryptWithKey(key, plaintext)
 	if err != nil {
 		return nil, nil, err
 	}
+	return ciphertext, key, nil
+}
+
+// same as Encrypt, but under a key the caller already has (nonce is prepended to the output)
+func EncryptWithKey(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err = rand.Read(nonce); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, key, nil
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
 }
 
 func Decrypt(key, ciphertext []byte) ([]byte, error) {
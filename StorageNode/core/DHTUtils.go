@@ -40,9 +40,11 @@ CID(#eid2ou3D@dn32i3d@n2$tg#f@3d) → [Peer QmABC, Peer QmXYZ]
 package core
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -93,3 +95,85 @@ func DHTGetProviders(ctx context.Context, dht *dht.IpfsDHT, key string) (provide
 		return providers, nil
 	}
 }
+
+/*-------------------------- REPUBLISHING -----------------------------------*/
+
+/*
+DHT nodes drop records put with PutValue after MaxRecordAge (48h by default), so the
+records this node is responsible for (the manifests it placed and their ACLs, its succession
+chain, its DID document) are saved in the "published" collection and put again every RECORD_REPUBLISH.
+*/
+const RECORD_REPUBLISH = 12 * time.Hour
+
+/*
+Puts the best of ours and the value currently found under key (as the validator selects
+them) back in the DHT, so the record outlives MaxRecordAge. ours may be nil to refresh
+whatever is found. Returns the value put, nil if there was none.
+*/
+func RepublishRecord(ctx context.Context, kadDHT *dht.IpfsDHT, key string, ours []byte) ([]byte, error) {
+	value := ours
+	if current, err := kadDHT.GetValue(ctx, key); err == nil && !bytes.Equal(current, ours) {
+		//a newer version published by someone else (e.g. an admin rotation) wins
+		if ours == nil {
+			value = current
+		} else if best, err := kadDHT.Validator.Select(key, [][]byte{ours, current}); err == nil && best == 1 {
+			value = current
+		}
+	}
+	if value == nil {
+		return nil, nil
+	}
+	return value, kadDHT.PutValue(ctx, key, value)
+}
+
+// puts a record in the DHT and keeps it published, even if it can't be put right now
+func (sm *StreamsMaster) publishRecord(ctx context.Context, key string, value []byte) error {
+	if err := sm.db.SavePublished(key, value); err != nil {
+		return err
+	}
+	return sm.dht.PutValue(ctx, key, value)
+}
+
+// republishes the records in the "published" collection every RECORD_REPUBLISH until ctx is done
+func (sm *StreamsMaster) RepublishRecords(ctx context.Context) {
+	ticker := time.NewTicker(RECORD_REPUBLISH)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		records, err := sm.db.PublishedRecords()
+		if err != nil {
+			fmt.Println("Error reading published records:", err)
+			continue
+		}
+		known := make(map[string]bool, len(records))
+		for _, rec := range records {
+			known[rec.Key] = true
+		}
+		failed := 0
+		for _, rec := range records {
+			//ACLs owners put for our manifests are kept too
+			if key := sm.aclKeyOf(rec); key != "" && !known[key] {
+				sm.adoptACL(ctx, key)
+			}
+
+			putCtx, cancel := context.WithTimeout(ctx, sm.cfg.Timeouts.Request)
+			value, err := RepublishRecord(putCtx, sm.dht, rec.Key, rec.Value)
+			cancel()
+			if err != nil {
+				failed++
+				continue
+			}
+			if !bytes.Equal(value, rec.Value) {
+				if err := sm.db.SavePublished(rec.Key, value); err != nil {
+					fmt.Println("Error saving published record:", err)
+				}
+			}
+		}
+		fmt.Printf("📣 Republished %d records (%d failed)\n", len(records)-failed, failed)
+	}
+}
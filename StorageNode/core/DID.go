@@ -0,0 +1,277 @@
+/*
+# DID.go
+
+W3C decentralized identifiers (did:key) for nodes and users, and their DID documents.
+
+A did:key is derived from an Ed25519 public key (multicodec 0xed01, base58btc), so it
+resolves offline to a minimal document (NewDIDDocument). That is all the node needs: the
+owners of manifests, consent and ACL signers, credential issuers and holders are checked
+with the key taken from their DID (PubKeyFromDID, ParseNodeRef), and user DIDs are never
+published.
+
+For resolvers outside the network, nodes also publish a signed document with their libp2p
+service endpoint (and the identities they succeeded, see Succession.go) in the DHT record
+store, under the node's custom namespace, and keep it published (see RepublishRecords):
+	/
+	├── <namespace>/
+	│     ├── did/
+	│     │     ├── <did> : DID document json
+*/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multibase"
+)
+
+// multicodec prefix of an ed25519 public key (0xed as varint)
+var ed25519PubCodec = []byte{0xed, 0x01}
+
+type DIDDocument struct {
+	Context            []string             `json:"@context"`
+	ID                 string               `json:"id"`
+	AlsoKnownAs        []string             `json:"alsoKnownAs,omitempty"` // DIDs of identities this one succeeded
+	VerificationMethod []VerificationMethod `json:"verificationMethod"`
+	Authentication     []string             `json:"authentication"`
+	AssertionMethod    []string             `json:"assertionMethod"`
+	Service            []DIDService         `json:"service,omitempty"`
+	Updated            string               `json:"updated,omitempty"`
+	Proof              *DataProof           `json:"proof,omitempty"` // only on published documents
+}
+
+type VerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"` // "Multikey"
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+type DIDService struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// did:key of an Ed25519 public key
+func DIDFromPubKey(pub crypto.PubKey) (string, error) {
+	if pub.Type() != crypto.Ed25519 {
+		return "", errors.New("did:key only supported for Ed25519 keys")
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return "", err
+	}
+	mb, err := multibase.Encode(multibase.Base58BTC, append(append([]byte{}, ed25519PubCodec...), raw...))
+	if err != nil {
+		return "", err
+	}
+	return "did:key:" + mb, nil
+}
+
+// Ed25519 public key inside a did:key
+func PubKeyFromDID(did string) (crypto.PubKey, error) {
+	if !strings.HasPrefix(did, "did:key:") {
+		return nil, fmt.Errorf("not a did:key: %s", did)
+	}
+	_, data, err := multibase.Decode(strings.TrimPrefix(did, "did:key:"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid did:key: %v", err)
+	}
+	if !bytes.HasPrefix(data, ed25519PubCodec) {
+		return nil, errors.New("did:key is not an Ed25519 key")
+	}
+	return crypto.UnmarshalEd25519PublicKey(data[len(ed25519PubCodec):])
+}
+
+// did:key of a node, from the key embedded in its peer ID
+func DIDFromPeerID(id peer.ID) (string, error) {
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return "", err
+	}
+	return DIDFromPubKey(pub)
+}
+
+// peer ID of a node did:key
+func PeerIDFromDID(did string) (peer.ID, error) {
+	pub, err := PubKeyFromDID(did)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPublicKey(pub)
+}
+
+/*
+Parses a reference to a node: a did:key or a plain peer ID.
+
+Manifests written before DIDs name holders by peer ID.
+*/
+func ParseNodeRef(ref string) (peer.ID, error) {
+	if strings.HasPrefix(ref, "did:") {
+		return PeerIDFromDID(ref)
+	}
+	return peer.Decode(ref)
+}
+
+/*-------------------------- DOCUMENTS -----------------------------------*/
+
+// The document a did:key resolves to without any published one
+func NewDIDDocument(did string) (*DIDDocument, error) {
+	if _, err := PubKeyFromDID(did); err != nil {
+		return nil, err
+	}
+
+	key := did + "#" + strings.TrimPrefix(did, "did:key:")
+	return &DIDDocument{
+		Context: []string{"https://www.w3.org/ns/did/v1", "https://w3id.org/security/multikey/v1"},
+		ID:      did,
+		VerificationMethod: []VerificationMethod{{
+			ID:                 key,
+			Type:               "Multikey",
+			Controller:         did,
+			PublicKeyMultibase: strings.TrimPrefix(did, "did:key:"),
+		}},
+		Authentication:  []string{key},
+		AssertionMethod: []string{key},
+	}, nil
+}
+
+// Signs a DID document with the key of its DID (proof like the one of verification credentials)
+func SignDIDDocument(priv crypto.PrivKey, doc *DIDDocument) error {
+	did, err := DIDFromPubKey(priv.GetPublic())
+	if err != nil {
+		return err
+	}
+	if did != doc.ID {
+		return errors.New("document belongs to another DID")
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	doc.Updated = now
+	doc.Proof = nil
+	proof := &DataProof{
+		Type:               "DataIntegrityProof",
+		Cryptosuite:        "eddsa-jcs-2022",
+		Created:            now,
+		VerificationMethod: doc.VerificationMethod[0].ID,
+		ProofPurpose:       "assertionMethod",
+	}
+
+	input, err := didProofInput(doc, proof)
+	if err != nil {
+		return err
+	}
+	sig, err := priv.Sign(input)
+	if err != nil {
+		return err
+	}
+	proof.ProofValue, err = multibase.Encode(multibase.Base58BTC, sig)
+	if err != nil {
+		return err
+	}
+	doc.Proof = proof
+	return nil
+}
+
+// Checks that a published document was signed by the key of its DID
+func (doc *DIDDocument) Verify() error {
+	if doc.Proof == nil {
+		return errors.New("document has no proof")
+	}
+	if !strings.HasPrefix(doc.Proof.VerificationMethod, doc.ID+"#") {
+		return errors.New("proof not made by the DID subject")
+	}
+	pub, err := PubKeyFromDID(doc.ID)
+	if err != nil {
+		return err
+	}
+	_, sig, err := multibase.Decode(doc.Proof.ProofValue)
+	if err != nil {
+		return fmt.Errorf("invalid proof value: %v", err)
+	}
+
+	unsigned := *doc.Proof
+	unsigned.ProofValue = ""
+	input, err := didProofInput(doc, &unsigned)
+	if err != nil {
+		return err
+	}
+	if ok, err := pub.Verify(input, sig); err != nil || !ok {
+		return errors.New("bad document signature")
+	}
+	return nil
+}
+
+// sha256(proof options) || sha256(document without proof), as for credentials
+func didProofInput(doc *DIDDocument, proof *DataProof) ([]byte, error) {
+	unsigned := *doc
+	unsigned.Proof = nil
+	return jcsProofInput(doc.Context, proof, unsigned)
+}
+
+/*-------------------------- DHT RECORDS -----------------------------------*/
+
+func didKey(namespace string, did string) string {
+	return fmt.Sprintf("/%s/did/%s", namespace, did)
+}
+
+/*
+Signed DID document of a node: its libp2p endpoint and the DIDs of the identities it
+succeeded.
+*/
+func NodeDIDDocument(priv crypto.PrivKey) (*DIDDocument, error) {
+	did, err := DIDFromPubKey(priv.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := NewDIDDocument(did)
+	if err != nil {
+		return nil, err
+	}
+	doc.Service = []DIDService{{ID: did + "#libp2p", Type: "LibP2PNode", ServiceEndpoint: id.String()}}
+
+	chain, err := ReadSuccessionChain()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range chain {
+		if pid, err := peer.Decode(s.Old); err == nil {
+			if old, err := DIDFromPeerID(pid); err == nil {
+				doc.AlsoKnownAs = append(doc.AlsoKnownAs, old)
+			}
+		}
+	}
+
+	if err := SignDIDDocument(priv, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Publishes the DID document of this node and keeps it published (see RepublishRecords)
+func (sm *StreamsMaster) PublishNodeDID(ctx context.Context) error {
+	doc, err := NodeDIDDocument(sm.h.Peerstore().PrivKey(sm.h.ID()))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return sm.publishRecord(ctx, didKey(sm.namespace, doc.ID), data)
+}
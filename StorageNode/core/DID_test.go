@@ -0,0 +1,125 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestDIDRoundTrip(t *testing.T) {
+	priv := testKey(t)
+	did, err := DIDFromPubKey(priv.GetPublic())
+	if err != nil {
+		t.Fatalf("DIDFromPubKey: %v", err)
+	}
+	if !strings.HasPrefix(did, "did:key:z6Mk") {
+		t.Errorf("unexpected did:key %s", did)
+	}
+
+	pub, err := PubKeyFromDID(did)
+	if err != nil {
+		t.Fatalf("PubKeyFromDID: %v", err)
+	}
+	if !pub.Equals(priv.GetPublic()) {
+		t.Error("did:key resolved to another key")
+	}
+
+	//a node is referenced the same way by its did:key and its peer ID
+	id, _ := peer.IDFromPrivateKey(priv)
+	for _, ref := range []string{did, id.String()} {
+		if got, err := ParseNodeRef(ref); err != nil || got != id {
+			t.Errorf("ParseNodeRef(%s) = %s, %v", ref, got, err)
+		}
+	}
+}
+
+func TestDIDInvalid(t *testing.T) {
+	rsa, _, err := crypto.GenerateKeyPair(crypto.RSA, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DIDFromPubKey(rsa.GetPublic()); err == nil {
+		t.Error("made a did:key of an RSA key")
+	}
+
+	for _, did := range []string{
+		"did:web:example.com",
+		"did:key:not-multibase",
+		"did:key:zQ3shokFTS3brHcDQrn82RUDfCZESWL1ZdCEJwekUDPQiYBme", //secp256k1
+	} {
+		if _, err := PubKeyFromDID(did); err == nil {
+			t.Errorf("accepted %s", did)
+		}
+	}
+}
+
+func testNodeDIDDocument(t *testing.T) (*DIDDocument, crypto.PrivKey) {
+	t.Helper()
+	testHome(t)
+	priv := testKey(t)
+	doc, err := NodeDIDDocument(priv)
+	if err != nil {
+		t.Fatalf("NodeDIDDocument: %v", err)
+	}
+	return doc, priv
+}
+
+func TestDIDDocumentSigned(t *testing.T) {
+	doc, priv := testNodeDIDDocument(t)
+	if err := doc.Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	//published and read back
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (RecordValidator{}).Validate("/ns/did/"+doc.ID, data); err != nil {
+		t.Errorf("validator refused the document: %v", err)
+	}
+
+	//only the DID's own key signs its document
+	other, err := NewDIDDocument(doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignDIDDocument(testKey(t), other); err == nil {
+		t.Error("signed the document of another DID")
+	}
+	if err := SignDIDDocument(priv, other); err != nil {
+		t.Errorf("SignDIDDocument: %v", err)
+	}
+}
+
+func TestDIDDocumentTampered(t *testing.T) {
+	cases := map[string]func(doc *DIDDocument){
+		"service":      func(doc *DIDDocument) { doc.Service[0].ServiceEndpoint = testPeerID(t).String() },
+		"alsoKnownAs":  func(doc *DIDDocument) { doc.AlsoKnownAs = []string{doc.ID} },
+		"updated":      func(doc *DIDDocument) { doc.Updated = "2999-01-01T00:00:00Z" },
+		"no proof":     func(doc *DIDDocument) { doc.Proof = nil },
+		"proof method": func(doc *DIDDocument) { doc.Proof.VerificationMethod = "did:key:other#key" },
+		"signature":    func(doc *DIDDocument) { doc.Proof.ProofValue = "z" + strings.Repeat("1", 86) },
+		"verification method": func(doc *DIDDocument) {
+			doc.VerificationMethod[0].PublicKeyMultibase = "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"
+		},
+	}
+	for name, tamper := range cases {
+		doc, _ := testNodeDIDDocument(t)
+		tamper(doc)
+		if err := doc.Verify(); err == nil {
+			t.Errorf("%s: tampered document verified", name)
+		}
+	}
+
+	//a valid document filed under another DID
+	doc, _ := testNodeDIDDocument(t)
+	data, _ := json.Marshal(doc)
+	other, _ := DIDFromPubKey(testKey(t).GetPublic())
+	if err := (RecordValidator{}).Validate("/ns/did/"+other, data); err == nil {
+		t.Error("validator accepted a document under another DID")
+	}
+}
@@ -17,10 +17,12 @@ type Database struct {
 	fragments  *mongo.Collection
 	dataBlocks *mongo.Collection
 	nodes      *mongo.Collection
+	rotations  *mongo.Collection
+	published  *mongo.Collection
 }
 
 // NewDatabase creates a new MongoDB client and initializes collections.
-func NewDatabase(connectionString string) (*Database, error) {
+func NewDatabase(connectionString string, name string) (*Database, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -33,7 +35,7 @@ func NewDatabase(connectionString string) (*Database, error) {
 		return nil, fmt.Errorf("failed to ping MongoDB: %v", err)
 	}
 
-	db := client.Database("didn_storage")
+	db := client.Database(name)
 
 	return &Database{
 		client:     client,
@@ -41,6 +43,8 @@ func NewDatabase(connectionString string) (*Database, error) {
 		fragments:  db.Collection("fragments"),
 		dataBlocks: db.Collection("data_blocks"),
 		nodes:      db.Collection("nodes"),
+		rotations:  db.Collection("rotations"),
+		published:  db.Collection("published"),
 	}, nil
 }
 
@@ -208,3 +212,127 @@ func (db *Database) StoreSimple(data SimpleData) error {
 	log.Printf("Data stored successfully, hash: %s\n", data.Hash)
 	return nil
 }
+
+func (db *Database) RetrieveSimple(hash string) (*SimpleData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var data SimpleData
+	err := db.main.FindOne(ctx, bson.M{"hash": hash}).Decode(&data)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("data not found for hash: %s", hash)
+		}
+		return nil, fmt.Errorf("failed to retrieve data: %v", err)
+	}
+
+	return &data, nil
+}
+
+func (db *Database) DeleteSimple(hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := db.main.DeleteMany(ctx, bson.M{"hash": hash})
+	if err != nil {
+		return fmt.Errorf("failed to delete data: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("data not found for deletion: %s", hash)
+	}
+
+	log.Printf("Data deleted successfully, hash: %s", hash)
+	return nil
+}
+
+// ---------------- Key rotations ----------------
+
+func (db *Database) SaveRotation(state RotationState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	state.UpdatedAt = time.Now().UTC()
+
+	opts := options.Replace().SetUpsert(true)
+	_, err := db.rotations.ReplaceOne(ctx, bson.M{"manifest_id": state.ManifestID}, state, opts)
+	if err != nil {
+		return fmt.Errorf("failed to save rotation: %v", err)
+	}
+	return nil
+}
+
+// returns nil (and no error) if there is no rotation in progress for the manifest
+func (db *Database) RetrieveRotation(manifestID string) (*RotationState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var state RotationState
+	err := db.rotations.FindOne(ctx, bson.M{"manifest_id": manifestID}).Decode(&state)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve rotation: %v", err)
+	}
+	return &state, nil
+}
+
+func (db *Database) PendingRotations() ([]RotationState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := db.rotations.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rotations: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var states []RotationState
+	if err := cursor.All(ctx, &states); err != nil {
+		return nil, fmt.Errorf("failed to decode rotations: %v", err)
+	}
+	return states, nil
+}
+
+func (db *Database) DeleteRotation(manifestID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.rotations.DeleteOne(ctx, bson.M{"manifest_id": manifestID})
+	if err != nil {
+		return fmt.Errorf("failed to delete rotation: %v", err)
+	}
+	return nil
+}
+
+// ---------------- Published DHT records ----------------
+
+func (db *Database) SavePublished(key string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rec := PublishedRecord{Key: key, Value: value, UpdatedAt: time.Now().UTC()}
+	opts := options.Replace().SetUpsert(true)
+	_, err := db.published.ReplaceOne(ctx, bson.M{"key": key}, rec, opts)
+	if err != nil {
+		return fmt.Errorf("failed to save published record: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) PublishedRecords() ([]PublishedRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := db.published.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query published records: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var records []PublishedRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode published records: %v", err)
+	}
+	return records, nil
+}
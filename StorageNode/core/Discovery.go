@@ -0,0 +1,87 @@
+/*
+# Discovery.go
+
+Rendezvous peer discovery through the DHT.
+
+Every node advertises itself as a provider of a key derived from the namespace, and
+every network.discovery.interval looks the key up to find nodes that joined after it
+started (the address book only knows the ones seen before). New nodes are dialed until the
+node has network.discovery.target_peers connections.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+)
+
+type DiscoveryConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	TargetPeers int           `yaml:"target_peers"`
+	Interval    time.Duration `yaml:"interval"`
+}
+
+// rendezvous key nodes of a namespace advertise
+func rendezvousKey(namespace string) string {
+	return fmt.Sprintf("/%s/storage-nodes", namespace)
+}
+
+// Advertises the node and keeps finding others until ctx is done
+func DiscoverPeers(ctx context.Context, h host.Host, kadDHT *dht.IpfsDHT, namespace string, cfg DiscoveryConfig) {
+	rd := drouting.NewRoutingDiscovery(kadDHT)
+	key := rendezvousKey(namespace)
+
+	//re-advertises before the record expires, in the background
+	dutil.Advertise(ctx, rd, key)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if missing := cfg.TargetPeers - len(h.Network().Peers()); missing > 0 {
+			findPeers(ctx, h, rd, key, missing)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dials up to n nodes advertising key that we are not connected to yet
+func findPeers(ctx context.Context, h host.Host, rd *drouting.RoutingDiscovery, key string, n int) {
+	findCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	found, err := rd.FindPeers(findCtx, key)
+	if err != nil {
+		fmt.Println("\nError finding peers:", err)
+		return
+	}
+
+	for pi := range found {
+		if n == 0 {
+			return
+		}
+		if pi.ID == h.ID() || len(pi.Addrs) == 0 || h.Network().Connectedness(pi.ID) == network.Connected {
+			continue
+		}
+
+		err := h.Connect(findCtx, pi)
+		ExplainDialError(pi.ID, err)
+		if err != nil {
+			continue
+		}
+		fmt.Printf("\n🧭 Discovered node %s\n", pi.ID)
+		n--
+	}
+}
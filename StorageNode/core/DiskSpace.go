@@ -0,0 +1,21 @@
+//go:build !windows
+
+/*
+# DiskSpace.go
+
+Free disk space, advertised as a capability (see Roles.go). Windows has its own version
+in DiskSpace_windows.go.
+*/
+
+package core
+
+import "golang.org/x/sys/unix"
+
+// bytes available to us on the filesystem holding path
+func DiskFree(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
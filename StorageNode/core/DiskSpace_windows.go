@@ -0,0 +1,22 @@
+/*
+# DiskSpace_windows.go
+
+Free disk space on Windows (see DiskSpace.go).
+*/
+
+package core
+
+import "golang.org/x/sys/windows"
+
+// bytes available to us on the volume holding path
+func DiskFree(path string) (uint64, error) {
+	dir, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
@@ -0,0 +1,189 @@
+/*
+# Envelope.go
+
+Signed envelopes for protocol requests.
+
+Every request travels inside an envelope carrying the originator's peer ID, the peer
+and protocol it is meant for, a timestamp, a random nonce and a signature made with the
+originator's libp2p key over
+
+	dsn-envelope/2\n<origin>\n<recipient>\n<protocol>\n<timestamp>\n<nonce>\n<payload json>
+
+Handlers check the signature against the key embedded in the origin peer ID, that they
+are the recipient and that it arrived on the protocol it was signed for, refuse envelopes
+outside ENVELOPE_WINDOW and remember nonces for that long. So a payload can't be altered
+by a relaying peer, replayed later (e.g. to roll a block back), or replayed to another
+node or on another protocol.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// how far an envelope timestamp may be from our clock
+const ENVELOPE_WINDOW = 2 * time.Minute
+
+type Envelope struct {
+	Origin    string          `json:"origin"`    // peer ID of whoever created the request
+	Recipient string          `json:"recipient"` // peer ID of the node it is meant for
+	Protocol  string          `json:"protocol"`  // protocol it is sent on
+	Timestamp int64           `json:"timestamp"` // unix milliseconds
+	Nonce     string          `json:"nonce"`
+	Payload   json.RawMessage `json:"payload"`
+	Signature []byte          `json:"signature"`
+}
+
+// Wraps a payload for recipient, on proto, in an envelope signed with priv
+func SealEnvelope(priv crypto.PrivKey, recipient peer.ID, proto protocol.ID, payload interface{}) (*Envelope, error) {
+	origin, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := marshalJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{
+		Origin:    origin.String(),
+		Recipient: recipient.String(),
+		Protocol:  string(proto),
+		Timestamp: time.Now().UnixMilli(),
+		Nonce:     base64.StdEncoding.EncodeToString(nonce),
+		Payload:   data,
+	}
+	env.Signature, err = priv.Sign(env.signingBytes())
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+/*
+Checks an envelope received by self on proto (signature, recipient, protocol, freshness
+and nonce) and decodes its payload into v.
+
+Returns the origin peer ID.
+*/
+func (env *Envelope) Open(nonces *NonceCache, self peer.ID, proto protocol.ID, v interface{}) (peer.ID, error) {
+	origin, err := env.check(self, proto)
+	if err != nil {
+		return "", err
+	}
+	if !nonces.Use(env.Origin + "/" + env.Nonce) {
+		return "", errors.New("replayed envelope")
+	}
+
+	if err := json.Unmarshal(env.Payload, v); err != nil {
+		return "", fmt.Errorf("invalid payload: %v", err)
+	}
+	return origin, nil
+}
+
+// checks everything but the nonce: signature, recipient, protocol and freshness
+func (env *Envelope) check(self peer.ID, proto protocol.ID) (peer.ID, error) {
+	origin, err := peer.Decode(env.Origin)
+	if err != nil {
+		return "", fmt.Errorf("invalid origin: %v", err)
+	}
+	pub, err := origin.ExtractPublicKey()
+	if err != nil {
+		return "", fmt.Errorf("origin key: %v", err)
+	}
+	if ok, err := pub.Verify(env.signingBytes(), env.Signature); err != nil || !ok {
+		return "", errors.New("bad envelope signature")
+	}
+	if env.Recipient != self.String() {
+		return "", errors.New("envelope meant for another node")
+	}
+	if env.Protocol != string(proto) {
+		return "", errors.New("envelope meant for another protocol")
+	}
+
+	if d := time.Since(time.UnixMilli(env.Timestamp)); d > ENVELOPE_WINDOW || d < -ENVELOPE_WINDOW {
+		return "", errors.New("stale envelope")
+	}
+	return origin, nil
+}
+
+func (env *Envelope) signingBytes() []byte {
+	header := fmt.Sprintf("dsn-envelope/2\n%s\n%s\n%s\n%d\n%s\n", env.Origin, env.Recipient, env.Protocol, env.Timestamp, env.Nonce)
+	return append([]byte(header), env.Payload...)
+}
+
+/*
+json.Marshal without html escaping. Verification requests signed by AdminNode travel on
+inside our own requests, and json.Marshal would turn the < > & in them into \u003c etc.,
+breaking their signature: everything we send goes through this instead.
+*/
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+/*-------------------------- NONCE CACHE -----------------------------------*/
+
+/*
+Remembers the nonces seen inside the freshness window. An envelope is only accepted while
+its timestamp is within ENVELOPE_WINDOW of our clock, so a nonce needs remembering for at
+most 2*ENVELOPE_WINDOW after it was used; they are queued in the order they were used and
+forgotten from the front.
+*/
+type NonceCache struct {
+	mu    sync.Mutex
+	seen  map[string]bool
+	queue []usedNonce // oldest first
+}
+
+type usedNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+func NewNonceCache() *NonceCache {
+	return &NonceCache{seen: make(map[string]bool)}
+}
+
+// Records a nonce; false if it was already used
+func (c *NonceCache) Use(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	//forget what fell out of the window, those are refused as stale anyway
+	now := time.Now()
+	for len(c.queue) > 0 && now.After(c.queue[0].expires) {
+		delete(c.seen, c.queue[0].nonce)
+		c.queue = c.queue[1:]
+	}
+
+	if c.seen[nonce] {
+		return false
+	}
+	c.seen[nonce] = true
+	c.queue = append(c.queue, usedNonce{nonce: nonce, expires: now.Add(2 * ENVELOPE_WINDOW)})
+	return true
+}
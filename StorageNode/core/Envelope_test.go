@@ -0,0 +1,189 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const testProtocol = "/store/1.0.0"
+
+// a request sealed for recipient with a fresh key, and that key
+func sealTestEnvelope(t *testing.T, recipient peer.ID) (*Envelope, crypto.PrivKey) {
+	t.Helper()
+	priv := testKey(t)
+	env, err := SealEnvelope(priv, recipient, testProtocol, HashRequest{ManifestID: "m", Hash: "h"})
+	if err != nil {
+		t.Fatalf("SealEnvelope: %v", err)
+	}
+	return env, priv
+}
+
+func testPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	id, err := peer.IDFromPrivateKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	self := testPeerID(t)
+	env, priv := sealTestEnvelope(t, self)
+
+	//it travels as json
+	raw, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := &Envelope{}
+	if err := json.Unmarshal(raw, received); err != nil {
+		t.Fatal(err)
+	}
+
+	req := HashRequest{}
+	origin, err := received.Open(NewNonceCache(), self, testProtocol, &req)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if want, _ := peer.IDFromPrivateKey(priv); origin != want {
+		t.Errorf("origin = %s, want %s", origin, want)
+	}
+	if req.ManifestID != "m" || req.Hash != "h" {
+		t.Errorf("payload = %+v", req)
+	}
+}
+
+func TestEnvelopeReplay(t *testing.T) {
+	self := testPeerID(t)
+	env, _ := sealTestEnvelope(t, self)
+	nonces := NewNonceCache()
+
+	if _, err := env.Open(nonces, self, testProtocol, &HashRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Open(nonces, self, testProtocol, &HashRequest{}); err == nil {
+		t.Error("accepted a replayed envelope")
+	}
+}
+
+func TestEnvelopeBinding(t *testing.T) {
+	self := testPeerID(t)
+
+	env, _ := sealTestEnvelope(t, self)
+	if _, err := env.Open(NewNonceCache(), testPeerID(t), testProtocol, &HashRequest{}); err == nil {
+		t.Error("accepted an envelope meant for another node")
+	}
+	if _, err := env.Open(NewNonceCache(), self, "/delete/1.0.0", &HashRequest{}); err == nil {
+		t.Error("accepted an envelope meant for another protocol")
+	}
+
+	//rewriting the recipient breaks the signature
+	other := testPeerID(t)
+	env.Recipient = other.String()
+	if _, err := env.Open(NewNonceCache(), other, testProtocol, &HashRequest{}); err == nil {
+		t.Error("accepted an envelope with a rewritten recipient")
+	}
+}
+
+func TestEnvelopeTampering(t *testing.T) {
+	self := testPeerID(t)
+	cases := map[string]func(env *Envelope){
+		"payload":   func(env *Envelope) { env.Payload = json.RawMessage(`{"manifest_id":"m","hash":"other"}`) },
+		"origin":    func(env *Envelope) { env.Origin = testPeerID(t).String() },
+		"protocol":  func(env *Envelope) { env.Protocol = "/delete/1.0.0" },
+		"timestamp": func(env *Envelope) { env.Timestamp++ },
+		"nonce":     func(env *Envelope) { env.Nonce = "AAAA" },
+	}
+	for name, tamper := range cases {
+		env, _ := sealTestEnvelope(t, self)
+		tamper(env)
+		if _, err := env.Open(NewNonceCache(), self, protocol.ID(env.Protocol), &HashRequest{}); err == nil {
+			t.Errorf("%s: tampered envelope opened", name)
+		}
+	}
+}
+
+func TestEnvelopeStale(t *testing.T) {
+	self := testPeerID(t)
+	priv := testKey(t)
+
+	env, err := SealEnvelope(priv, self, testProtocol, HashRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Timestamp = time.Now().Add(-2 * ENVELOPE_WINDOW).UnixMilli()
+	if env.Signature, err = priv.Sign(env.signingBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Open(NewNonceCache(), self, testProtocol, &HashRequest{}); err == nil || err.Error() != "stale envelope" {
+		t.Errorf("Open of an old envelope: %v", err)
+	}
+}
+
+// envelopes signed by AdminNode are forwarded to holders inside our own requests
+func TestEnvelopeForwarded(t *testing.T) {
+	self := testPeerID(t)
+	priv := testKey(t)
+
+	//JSON.stringify does not escape html characters, json.Marshal does
+	env, err := SealEnvelope(priv, self, testProtocol, HashRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Payload = json.RawMessage(`{"manifest_id":"<m> & co","hash":"h"}`)
+	if env.Signature, err = priv.Sign(env.signingBytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	//inside one of our requests, to a holder
+	holder := testPeerID(t)
+	outer, err := SealEnvelope(testKey(t), holder, "/decrypt/1.0.0", DecryptRequest{ManifestID: "m", Request: env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := marshalJSON(outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := &Envelope{}
+	if err := json.Unmarshal(line, received); err != nil {
+		t.Fatal(err)
+	}
+	forwarded := DecryptRequest{}
+	if _, err := received.Open(NewNonceCache(), holder, "/decrypt/1.0.0", &forwarded); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	req := HashRequest{}
+	if _, err := forwarded.Request.Open(NewNonceCache(), self, testProtocol, &req); err != nil {
+		t.Fatalf("Open of a forwarded envelope: %v", err)
+	}
+	if req.ManifestID != "<m> & co" {
+		t.Errorf("payload = %+v", req)
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	nonces := NewNonceCache()
+	if !nonces.Use("a") || !nonces.Use("b") || nonces.Use("a") {
+		t.Fatal("nonces not remembered")
+	}
+
+	//"a" is out of the window, "b" still in it
+	nonces.queue[0].expires = time.Now().Add(-time.Second)
+	if !nonces.Use("c") {
+		t.Fatal("new nonce refused")
+	}
+	if len(nonces.seen) != 2 || len(nonces.queue) != 2 {
+		t.Errorf("remembers %d nonces, %d queued", len(nonces.seen), len(nonces.queue))
+	}
+	if nonces.Use("b") {
+		t.Error("nonce forgotten inside the window")
+	}
+}
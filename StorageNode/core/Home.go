@@ -0,0 +1,53 @@
+/*
+# Home.go
+
+Node home directory.
+
+Everything a node keeps on disk (identity, peer list, config, swarm key, certificates,
+succession chain, audit log) lives in its home, so several nodes can run on one host
+from different homes. The home is the working directory unless --home (or NODE_HOME)
+names another one; relative paths given by the user on the command line are not
+affected.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// environment variable naming the home directory, --home takes precedence
+const HOME_ENV = "NODE_HOME"
+
+var homeDir = "."
+
+// Sets the home directory, creating it if needed
+func SetHome(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(abs, 0700); err != nil {
+		return err
+	}
+	homeDir = abs
+	return nil
+}
+
+// true when the node runs from a home other than the working directory
+func HasHome() bool {
+	return homeDir != "."
+}
+
+func Home() string {
+	return homeDir
+}
+
+// path of a node file inside the home directory
+func HomePath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(homeDir, name)
+}
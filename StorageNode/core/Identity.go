@@ -0,0 +1,202 @@
+/*
+# Identity.go
+
+Passphrase protection of the node identity file (ID.json).
+
+The private key can be stored encrypted instead of as plain base64: a key is derived
+from a passphrase with scrypt and the marshalled private key is sealed with AES-GCM.
+The public key stays in clear so the peer ID can be read without the passphrase.
+
+The passphrase comes from (first match):
+  - the IDENTITY_PASSPHRASE environment variable
+  - the file descriptor set with --passphrase-fd (first line)
+  - a prompt on the terminal (without echo)
+
+The variable and the descriptor are read once per process: every later request (e.g.
+the old and the new passphrase of rotate-identity) gets the same passphrase.
+
+The scrypt parameters are read from the file, so they are bounded before deriving: a
+crafted file could otherwise make the node allocate gigabytes.
+*/
+
+package core
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// environment variable holding the identity passphrase
+const PASSPHRASE_ENV = "IDENTITY_PASSPHRASE"
+
+// file descriptor to read the passphrase from, -1 if not set (--passphrase-fd)
+var PassphraseFD = -1
+
+// passphrase from the environment or the descriptor, read once
+var (
+	presetOnce       sync.Once
+	presetPassphrase []byte
+	presetErr        error
+)
+
+// scrypt cost parameters used for new files
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// highest scrypt parameters accepted from a file, scrypt takes 128*N*r bytes
+const (
+	scryptMaxN      = 1 << 20
+	scryptMaxR      = 32
+	scryptMaxP      = 16
+	scryptMaxMemory = 256 << 20
+)
+
+type EncryptedKey struct {
+	KDF    string `json:"kdf"` // "scrypt"
+	Salt   []byte `json:"salt"`
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	Cipher []byte `json:"cipher"` // AES-GCM, nonce prepended
+}
+
+// Encrypts a marshalled private key under a passphrase
+func EncryptPrivateKey(privBytes []byte, passphrase []byte) (*EncryptedKey, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	ek := &EncryptedKey{KDF: "scrypt", Salt: salt, N: scryptN, R: scryptR, P: scryptP}
+	key, err := scrypt.Key(passphrase, salt, ek.N, ek.R, ek.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	ek.Cipher, err = EncryptWithKey(key, privBytes)
+	if err != nil {
+		return nil, err
+	}
+	return ek, nil
+}
+
+// Decrypts a private key sealed by EncryptPrivateKey
+func DecryptPrivateKey(ek *EncryptedKey, passphrase []byte) ([]byte, error) {
+	if ek.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported kdf %q", ek.KDF)
+	}
+	if err := ek.checkCost(); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, ek.Salt, ek.N, ek.R, ek.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	privBytes, err := Decrypt(key, ek.Cipher)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted key")
+	}
+	return privBytes, nil
+}
+
+// refuses scrypt parameters that are invalid or would take too much memory or time
+func (ek *EncryptedKey) checkCost() error {
+	if ek.N < 2 || ek.N > scryptMaxN || ek.N&(ek.N-1) != 0 {
+		return fmt.Errorf("scrypt N must be a power of 2 up to %d", scryptMaxN)
+	}
+	if ek.R < 1 || ek.R > scryptMaxR || ek.P < 1 || ek.P > scryptMaxP {
+		return fmt.Errorf("scrypt r and p must be within 1..%d and 1..%d", scryptMaxR, scryptMaxP)
+	}
+	if 128*ek.N*ek.R > scryptMaxMemory {
+		return fmt.Errorf("scrypt parameters need more than %d MiB", scryptMaxMemory>>20)
+	}
+	return nil
+}
+
+/*
+Gets the identity passphrase from the environment, the passphrase file descriptor or a prompt.
+
+confirm asks twice when prompting, for new passphrases.
+*/
+func ReadPassphrase(prompt string, confirm bool) ([]byte, error) {
+	presetOnce.Do(readPresetPassphrase)
+	if presetErr != nil {
+		return nil, presetErr
+	}
+	if presetPassphrase != nil {
+		return append([]byte{}, presetPassphrase...), nil
+	}
+
+	passphrase, err := promptHidden(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		again, err := promptHidden("Repeat passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(passphrase) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// reads the passphrase from the environment or the descriptor, leaves it nil if neither is set
+func readPresetPassphrase() {
+	if v := os.Getenv(PASSPHRASE_ENV); v != "" {
+		presetPassphrase = []byte(v)
+		return
+	}
+	if PassphraseFD < 0 {
+		return
+	}
+
+	f := os.NewFile(uintptr(PassphraseFD), "passphrase")
+	if f == nil {
+		presetErr = fmt.Errorf("invalid passphrase fd %d", PassphraseFD)
+		return
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		presetErr = fmt.Errorf("read passphrase fd: %v", err)
+		return
+	}
+	presetPassphrase = []byte(strings.TrimRight(line, "\r\n"))
+}
+
+// reads a line from the terminal with echo turned off
+func promptHidden(prompt string) ([]byte, error) {
+	in, out := os.Stdin, os.Stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		in, out = tty, tty
+	}
+	if !term.IsTerminal(int(in.Fd())) {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase (set %s or --passphrase-fd)", PASSPHRASE_ENV)
+	}
+
+	fmt.Fprint(out, prompt)
+	passphrase, err := term.ReadPassword(int(in.Fd()))
+	fmt.Fprintln(out)
+	if err != nil {
+		return nil, err
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testEncryptedKey(t *testing.T) (*EncryptedKey, []byte) {
+	t.Helper()
+	privBytes := []byte("marshalled private key")
+	ek, err := EncryptPrivateKey(privBytes, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("EncryptPrivateKey: %v", err)
+	}
+	return ek, privBytes
+}
+
+func TestIdentityRoundTrip(t *testing.T) {
+	ek, privBytes := testEncryptedKey(t)
+	if bytes.Contains(ek.Cipher, privBytes) {
+		t.Fatal("private key stored in clear")
+	}
+
+	got, err := DecryptPrivateKey(ek, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("DecryptPrivateKey: %v", err)
+	}
+	if !bytes.Equal(got, privBytes) {
+		t.Errorf("decrypted %q", got)
+	}
+}
+
+func TestIdentityWrongPassphrase(t *testing.T) {
+	ek, _ := testEncryptedKey(t)
+	if _, err := DecryptPrivateKey(ek, []byte("battery staple")); err == nil {
+		t.Error("decrypted with the wrong passphrase")
+	}
+}
+
+func TestIdentityTampered(t *testing.T) {
+	cases := map[string]func(ek *EncryptedKey){
+		"cipher": func(ek *EncryptedKey) { ek.Cipher[len(ek.Cipher)-1] ^= 1 },
+		"nonce":  func(ek *EncryptedKey) { ek.Cipher[0] ^= 1 },
+		"salt":   func(ek *EncryptedKey) { ek.Salt[0] ^= 1 },
+	}
+	for name, tamper := range cases {
+		ek, _ := testEncryptedKey(t)
+		tamper(ek)
+		if _, err := DecryptPrivateKey(ek, []byte("correct horse")); err == nil {
+			t.Errorf("%s: tampered key decrypted", name)
+		}
+	}
+}
+
+func TestIdentityScryptBounds(t *testing.T) {
+	cases := map[string]func(ek *EncryptedKey){
+		"huge N":        func(ek *EncryptedKey) { ek.N = 1 << 30 },
+		"N not pow2":    func(ek *EncryptedKey) { ek.N = 3 << 10 },
+		"huge r":        func(ek *EncryptedKey) { ek.R = 1 << 20 },
+		"huge p":        func(ek *EncryptedKey) { ek.P = 1 << 20 },
+		"no p":          func(ek *EncryptedKey) { ek.P = 0 },
+		"memory":        func(ek *EncryptedKey) { ek.N, ek.R = scryptMaxN, scryptMaxR },
+		"negative r":    func(ek *EncryptedKey) { ek.R = -1 },
+		"unknown kdf":   func(ek *EncryptedKey) { ek.KDF = "argon2" },
+		"overflowing N": func(ek *EncryptedKey) { ek.N = -1 << 62 },
+	}
+	for name, tamper := range cases {
+		ek, _ := testEncryptedKey(t)
+		tamper(ek)
+		if _, err := DecryptPrivateKey(ek, []byte("correct horse")); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+/*
+# Limits.go
+
+Resource limits for the custom protocols.
+
+Three layers keep a peer from exhausting a node:
+
+  - the libp2p resource manager caps streams and memory per protocol, in total and per peer
+  - a token bucket per remote peer limits how often it can open store, upload and verify
+    streams; over the limit the stream gets a "rate limited" reply and is closed
+  - every json message read from a stream is capped (MAX_MESSAGE_SIZE, more for the
+    protocols carrying data blocks); bigger ones get a "too large" reply
+*/
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"golang.org/x/time/rate"
+)
+
+const (
+	MAX_MESSAGE_SIZE       = 1 << 20         // default cap of one json message
+	MAX_DATA_MESSAGE_SIZE  = 16 << 20        // cap for protocols carrying data blocks
+	DISCARD_TIMEOUT        = 5 * time.Second // how long the rest of a too large message is read and dropped
+	RATE_LIMITER_IDLE      = 10 * time.Minute
+	REPLY_RATE_LIMITED     = "rate limited"
+	REPLY_TOO_LARGE        = "too large"
+	REPLY_RESOURCE_LIMITED = "resource limit exceeded"
+)
+
+var (
+	ErrTooLarge        = errors.New(REPLY_TOO_LARGE)
+	ErrResourceLimited = errors.New(REPLY_RESOURCE_LIMITED)
+)
+
+// message caps per protocol, MAX_MESSAGE_SIZE for the rest
+var messageSizes = map[protocol.ID]int{
+	UPLOAD_PROTOCOL:   MAX_DATA_MESSAGE_SIZE,
+	STORE_PROTOCOL:    MAX_DATA_MESSAGE_SIZE,
+	RETRIEVE_PROTOCOL: MAX_DATA_MESSAGE_SIZE,
+}
+
+// largest json message accepted on a protocol
+func maxMessageSize(proto protocol.ID) int {
+	if size, ok := messageSizes[proto]; ok {
+		return size
+	}
+	return MAX_MESSAGE_SIZE
+}
+
+// token buckets per remote peer: requests per second and burst
+var rateLimits = map[protocol.ID]struct {
+	Rate  rate.Limit
+	Burst int
+}{
+	STORE_PROTOCOL:  {Rate: 20, Burst: 50},
+	UPLOAD_PROTOCOL: {Rate: 1, Burst: 5},
+	VERIFY_PROTOCOL: {Rate: 2, Burst: 10},
+}
+
+/*-------------------------- RESOURCE MANAGER -----------------------------------*/
+
+/*
+Resource manager option with the libp2p defaults plus caps for our protocols: streams
+and memory in total, and per peer. Memory is what readJSON reserves for the messages.
+*/
+func ResourceManagerOption() (libp2p.Option, error) {
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+
+	protocols := []protocol.ID{
+		PRINT_PROTOCOL, UPLOAD_PROTOCOL, STORE_PROTOCOL, DECRYPT_PROTOCOL, RETRIEVE_PROTOCOL,
+		DELETE_PROTOCOL, CREDENTIAL_PROTOCOL, VERIFY_PROTOCOL, MPC_PROTOCOL, MEMBERSHIP_PROTOCOL,
+	}
+	for _, proto := range protocols {
+		size := int64(maxMessageSize(proto))
+		limits.AddProtocolLimit(proto,
+			rcmgr.BaseLimit{Streams: 256, StreamsInbound: 128, StreamsOutbound: 128, Memory: 16 * size},
+			rcmgr.BaseLimitIncrease{})
+		limits.AddProtocolPeerLimit(proto,
+			rcmgr.BaseLimit{Streams: 32, StreamsInbound: 16, StreamsOutbound: 16, Memory: 4 * size},
+			rcmgr.BaseLimitIncrease{})
+	}
+
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits.AutoScale()))
+	if err != nil {
+		return nil, err
+	}
+	return libp2p.ResourceManager(rm), nil
+}
+
+/*-------------------------- RATE LIMITS -----------------------------------*/
+
+// token buckets of the peers that used a rate limited protocol recently
+type RateLimiter struct {
+	mu       sync.Mutex
+	limiters map[protocol.ID]map[peer.ID]*peerLimiter
+}
+
+type peerLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{limiters: make(map[protocol.ID]map[peer.ID]*peerLimiter)}
+}
+
+// true if p may open one more stream of proto now
+func (r *RateLimiter) Allow(proto protocol.ID, p peer.ID) bool {
+	limit, ok := rateLimits[proto]
+	if !ok {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peers := r.limiters[proto]
+	if peers == nil {
+		peers = make(map[peer.ID]*peerLimiter)
+		r.limiters[proto] = peers
+	}
+	pl := peers[p]
+	if pl == nil {
+		pl = &peerLimiter{limiter: rate.NewLimiter(limit.Rate, limit.Burst)}
+		peers[p] = pl
+	}
+	pl.lastSeen = time.Now()
+	return pl.limiter.Allow()
+}
+
+// Forgets peers idle for RATE_LIMITER_IDLE (their buckets are full again anyway)
+func (r *RateLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(RATE_LIMITER_IDLE)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			for _, peers := range r.limiters {
+				for p, pl := range peers {
+					if time.Since(pl.lastSeen) > RATE_LIMITER_IDLE {
+						delete(peers, p)
+					}
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// error-only reply, for streams refused before their handler runs
+type ErrorReply struct {
+	Error string `json:"error"`
+}
+
+// Wraps a handler so peers over their rate get a "rate limited" reply instead
+func (r *RateLimiter) Guard(proto protocol.ID, handler network.StreamHandler) network.StreamHandler {
+	if _, ok := rateLimits[proto]; !ok {
+		return handler
+	}
+	return func(s network.Stream) {
+		if !r.Allow(proto, s.Conn().RemotePeer()) {
+			writeJSON(s, ErrorReply{Error: REPLY_RATE_LIMITED})
+			s.Close()
+			return
+		}
+		handler(s)
+	}
+}
+
+/*-------------------------- MESSAGE SIZE -----------------------------------*/
+
+/*
+Reads one json line of at most the protocol cap. Its memory is reserved in the stream
+scope before each read (and released when the stream is closed), so the resource manager
+bounds what peers make us buffer.
+*/
+func readLimited(s network.Stream) ([]byte, error) {
+	max := maxMessageSize(s.Protocol())
+	r := &reservingReader{s: s}
+	raw, err := bufio.NewReader(io.LimitReader(r, int64(max)+1)).ReadBytes('\n')
+	limited := errors.Is(err, ErrResourceLimited)
+	if err != nil && err != io.EOF && !limited {
+		return nil, err
+	}
+	if len(raw) > max || limited {
+		//discard the rest for a while, so the sender can finish writing and read our reply
+		s.Scope().ReleaseMemory(r.reserved)
+		s.SetReadDeadline(time.Now().Add(DISCARD_TIMEOUT))
+		io.Copy(io.Discard, s)
+		if len(raw) > max {
+			return nil, ErrTooLarge
+		}
+		return nil, ErrResourceLimited
+	}
+	return raw, nil
+}
+
+// reads a stream, reserving the memory of each read in the stream scope before making it
+type reservingReader struct {
+	s        network.Stream
+	reserved int
+}
+
+func (r *reservingReader) Read(p []byte) (int, error) {
+	if err := r.s.Scope().ReserveMemory(len(p), network.ReservationPriorityMedium); err != nil {
+		return 0, ErrResourceLimited
+	}
+	n, err := r.s.Read(p)
+	r.s.Scope().ReleaseMemory(len(p) - n)
+	r.reserved += n
+	return n, err
+}
+
+// reply error for a request that could not be read
+func requestError(err error) string {
+	if errors.Is(err, ErrTooLarge) || errors.Is(err, ErrResourceLimited) {
+		return err.Error()
+	}
+	return "invalid request"
+}
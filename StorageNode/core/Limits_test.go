@@ -0,0 +1,104 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// a stream scope with a memory limit
+type fakeScope struct {
+	network.StreamScope
+	limit    int
+	reserved int
+	pending  int // reserved since the last read
+}
+
+func (sc *fakeScope) ReserveMemory(size int, prio uint8) error {
+	if sc.reserved+size > sc.limit {
+		return errors.New("memory limit")
+	}
+	sc.reserved += size
+	sc.pending += size
+	return nil
+}
+
+func (sc *fakeScope) ReleaseMemory(size int) {
+	sc.reserved -= size
+}
+
+// an inbound stream reading from a buffer, checking nothing is buffered that was not reserved
+type fakeStream struct {
+	network.Stream
+	data       *bytes.Reader
+	scope      *fakeScope
+	buffered   int  // bytes read before the rest was discarded
+	unreserved bool // a read went past its reservation
+	discarding bool
+}
+
+func newFakeStream(msg string, limit int) *fakeStream {
+	return &fakeStream{data: bytes.NewReader([]byte(msg)), scope: &fakeScope{limit: limit}}
+}
+
+func (s *fakeStream) Read(p []byte) (int, error) {
+	n, err := s.data.Read(p)
+	if !s.discarding {
+		s.buffered += n
+		s.unreserved = s.unreserved || n > s.scope.pending
+	}
+	s.scope.pending = 0
+	return n, err
+}
+
+func (s *fakeStream) Protocol() protocol.ID      { return PRINT_PROTOCOL }
+func (s *fakeStream) Scope() network.StreamScope { return s.scope }
+func (s *fakeStream) SetReadDeadline(time.Time) error {
+	s.discarding = true
+	return nil
+}
+
+func TestReadLimited(t *testing.T) {
+	msg := `{"hello":"world"}` + "\n"
+	s := newFakeStream(msg, MAX_MESSAGE_SIZE)
+	raw, err := readLimited(s)
+	if err != nil || string(raw) != msg {
+		t.Fatalf("readLimited = %q, %v", raw, err)
+	}
+	if s.unreserved || s.scope.reserved != s.buffered {
+		t.Errorf("reserved %d bytes for %d read", s.scope.reserved, s.buffered)
+	}
+}
+
+func TestReadLimitedTooLarge(t *testing.T) {
+	s := newFakeStream(strings.Repeat("a", MAX_MESSAGE_SIZE+10)+"\n", 4*MAX_MESSAGE_SIZE)
+	if _, err := readLimited(s); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("readLimited of a too large message: %v", err)
+	}
+	if s.data.Len() != 0 {
+		t.Error("rest of the message not discarded")
+	}
+	if s.unreserved || s.scope.reserved != 0 {
+		t.Errorf("%d bytes still reserved", s.scope.reserved)
+	}
+}
+
+// a message under the cap but over the memory left is refused before it is buffered
+func TestReadLimitedMemory(t *testing.T) {
+	const limit = 64 << 10
+	s := newFakeStream(strings.Repeat("a", 256<<10)+"\n", limit)
+	if _, err := readLimited(s); !errors.Is(err, ErrResourceLimited) {
+		t.Fatalf("readLimited over the memory limit: %v", err)
+	}
+	if s.unreserved || s.buffered > limit {
+		t.Errorf("buffered %d bytes with %d allowed", s.buffered, limit)
+	}
+	if s.data.Len() != 0 || s.scope.reserved != 0 {
+		t.Errorf("%d bytes left unread, %d still reserved", s.data.Len(), s.scope.reserved)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+# MDNS.go
+
+Local network peer discovery (opt-in, network.mdns in config.yaml).
+
+Nodes announce themselves over mDNS under a service name derived from the namespace, so
+only nodes of the same network find each other. A found node is connected to, which
+records it in the address book (see AddressBook.go), so Bootstrap.txt is no longer
+edited by hand for lab clusters.
+
+Other hosts only see usable addresses if the node listens on the LAN interface
+(e.g. /ip4/0.0.0.0/tcp/4001), not on 127.0.0.1.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+// how long connecting to a found node may take
+const MDNS_CONNECT_TIMEOUT = 10 * time.Second
+
+// mDNS service name of a namespace
+func mdnsServiceName(namespace string) string {
+	return fmt.Sprintf("_%s-dsn._udp", namespace)
+}
+
+type mdnsNotifee struct {
+	ctx context.Context
+	h   host.Host
+}
+
+// connects to a node found on the local network
+func (n *mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == n.h.ID() || len(pi.Addrs) == 0 || n.h.Network().Connectedness(pi.ID) == network.Connected {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, MDNS_CONNECT_TIMEOUT)
+	defer cancel()
+	if err := n.h.Connect(ctx, pi); err != nil {
+		ExplainDialError(pi.ID, err)
+		return
+	}
+
+	fmt.Printf("\n🔎 Found local node %s\n", pi.ID)
+}
+
+// Starts announcing this node and discovering others of the namespace on the local network
+func StartMDNS(ctx context.Context, h host.Host, namespace string) (mdns.Service, error) {
+	service := mdns.NewMdnsService(h, mdnsServiceName(namespace), &mdnsNotifee{ctx: ctx, h: h})
+	if err := service.Start(); err != nil {
+		return nil, err
+	}
+	fmt.Println("🔎 mDNS discovery enabled")
+	return service, nil
+}
@@ -0,0 +1,384 @@
+/*
+# MPC.go
+
+Optional multiparty evaluation of criteria rules over secret-shared attributes.
+
+When an upload asks for it, single attributes (DOB year/month/day, gender, state code)
+are Shamir-shared over the prime field p = 2^127 - 1 among the storage nodes, so a
+rule can be checked without ever rebuilding the attribute anywhere.
+
+Every attribute is a whole number in a public domain [min, max] (categories are
+numbered, see encodeMPCValue), and the uploading node (the only one that sees the
+plaintext anyway) shares its "thermometer" encoding rather than the value itself:
+
+	t_k = 1 if a >= k, else 0        for k = min+1 ... max
+
+Every rule is then a public linear combination of those bits that is exactly its
+verdict, which every holder computes locally on its shares:
+
+	greater c -> t_(c+1)
+	less c    -> 1 - t_c
+	equal s   -> t_s - t_(s+1)
+	in S      -> sum over s in S of (t_s - t_(s+1))
+
+(t_k is 1 for k <= min and 0 for k > max.) Opening the combination reveals the 0/1
+verdict and nothing else about a, so there are no masks to burn and no limit on how
+many times a record can be evaluated.
+
+Holders derive the combination themselves from the rule, and only for rules of the
+criteria the owner consented to (see the MPC protocol in StreamHandlers.go), so a
+coordinator can't open arbitrary bits.
+*/
+
+package core
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+)
+
+// p = 2^127 - 1
+var mpcPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 127), big.NewInt(1))
+
+// attributes that can be shared for MPC evaluation
+var MPCAttributes = []string{"DOB.year", "DOB.month", "DOB.day", "Gender", "State"}
+
+// genders that can be shared for MPC evaluation, numbered in this order
+var MPCGenders = []string{"female", "male", "non-binary", "other"}
+
+// domain [min, max] of every attribute, and whether greater/less make sense on it
+type mpcDomain struct {
+	Min     int64
+	Max     int64
+	Ordered bool
+}
+
+var mpcDomains = map[string]mpcDomain{
+	"DOB.year":  {1900, 2100, true},
+	"DOB.month": {1, 12, true},
+	"DOB.day":   {1, 31, true},
+	"Gender":    {0, int64(len(MPCGenders) - 1), false},
+	"State":     {0, 26*26 - 1, false}, // two letter codes
+}
+
+// one holder's shares for one attribute
+type MPCShareSet struct {
+	Attribute string   `json:"attribute"`
+	X         int      `json:"x"`
+	Bits      []string `json:"bits"` // Bits[i] is the share of t_(min+1+i) (decimal)
+}
+
+// where the shares of one attribute were sent
+type MPCPlacement struct {
+	Attribute string      `json:"attribute"`
+	Threshold int         `json:"threshold"`
+	Holders   []Placement `json:"holders"`
+}
+
+/*-------------------------- DEALING -----------------------------------*/
+
+// Extracts the MPC attributes from info; values that are missing or out of their domain are left out
+func MPCAttributeValues(info UserInfo) map[string]int64 {
+	raw := map[string]interface{}{
+		"DOB.year":  info.DOB.Year,
+		"DOB.month": info.DOB.Month,
+		"DOB.day":   info.DOB.Day,
+		"Gender":    info.Gender,
+		"State":     stateCode(info.Address),
+	}
+
+	values := make(map[string]int64)
+	for attribute, v := range raw {
+		a, err := encodeMPCValue(attribute, v)
+		d := mpcDomains[attribute]
+		if err == nil && a >= d.Min && a <= d.Max {
+			values[attribute] = a
+		}
+	}
+	return values
+}
+
+// Deals the shares of the thermometer encoding of one attribute for nShares holders
+func DealMPCShares(attribute string, value int64, nShares int, threshold int) ([]MPCShareSet, error) {
+	if threshold < 2 || threshold > nShares {
+		return nil, fmt.Errorf("invalid threshold %d of %d", threshold, nShares)
+	}
+	d, ok := mpcDomains[attribute]
+	if !ok {
+		return nil, fmt.Errorf("attribute %q can't be shared", attribute)
+	}
+	if value < d.Min || value > d.Max {
+		return nil, fmt.Errorf("%s out of its domain", attribute)
+	}
+
+	sets := make([]MPCShareSet, nShares)
+	for i := range sets {
+		sets[i] = MPCShareSet{Attribute: attribute, X: i + 1}
+	}
+
+	for k := d.Min + 1; k <= d.Max; k++ {
+		bit := big.NewInt(0)
+		if value >= k {
+			bit.SetInt64(1)
+		}
+		shares, err := shamirShareBig(bit, nShares, threshold)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sets {
+			sets[i].Bits = append(sets[i].Bits, shares[i].String())
+		}
+	}
+
+	return sets, nil
+}
+
+/*-------------------------- EVALUATION -----------------------------------*/
+
+/*
+Turns a rule into its linear combination of the thermometer bits: a constant and the
+coefficient of every t_k it uses (keyed by k, only for k in min+1 ... max).
+*/
+func MPCRuleCoefficients(r Rule) (int64, map[int64]int64, error) {
+	d, ok := mpcDomains[r.Field]
+	if !ok {
+		return 0, nil, fmt.Errorf("attribute %q can't be evaluated with mpc", r.Field)
+	}
+
+	constant := int64(0)
+	coeffs := make(map[int64]int64)
+	//adds c * t_k, folding the bits that are known for every value of the domain
+	add := func(c int64, k int64) {
+		switch {
+		case k <= d.Min:
+			constant += c
+		case k <= d.Max:
+			coeffs[k] += c
+		}
+	}
+
+	switch r.Type {
+	case "greater", "less":
+		if !d.Ordered {
+			return 0, nil, fmt.Errorf("rule %q on %q needs an ordered attribute", r.Type, r.Field)
+		}
+		c, err := encodeMPCValue(r.Field, r.Value)
+		if err != nil {
+			return 0, nil, err
+		}
+		if r.Type == "greater" {
+			add(1, c+1)
+		} else {
+			constant++
+			add(-1, c)
+		}
+	case "equal", "in":
+		set := []interface{}{r.Value}
+		if r.Type == "in" {
+			list, ok := r.Value.([]interface{})
+			if !ok {
+				return 0, nil, fmt.Errorf("rule \"in\" on %q needs a list", r.Field)
+			}
+			set = list
+		}
+
+		seen := make(map[int64]bool)
+		for _, v := range set {
+			s, err := encodeMPCValue(r.Field, v)
+			if errors.Is(err, errUnknownCategory) {
+				continue // matches no shared value
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			if seen[s] || s < d.Min || s > d.Max {
+				continue
+			}
+			seen[s] = true
+			add(1, s)
+			add(-1, s+1)
+		}
+	default:
+		return 0, nil, fmt.Errorf("unknown rule type %q", r.Type)
+	}
+
+	for k, c := range coeffs {
+		if c == 0 {
+			delete(coeffs, k)
+		}
+	}
+	return constant, coeffs, nil
+}
+
+// Computes this holder's share of the verdict of a rule over the attribute it holds
+func EvalMPCShare(set *MPCShareSet, r Rule) (*big.Int, error) {
+	if r.Field != set.Attribute {
+		return nil, fmt.Errorf("shares are for %q, not %q", set.Attribute, r.Field)
+	}
+	d := mpcDomains[set.Attribute]
+	if int64(len(set.Bits)) != d.Max-d.Min {
+		return nil, errors.New("corrupted shares")
+	}
+
+	constant, coeffs, err := MPCRuleCoefficients(r)
+	if err != nil {
+		return nil, err
+	}
+
+	//a public constant is its own share
+	sum := fieldInt(constant)
+	for k, c := range coeffs {
+		v, ok := new(big.Int).SetString(set.Bits[k-d.Min-1], 10)
+		if !ok {
+			return nil, errors.New("corrupted shares")
+		}
+		sum = addMod(sum, mulMod(fieldInt(c), v))
+	}
+	return sum, nil
+}
+
+// Combines the holders' shares of a verdict (keyed by x-coordinate); anything but 0 or 1 means a holder lied
+func MPCRuleResult(shares map[int]*big.Int) (bool, error) {
+	y := combineBig(shares)
+	switch {
+	case y.Sign() == 0:
+		return false, nil
+	case y.Cmp(big.NewInt(1)) == 0:
+		return true, nil
+	default:
+		return false, errors.New("inconsistent mpc shares")
+	}
+}
+
+// true if every rule of the criteria can be evaluated with MPC
+func MPCSupports(c Criteria) bool {
+	for _, r := range append(append([]Rule{}, c.All...), c.Any...) {
+		if _, _, err := MPCRuleCoefficients(r); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// the rules of a criteria in order, All then Any (how MPC requests refer to them)
+func criteriaRules(c Criteria) []Rule {
+	return append(append([]Rule{}, c.All...), c.Any...)
+}
+
+/*-------------------------- FIELD HELPERS -----------------------------------*/
+
+func shamirShareBig(secret *big.Int, nShares int, threshold int) ([]*big.Int, error) {
+	coeffs := []*big.Int{secret}
+	for i := 1; i < threshold; i++ {
+		c, err := rand.Int(rand.Reader, mpcPrime)
+		if err != nil {
+			return nil, err
+		}
+		coeffs = append(coeffs, c)
+	}
+
+	shares := make([]*big.Int, nShares)
+	for x := 1; x <= nShares; x++ {
+		bx := big.NewInt(int64(x))
+		y := new(big.Int)
+		for i := threshold - 1; i >= 0; i-- {
+			y = addMod(mulMod(y, bx), coeffs[i])
+		}
+		shares[x-1] = y
+	}
+	return shares, nil
+}
+
+// lagrange interpolation at 0
+func combineBig(shares map[int]*big.Int) *big.Int {
+	result := new(big.Int)
+	for xi, yi := range shares {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for xj := range shares {
+			if xj == xi {
+				continue
+			}
+			num = mulMod(num, big.NewInt(int64(xj)))
+			den = mulMod(den, new(big.Int).Mod(big.NewInt(int64(xj-xi)), mpcPrime))
+		}
+		l := mulMod(num, new(big.Int).ModInverse(den, mpcPrime))
+		result = addMod(result, mulMod(l, yi))
+	}
+	return result
+}
+
+func addMod(a, b *big.Int) *big.Int {
+	return new(big.Int).Mod(new(big.Int).Add(a, b), mpcPrime)
+}
+
+func mulMod(a, b *big.Int) *big.Int {
+	return new(big.Int).Mod(new(big.Int).Mul(a, b), mpcPrime)
+}
+
+// v mod p, for small signed coefficients
+func fieldInt(v int64) *big.Int {
+	return new(big.Int).Mod(big.NewInt(v), mpcPrime)
+}
+
+var errUnknownCategory = errors.New("unknown category")
+
+/*
+Encodes an attribute or rule value as a whole number of its domain: numbers as they are,
+genders as their index in MPCGenders (case and spaces don't matter) and two letter
+state codes as (first letter)*26 + (second letter).
+*/
+func encodeMPCValue(field string, v interface{}) (int64, error) {
+	switch field {
+	case "Gender":
+		s, ok := v.(string)
+		if !ok {
+			return 0, fmt.Errorf("rule on %q needs a string", field)
+		}
+		s = strings.ToLower(strings.TrimSpace(s))
+		for i, g := range MPCGenders {
+			if s == g {
+				return int64(i), nil
+			}
+		}
+		return 0, errUnknownCategory
+	case "State":
+		s, ok := v.(string)
+		if !ok {
+			return 0, fmt.Errorf("rule on %q needs a string", field)
+		}
+		s = strings.ToUpper(strings.TrimSpace(s))
+		if len(s) != 2 || s[0] < 'A' || s[0] > 'Z' || s[1] < 'A' || s[1] > 'Z' {
+			return 0, errUnknownCategory
+		}
+		return int64(s[0]-'A')*26 + int64(s[1]-'A'), nil
+	}
+
+	switch value := v.(type) {
+	case float64:
+		if value != float64(int64(value)) {
+			return 0, fmt.Errorf("rule on %q needs whole numbers", field)
+		}
+		return int64(value), nil
+	case int:
+		return int64(value), nil
+	default:
+		return 0, fmt.Errorf("unsupported value for %q", field)
+	}
+}
+
+// two letter state code of an address like "1 Main St, Springfield, IL 62704" (empty if there is none)
+func stateCode(address string) string {
+	parts := strings.Split(address, ",")
+	for i := len(parts) - 1; i >= 0; i-- {
+		for _, word := range strings.Fields(parts[i]) {
+			if len(word) == 2 && unicode.IsUpper(rune(word[0])) && unicode.IsUpper(rune(word[1])) {
+				return word
+			}
+		}
+	}
+	return ""
+}
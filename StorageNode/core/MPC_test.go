@@ -0,0 +1,156 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestShamirBigRoundTrip(t *testing.T) {
+	secret := new(big.Int).Sub(mpcPrime, big.NewInt(12345))
+	shares, err := shamirShareBig(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, idx := range [][]int{{0, 1, 2}, {1, 3, 4}, {0, 2, 3, 4}} {
+		subset := make(map[int]*big.Int)
+		for _, i := range idx {
+			subset[i+1] = shares[i]
+		}
+		if got := combineBig(subset); got.Cmp(secret) != 0 {
+			t.Errorf("shares %v combine to %v", idx, got)
+		}
+	}
+
+	subset := map[int]*big.Int{1: shares[0], 2: shares[1]}
+	if combineBig(subset).Cmp(secret) == 0 {
+		t.Error("2 shares of a 3-of-5 sharing gave the secret")
+	}
+}
+
+func TestFieldHelpers(t *testing.T) {
+	minusOne := fieldInt(-1)
+	if addMod(minusOne, big.NewInt(1)).Sign() != 0 {
+		t.Error("-1 + 1 != 0")
+	}
+	if mulMod(minusOne, minusOne).Cmp(big.NewInt(1)) != 0 {
+		t.Error("-1 * -1 != 1")
+	}
+	if mulMod(mpcPrime, big.NewInt(7)).Sign() != 0 {
+		t.Error("p is not 0")
+	}
+}
+
+// opens the verdict of r from the shares of the given holders
+func openMPCVerdict(t *testing.T, sets []MPCShareSet, r Rule, holders ...int) (bool, error) {
+	t.Helper()
+	shares := make(map[int]*big.Int)
+	for _, i := range holders {
+		v, err := EvalMPCShare(&sets[i], r)
+		if err != nil {
+			return false, err
+		}
+		shares[sets[i].X] = v
+	}
+	return MPCRuleResult(shares)
+}
+
+func TestMPCVerdicts(t *testing.T) {
+	info := UserInfo{Gender: "Female", DOB: DOB{Year: 1990, Month: 6, Day: 15}, Address: "1 Main St, Springfield, IL 62704"}
+	values := MPCAttributeValues(info)
+	if len(values) != len(MPCAttributes) {
+		t.Fatalf("shared %d of %d attributes: %v", len(values), len(MPCAttributes), values)
+	}
+
+	shared := make(map[string][]MPCShareSet)
+	for attribute, v := range values {
+		sets, err := DealMPCShares(attribute, v, 5, 3)
+		if err != nil {
+			t.Fatalf("DealMPCShares %s: %v", attribute, err)
+		}
+		shared[attribute] = sets
+	}
+
+	cases := []struct {
+		rule Rule
+		want bool
+	}{
+		{Rule{Field: "DOB.year", Type: "less", Value: float64(2007)}, true},
+		{Rule{Field: "DOB.year", Type: "less", Value: float64(1990)}, false},
+		{Rule{Field: "DOB.year", Type: "greater", Value: float64(1989)}, true},
+		{Rule{Field: "DOB.year", Type: "greater", Value: float64(1990)}, false},
+		{Rule{Field: "DOB.year", Type: "greater", Value: float64(1800)}, true},
+		{Rule{Field: "DOB.year", Type: "less", Value: float64(3000)}, true},
+		{Rule{Field: "DOB.month", Type: "equal", Value: float64(6)}, true},
+		{Rule{Field: "DOB.month", Type: "equal", Value: float64(7)}, false},
+		{Rule{Field: "DOB.day", Type: "in", Value: []interface{}{float64(1), float64(15), float64(15)}}, true},
+		{Rule{Field: "DOB.day", Type: "in", Value: []interface{}{float64(14), float64(16), float64(99)}}, false},
+		{Rule{Field: "Gender", Type: "equal", Value: "female"}, true},
+		{Rule{Field: "Gender", Type: "in", Value: []interface{}{"male", "unknown"}}, false},
+		{Rule{Field: "State", Type: "in", Value: []interface{}{"CA", "IL"}}, true},
+		{Rule{Field: "State", Type: "equal", Value: "NY"}, false},
+	}
+
+	for _, c := range cases {
+		r := c.rule
+		if r.Field == "DOB.year" || r.Field == "DOB.month" || r.Field == "DOB.day" {
+			plain, err := EvaluateCriteria(info, Criteria{All: []Rule{r}})
+			if err != nil || plain != c.want {
+				t.Fatalf("plaintext %s %s %v: %v %v", r.Field, r.Type, r.Value, plain, err)
+			}
+		}
+		for _, holders := range [][]int{{0, 1, 2}, {2, 3, 4}} {
+			got, err := openMPCVerdict(t, shared[r.Field], r, holders...)
+			if err != nil {
+				t.Fatalf("mpc %s %s %v: %v", r.Field, r.Type, r.Value, err)
+			}
+			if got != c.want {
+				t.Errorf("%s %s %v: mpc %v, want %v", r.Field, r.Type, r.Value, got, c.want)
+			}
+		}
+	}
+}
+
+func TestMPCRuleChecks(t *testing.T) {
+	sets, err := DealMPCShares("Gender", 1, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openMPCVerdict(t, sets, Rule{Field: "Gender", Type: "greater", Value: "female"}, 0, 1); err == nil {
+		t.Error("evaluated an order rule on a category")
+	}
+	if _, err := openMPCVerdict(t, sets, Rule{Field: "DOB.year", Type: "less", Value: float64(2000)}, 0, 1); err == nil {
+		t.Error("evaluated a rule on the shares of another attribute")
+	}
+	if _, err := DealMPCShares("DOB.month", 13, 3, 2); err == nil {
+		t.Error("dealt a value out of its domain")
+	}
+	if _, err := DealMPCShares("DOB.month", 5, 3, 1); err == nil {
+		t.Error("dealt with a threshold of 1")
+	}
+	if MPCSupports(Criteria{All: []Rule{{Field: "Name", Type: "equal", Value: "x"}}}) {
+		t.Error("MPCSupports accepted a rule on Name")
+	}
+}
+
+func TestMPCInconsistentShares(t *testing.T) {
+	sets, err := DealMPCShares("DOB.month", 6, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Rule{Field: "DOB.month", Type: "equal", Value: float64(6)}
+
+	shares := make(map[int]*big.Int)
+	for i := 0; i < 2; i++ {
+		v, err := EvalMPCShare(&sets[i], r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares[sets[i].X] = v
+	}
+	shares[sets[1].X] = addMod(shares[sets[1].X], big.NewInt(5))
+	if _, err := MPCRuleResult(shares); err == nil {
+		t.Error("accepted a tampered share")
+	}
+}
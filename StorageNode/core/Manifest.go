@@ -0,0 +1,470 @@
+/*
+# Manifest.go
+
+A manifest describes where the pieces of one stored identity record live:
+the encrypted data block, the threshold key fragments and the wrapped AES key.
+
+Manifests are published in the DHT record store, under the node's custom namespace:
+	/
+	├── <namespace>/
+	│     ├── manifest/
+	│     │     ├── <manifest id> : manifest json
+
+Every version is signed by the node publishing it (see SignManifest). The first one is
+published by the gateway that placed the record, which stays named in every later
+version; those must be signed by the gateway again or by an admin member (key rotation),
+whose membership presentation goes along. A record with an owner also carries the owner's
+claim on it, signed by the owner key in the upload payload (see SignOwnerClaim). Records
+can't change their gateway, owner or format, see the manifest rules in Validators.go.
+
+Records placed since consent (format MANIFEST_FORMAT_CONSENT) always have an owner; only
+the ones placed before, without a format, may have none.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// manifest formats
+const (
+	MANIFEST_FORMAT_LEGACY  = 0 // placed before consent, the owner is optional
+	MANIFEST_FORMAT_CONSENT = 1 // the owner is required, see Consent.go
+)
+
+// where a piece of a record was sent
+type Placement struct {
+	Hash string `json:"hash"`
+	Peer string `json:"peer"` // did:key of the holder (peer ID in older manifests), see ParseNodeRef
+}
+
+// how placements name a holder: its did:key, or its peer ID for keys that have none
+func nodeRef(id peer.ID) string {
+	if did, err := DIDFromPeerID(id); err == nil {
+		return did
+	}
+	return id.String()
+}
+
+type Manifest struct {
+	ID         string         `json:"id"`
+	Format     int            `json:"format,omitempty"` // MANIFEST_FORMAT_*, kept across versions
+	Version    int            `json:"version"`          // bumped on every key rotation
+	Block      Placement      `json:"block"`
+	Fragments  []Placement    `json:"fragments"`
+	Threshold  int            `json:"threshold"`  // k in k-of-n
+	Total      int            `json:"total"`      // n in k-of-n
+	PublicKey  []byte         `json:"public_key"` // threshold public key the data key is wrapped under
+	WrappedKey WrappedKey     `json:"wrapped_key"`
+	MPC        []MPCPlacement `json:"mpc,omitempty"`   // secret-shared attributes, if the upload asked for them
+	Owner      string         `json:"owner,omitempty"` // did:key whose consent is needed to use the record, see Consent.go
+	ACL        *ACL           `json:"acl,omitempty"`   // owner-signed access control list, see ACL.go
+	CreatedAt  time.Time      `json:"created_at"`
+
+	OwnerSignature []byte                  `json:"owner_signature,omitempty"` // owner claim on the record, see SignOwnerClaim
+	Gateway        string                  `json:"gateway"`                   // did:key of the node that published the first version
+	Signer         string                  `json:"signer"`                    // did:key of the node that published this one
+	SignerCert     *MembershipPresentation `json:"signer_cert,omitempty"`     // admin membership of the signer, when it is not the gateway
+	Signature      []byte                  `json:"signature,omitempty"`       // by the signer
+}
+
+// manifest id for a user id
+func ManifestID(uid string) string {
+	return CidHash([]byte("manifest#" + uid)).String()
+}
+
+// hash a fragment is stored under, unique per manifest version
+func fragmentHash(id string, version int, i int) string {
+	return CidHash([]byte(fmt.Sprintf("%s#%d#fragment#%d", id, version, i))).String()
+}
+
+// every stored piece of the record: block, fragments and MPC shares
+func (m *Manifest) Placements() []Placement {
+	all := append([]Placement{m.Block}, m.Fragments...)
+	for _, a := range m.MPC {
+		all = append(all, a.Holders...)
+	}
+	return all
+}
+
+// the MPC shares of an attribute, nil if it was not shared
+func (m *Manifest) MPCAttribute(attribute string) *MPCPlacement {
+	for i := range m.MPC {
+		if m.MPC[i].Attribute == attribute {
+			return &m.MPC[i]
+		}
+	}
+	return nil
+}
+
+// what an owner signs to claim a record
+func ownerClaimBytes(manifestID string, owner string) []byte {
+	return []byte(fmt.Sprintf("dsn-manifest-owner/1\n%s\n%s", manifestID, owner))
+}
+
+// Signs the claim of the owner key on a record, sent as owner_signature in the upload payload
+func SignOwnerClaim(owner crypto.PrivKey, manifestID string) ([]byte, error) {
+	did, err := DIDFromPubKey(owner.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	return owner.Sign(ownerClaimBytes(manifestID, did))
+}
+
+// checks an owner claim against the owner did:key
+func verifyOwnerClaim(manifestID string, owner string, sig []byte) error {
+	pub, err := PubKeyFromDID(owner)
+	if err != nil {
+		return fmt.Errorf("owner: %v", err)
+	}
+	if ok, err := pub.Verify(ownerClaimBytes(manifestID, owner), sig); err != nil || !ok {
+		return errors.New("record not claimed by its owner")
+	}
+	return nil
+}
+
+/*
+Signs a manifest version with the node key.
+
+A manifest without a gateway is a first version: the signer becomes its gateway. Any
+other signer must be an admin member, pres (the node's membership presentation) goes
+along so others can check it.
+*/
+func SignManifest(priv crypto.PrivKey, pres *MembershipPresentation, m *Manifest) error {
+	signer, err := DIDFromPubKey(priv.GetPublic())
+	if err != nil {
+		return err
+	}
+	if m.Gateway == "" {
+		m.Gateway = signer
+	}
+	m.Signer = signer
+	m.SignerCert = nil
+	if signer != m.Gateway {
+		m.SignerCert = pres
+	}
+
+	m.Signature = nil
+	msg, err := canonicalJSON(m)
+	if err != nil {
+		return err
+	}
+	m.Signature, err = priv.Sign(msg)
+	return err
+}
+
+/*
+Checks the signatures of a manifest version: the signer's, the owner claim if it has an
+owner, and that the signer is the gateway or an admin member under root. Without root
+(membership checks off) only the gateway can sign.
+*/
+func (m *Manifest) Verify(root crypto.PubKey) error {
+	pub, err := PubKeyFromDID(m.Signer)
+	if err != nil {
+		return fmt.Errorf("manifest signer: %v", err)
+	}
+	unsigned := *m
+	unsigned.Signature = nil
+	msg, err := canonicalJSON(unsigned)
+	if err != nil {
+		return err
+	}
+	if ok, err := pub.Verify(msg, m.Signature); err != nil || !ok {
+		return errors.New("manifest not signed by its signer")
+	}
+
+	if m.Owner != "" {
+		if err := verifyOwnerClaim(m.ID, m.Owner, m.OwnerSignature); err != nil {
+			return err
+		}
+	} else if m.Format != MANIFEST_FORMAT_LEGACY {
+		return errors.New("manifest without an owner")
+	}
+
+	if m.Signer == m.Gateway {
+		return nil
+	}
+	if root == nil || m.SignerCert == nil {
+		return errors.New("manifest not signed by its gateway")
+	}
+	signer, err := PeerIDFromDID(m.Signer)
+	if err != nil {
+		return err
+	}
+	if err := m.SignerCert.VerifyFor(root, signer); err != nil {
+		return fmt.Errorf("manifest signer: %v", err)
+	}
+	if m.SignerCert.Role != ROLE_ADMIN {
+		return errors.New("manifest signer is neither its gateway nor an admin")
+	}
+	return nil
+}
+
+// the record a manifest version belongs to: later versions can't change its gateway or owner
+func (m *Manifest) sameRecord(other *Manifest) bool {
+	return m.ID == other.ID && m.Gateway == other.Gateway && m.Owner == other.Owner && m.Format == other.Format
+}
+
+func manifestKey(namespace string, id string) string {
+	return fmt.Sprintf("/%s/manifest/%s", namespace, id)
+}
+
+// Puts the manifest in the DHT record store, signed with SignManifest
+func PublishManifest(ctx context.Context, kadDHT *dht.IpfsDHT, namespace string, m *Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return kadDHT.PutValue(ctx, manifestKey(namespace, m.ID), data)
+}
+
+// publishes a manifest version and keeps it published (see RepublishRecords)
+func (sm *StreamsMaster) publishManifest(ctx context.Context, m *Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return sm.publishRecord(ctx, manifestKey(sm.namespace, m.ID), data)
+}
+
+// signs a manifest version as this node, see SignManifest
+func (sm *StreamsMaster) signManifest(m *Manifest) error {
+	var pres *MembershipPresentation
+	if sm.gater != nil {
+		pres = sm.gater.own
+	}
+	return SignManifest(sm.h.Peerstore().PrivKey(sm.h.ID()), pres, m)
+}
+
+// Gets a manifest from the DHT record store
+func FetchManifest(ctx context.Context, kadDHT *dht.IpfsDHT, namespace string, id string) (*Manifest, error) {
+	data, err := kadDHT.GetValue(ctx, manifestKey(namespace, id))
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s not found: %v", id, err)
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", id, err)
+	}
+	return m, nil
+}
+
+/*
+Encrypts plaintext under a fresh AES key, wraps the key under a fresh threshold key
+and sends the data block and the threshold shares to the storage network.
+
+Every fragment goes to a different peer, and so does every share of an MPC attribute;
+peers in exclude are avoided when possible. A new record (version 1) must be an upload
+claimed by its owner; later versions keep the format of the first one, set by the caller. onSending (if not nil) is called for every
+piece right before it is sent, so callers can keep track of partial placements; an error
+from it stops the placement before that piece leaves this node.
+Returns the manifest describing the new placement; it is NOT published.
+*/
+func (sm *StreamsMaster) PlaceRecord(ctx context.Context, id string, version int, plaintext []byte, exclude map[peer.ID]bool, onSending func(Placement) error) (*Manifest, error) {
+	if onSending == nil {
+		onSending = func(Placement) error { return nil }
+	}
+
+	// Encrypt Data
+	cipher, key, err := Encrypt(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %v", err)
+	}
+
+	// Wrap the key under a fresh threshold key, nobody keeps the full private key
+	pub, shares, err := NewThresholdKey(sm.cfg.Thresholds.Fragments, sm.cfg.Thresholds.Threshold)
+	if err != nil {
+		return nil, fmt.Errorf("threshold key: %v", err)
+	}
+	wrapped, err := WrapKey(pub, key)
+	if err != nil {
+		return nil, fmt.Errorf("wrap key: %v", err)
+	}
+
+	payload := UploadPayload{}
+	isUpload := json.Unmarshal(plaintext, &payload) == nil
+	if version == 1 && (!isUpload || payload.Owner == "" || len(payload.OwnerSignature) == 0) {
+		return nil, errors.New("owner and owner_signature are required")
+	}
+	if isUpload && payload.Owner != "" {
+		if err := verifyOwnerClaim(id, payload.Owner, payload.OwnerSignature); err != nil {
+			return nil, err
+		}
+	}
+	if isUpload && payload.ACL != nil {
+		if payload.ACL.Owner != payload.Owner || payload.ACL.ManifestID != id {
+			return nil, fmt.Errorf("acl: not for this record")
+		}
+		if err := payload.ACL.Verify(); err != nil {
+			return nil, fmt.Errorf("acl: %v", err)
+		}
+	}
+
+	manifest := &Manifest{
+		ID:         id,
+		Version:    version,
+		Threshold:  sm.cfg.Thresholds.Threshold,
+		Total:      sm.cfg.Thresholds.Fragments,
+		PublicKey:  pub,
+		WrappedKey: *wrapped,
+		Owner:      payload.Owner,
+		ACL:        payload.ACL,
+		CreatedAt:  time.Now().UTC(),
+
+		OwnerSignature: payload.OwnerSignature,
+	}
+	if version == 1 {
+		manifest.Format = MANIFEST_FORMAT_CONSENT
+	}
+
+	// Send to Blob storage network
+	blob := SimpleData{
+		Hash: CidHash(cipher).String(),
+		Data: base64.StdEncoding.EncodeToString(cipher),
+	}
+	blockHolders, err := sm.pickHolders(1, exclude, len(blob.Data))
+	if err != nil {
+		return nil, fmt.Errorf("store data block: %v", err)
+	}
+	target := blockHolders[0]
+	block := Placement{Hash: blob.Hash, Peer: nodeRef(target)}
+	if err := onSending(block); err != nil {
+		return nil, err
+	}
+	if err := sm.StoreSend(ctx, target, StoreRequest{SimpleData: blob, ManifestID: id}); err != nil {
+		return nil, fmt.Errorf("store data block: %v", err)
+	}
+	manifest.Block = block
+
+	// Send threshold key shares, one per holder
+	holders, err := sm.pickHolders(len(shares), exclude, base64.StdEncoding.EncodedLen(len(shares[0])))
+	if err != nil {
+		return manifest, fmt.Errorf("fragments: %v", err)
+	}
+	for i, share := range shares {
+		fp := SimpleData{
+			Hash: fragmentHash(id, version, i),
+			Data: base64.StdEncoding.EncodeToString(share),
+		}
+
+		target := holders[i]
+		placed := Placement{Hash: fp.Hash, Peer: nodeRef(target)}
+		if err := onSending(placed); err != nil {
+			return manifest, err
+		}
+		if err := sm.StoreSend(ctx, target, StoreRequest{SimpleData: fp, ManifestID: id}); err != nil {
+			fmt.Printf("Error sending fragment %d: %v\n", i+1, err)
+			continue
+		}
+		manifest.Fragments = append(manifest.Fragments, placed)
+	}
+
+	if len(manifest.Fragments) < manifest.Threshold {
+		return manifest, fmt.Errorf("only %d of %d fragments stored", len(manifest.Fragments), manifest.Total)
+	}
+
+	// Secret-share single attributes, if the upload asked for it
+	if isUpload && payload.MPC {
+		info := UserInfo{}
+		if err := json.Unmarshal(payload.UserData, &info); err != nil {
+			return manifest, fmt.Errorf("mpc: user data is not a UserInfo: %v", err)
+		}
+		for attribute, value := range MPCAttributeValues(info) {
+			placement, err := sm.placeMPCShares(ctx, id, version, attribute, value, exclude, onSending)
+			if err != nil {
+				return manifest, fmt.Errorf("mpc %s: %v", attribute, err)
+			}
+			manifest.MPC = append(manifest.MPC, *placement)
+		}
+	}
+
+	return manifest, nil
+}
+
+// deals and sends the MPC shares of one attribute
+func (sm *StreamsMaster) placeMPCShares(ctx context.Context, id string, version int, attribute string, value int64, exclude map[peer.ID]bool, onSending func(Placement) error) (*MPCPlacement, error) {
+	sets, err := DealMPCShares(attribute, value, sm.cfg.Thresholds.Fragments, sm.cfg.Thresholds.Threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	// one holder per share set, sized after the first set (they only differ in their values)
+	first, err := json.Marshal(sets[0])
+	if err != nil {
+		return nil, err
+	}
+	holders, err := sm.pickHolders(len(sets), exclude, base64.StdEncoding.EncodedLen(len(first)))
+	if err != nil {
+		return nil, err
+	}
+
+	placement := &MPCPlacement{Attribute: attribute, Threshold: sm.cfg.Thresholds.Threshold}
+	for i, set := range sets {
+		data, err := json.Marshal(set)
+		if err != nil {
+			return nil, err
+		}
+		sd := SimpleData{
+			Hash: CidHash([]byte(fmt.Sprintf("%s#%d#mpc#%s#%d", id, version, attribute, set.X))).String(),
+			Data: base64.StdEncoding.EncodeToString(data),
+		}
+
+		target := holders[i]
+		placed := Placement{Hash: sd.Hash, Peer: nodeRef(target)}
+		if err := onSending(placed); err != nil {
+			return nil, err
+		}
+		if err := sm.StoreSend(ctx, target, StoreRequest{SimpleData: sd, ManifestID: id}); err != nil {
+			fmt.Printf("Error sending %s share %d: %v\n", attribute, set.X, err)
+			continue
+		}
+		placement.Holders = append(placement.Holders, placed)
+	}
+
+	if len(placement.Holders) < placement.Threshold {
+		return nil, fmt.Errorf("only %d of %d shares stored", len(placement.Holders), len(sets))
+	}
+	return placement, nil
+}
+
+/*
+Recovers the data key in a verifier session, fetches the data block and decrypts it.
+
+request (the verification request being served, nil for key rotation) is forwarded to
+the holders, see Consent.go.
+*/
+func (sm *StreamsMaster) OpenRecord(ctx context.Context, m *Manifest, request *Envelope) ([]byte, error) {
+	key, err := sm.RecoverDataKey(ctx, m, request)
+	if err != nil {
+		return nil, fmt.Errorf("recover data key: %v", err)
+	}
+
+	blockPeer, err := sm.holder(ctx, m.Block)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block holder: %v", err)
+	}
+	block, err := sm.RetrieveSend(ctx, blockPeer, HashRequest{ManifestID: m.ID, Hash: m.Block.Hash, Request: request})
+	if err != nil {
+		return nil, fmt.Errorf("retrieve data block: %v", err)
+	}
+	cipher, err := base64.StdEncoding.DecodeString(block.Data)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted data block: %v", err)
+	}
+	plaintext, err := Decrypt(key, cipher)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt data block: %v", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// a first version of an owned record, signed by gateway
+func signedTestManifest(t *testing.T, gateway crypto.PrivKey) *Manifest {
+	t.Helper()
+	m, owner := ownedTestManifest(t)
+	m.Version = 1
+	m.Format = MANIFEST_FORMAT_CONSENT
+	m.CreatedAt = time.Now().UTC()
+
+	var err error
+	if m.OwnerSignature, err = SignOwnerClaim(owner, m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := SignManifest(gateway, nil, m); err != nil {
+		t.Fatalf("SignManifest: %v", err)
+	}
+	return m
+}
+
+// a membership presentation for priv, signed by root
+func testPresentation(t *testing.T, root crypto.PrivKey, priv crypto.PrivKey, role string) *MembershipPresentation {
+	t.Helper()
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := SignMembership(root, id, role, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MembershipPresentation{MembershipCert: *cert}
+}
+
+func TestManifestSignature(t *testing.T) {
+	m := signedTestManifest(t, testKey(t))
+	if err := m.Verify(nil); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	cases := map[string]func(m *Manifest){
+		"version":   func(m *Manifest) { m.Version = 7 },
+		"fragments": func(m *Manifest) { m.Fragments = []Placement{{Hash: "h", Peer: "p"}} },
+		"owner":     func(m *Manifest) { m.Owner, _ = DIDFromPubKey(testKey(t).GetPublic()) },
+		"gateway":   func(m *Manifest) { m.Gateway, _ = DIDFromPubKey(testKey(t).GetPublic()) },
+		"claim":     func(m *Manifest) { m.OwnerSignature = nil },
+	}
+	for name, tamper := range cases {
+		m := signedTestManifest(t, testKey(t))
+		tamper(m)
+		if err := m.Verify(nil); err == nil {
+			t.Errorf("%s: tampered manifest verified", name)
+		}
+	}
+}
+
+func TestManifestSigners(t *testing.T) {
+	root := testKey(t)
+	gateway := testKey(t)
+
+	//the gateway signs later versions too
+	m := signedTestManifest(t, gateway)
+	m.Version = 2
+	if err := SignManifest(gateway, nil, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(root.GetPublic()); err != nil {
+		t.Errorf("gateway version 2: %v", err)
+	}
+
+	//an admin member rotating it
+	admin := testKey(t)
+	if err := SignManifest(admin, testPresentation(t, root, admin, ROLE_ADMIN), m); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(root.GetPublic()); err != nil {
+		t.Errorf("admin version: %v", err)
+	}
+	if err := m.Verify(nil); err == nil {
+		t.Error("accepted an admin signature without membership checks")
+	}
+
+	//any other node
+	other := testKey(t)
+	for name, pres := range map[string]*MembershipPresentation{
+		"no certificate": nil,
+		"storage member": testPresentation(t, root, other, "storage"),
+		"other root":     testPresentation(t, testKey(t), other, ROLE_ADMIN),
+		"other peer":     testPresentation(t, root, admin, ROLE_ADMIN),
+	} {
+		if err := SignManifest(other, pres, m); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Verify(root.GetPublic()); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestManifestValidatorSelect(t *testing.T) {
+	gateway := testKey(t)
+	v := RecordValidator{}
+	key := "/ns/manifest/manifest-1"
+
+	m := signedTestManifest(t, gateway)
+	v1, _ := json.Marshal(m)
+	m.Version = 2
+	if err := SignManifest(gateway, nil, m); err != nil {
+		t.Fatal(err)
+	}
+	v2, _ := json.Marshal(m)
+
+	for _, value := range [][]byte{v1, v2} {
+		if err := v.Validate(key, value); err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+	}
+	if best, err := v.Select(key, [][]byte{v1, v2}); err != nil || best != 1 {
+		t.Errorf("Select = %d, %v", best, err)
+	}
+
+	//another record under the same key, with a higher version
+	hijacker := testKey(t)
+	hijack := signedTestManifest(t, hijacker)
+	hijack.Version = 99
+	if err := SignManifest(hijacker, nil, hijack); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(hijack)
+	if err := v.Validate(key, raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Select(key, [][]byte{raw, v2}); err == nil {
+		t.Error("selected a manifest of another record")
+	}
+
+	//the same gateway dropping the owner
+	m.Version, m.Owner, m.OwnerSignature = 3, "", nil
+	if err := SignManifest(gateway, nil, m); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = json.Marshal(m)
+	if err := v.Validate(key, raw); err == nil {
+		t.Error("accepted a manifest placed since consent without an owner")
+	}
+
+	//and passing the record off as one placed before consent
+	m.Format = MANIFEST_FORMAT_LEGACY
+	if err := SignManifest(gateway, nil, m); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = json.Marshal(m)
+	if err := v.Validate(key, raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Select(key, [][]byte{raw, v2}); err == nil {
+		t.Error("selected a manifest without the owner of the record")
+	}
+}
+
+func TestPlaceRecordOwner(t *testing.T) {
+	sm := &StreamsMaster{cfg: DefaultConfig()}
+	for name, payload := range map[string]string{
+		"not an upload":      `"raw"`,
+		"no owner":           `{"UID":"u","user_data":{}}`,
+		"no owner claim":     `{"UID":"u","user_data":{},"owner":"did:key:z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"}`,
+		"forged owner claim": `{"UID":"u","user_data":{},"owner":"did:key:z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK","owner_signature":"AAAA"}`,
+	} {
+		if _, err := sm.PlaceRecord(context.Background(), ManifestID("u"), 1, []byte(payload), nil, nil); err == nil {
+			t.Errorf("%s: new record placed", name)
+		}
+	}
+}
+
+// an in-process DHT server under namespace "ns", forgetting records after maxAge, connected to peers
+func testDHT(t *testing.T, maxAge time.Duration, peers ...*dht.IpfsDHT) *dht.IpfsDHT {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kadDHT, err := dht.New(context.Background(), h,
+		dht.Mode(dht.ModeServer),
+		dht.MaxRecordAge(maxAge),
+		dht.NamespacedValidator("ns", RecordValidator{}),
+		dht.ProtocolPrefix(protocol.ID("/ns")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		kadDHT.Close()
+		h.Close()
+	})
+
+	for _, other := range peers {
+		if err := h.Connect(context.Background(), peer.AddrInfo{ID: other.Host().ID(), Addrs: other.Host().Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//wait for the peers to make it into the routing table
+	for deadline := time.Now().Add(5 * time.Second); kadDHT.RoutingTable().Size() < len(peers); {
+		if time.Now().After(deadline) {
+			t.Fatal("peers never joined the routing table")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return kadDHT
+}
+
+func TestManifestRepublish(t *testing.T) {
+	const maxAge = 500 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	gateway := testDHT(t, maxAge)
+	holder := testDHT(t, maxAge, gateway)
+	gatewayKey := testKey(t)
+	m := signedTestManifest(t, gatewayKey)
+	if err := PublishManifest(ctx, gateway, "ns", m); err != nil {
+		t.Fatalf("PublishManifest: %v", err)
+	}
+	ours, _ := json.Marshal(m)
+
+	//a node joining after the records expired finds nothing
+	time.Sleep(2 * maxAge)
+	reader := testDHT(t, maxAge, gateway, holder)
+	if _, err := FetchManifest(ctx, reader, "ns", m.ID); err == nil {
+		t.Fatal("expired manifest still resolved")
+	}
+
+	//republished by the gateway, it resolves again
+	value, err := RepublishRecord(ctx, gateway, manifestKey("ns", m.ID), ours)
+	if err != nil || string(value) != string(ours) {
+		t.Fatalf("RepublishRecord = %s, %v", value, err)
+	}
+	got, err := FetchManifest(ctx, reader, "ns", m.ID)
+	if err != nil || got.Version != m.Version {
+		t.Fatalf("republished manifest: %+v, %v", got, err)
+	}
+
+	//a newer version published meanwhile is kept, not our old one
+	newer := *m
+	newer.Version = 2
+	if err := SignManifest(gatewayKey, nil, &newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishManifest(ctx, reader, "ns", &newer); err != nil {
+		t.Fatal(err)
+	}
+	value, err = RepublishRecord(ctx, gateway, manifestKey("ns", m.ID), ours)
+	kept := &Manifest{}
+	if err != nil || json.Unmarshal(value, kept) != nil || kept.Version != 2 {
+		t.Errorf("RepublishRecord over a newer version = %s, %v", value, err)
+	}
+}
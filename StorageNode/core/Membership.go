@@ -0,0 +1,533 @@
+/*
+# Membership.go
+
+Membership certificates and the connection gater that keeps non-members out.
+
+An admin root key (configured at init, in AdminRoot.pub) signs a certificate for every
+node allowed in the network: its peer ID, its role and an expiry. Each node keeps its
+own certificate in Membership.json.
+
+Peers are checked in the security handshake: a peer whose certificate we don't already
+hold is dropped there, before any protocol (identify and ping included) runs. Certificates
+can't travel in the handshake, so they come out of band: every node keeps the ones it knows
+in Members.json (add-member puts them there, e.g. the one printed by sign-membership), and
+members pass the certificates they know to each other through the membership protocol,
+so adding a new member to one node is enough for the others to learn about it.
+
+Certificates are public: holding one proves nothing, the handshake is what proves that the
+peer owns the peer ID it was issued for.
+
+A node that rotated its identity presents the certificate of its original peer ID along
+with the succession chain leading to its current one (see Succession.go).
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	MEMBERSHIP_PROTOCOL = "/membership/1.0.0"
+
+	// how long a certificate exchange may take
+	MEMBERSHIP_TIMEOUT = 5 * time.Second
+)
+
+// files holding the admin root public key, this node's own certificate and the ones of the members it knows
+var (
+	adminRootFile  = "AdminRoot.pub"
+	membershipFile = "Membership.json"
+	membersFile    = "Members.json"
+)
+
+type MembershipCert struct {
+	PeerID    string    `json:"peer_id"`
+	Role      string    `json:"role"` // e.g. "storage", "admin"
+	Expiry    time.Time `json:"expiry"`
+	Signature []byte    `json:"signature,omitempty"` // by the admin root key
+}
+
+// what a peer presents: its certificate, and the successions from the certificate's peer ID if it rotated its identity
+type MembershipPresentation struct {
+	MembershipCert
+	Succession []Succession `json:"succession,omitempty"`
+}
+
+// peer ID a presentation is for: the end of its succession chain, else the certificate's
+func (pres *MembershipPresentation) Holder() (peer.ID, error) {
+	id := pres.PeerID
+	if n := len(pres.Succession); n > 0 {
+		id = pres.Succession[n-1].New
+	}
+	return peer.Decode(id)
+}
+
+// Signs a membership certificate with the admin root key
+func SignMembership(root crypto.PrivKey, peerID peer.ID, role string, expiry time.Time) (*MembershipCert, error) {
+	cert := &MembershipCert{PeerID: peerID.String(), Role: role, Expiry: expiry.UTC()}
+
+	msg, err := canonicalJSON(cert)
+	if err != nil {
+		return nil, err
+	}
+	cert.Signature, err = root.Sign(msg)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Checks the certificate signature and expiry
+func (c *MembershipCert) Verify(root crypto.PubKey) error {
+	unsigned := *c
+	unsigned.Signature = nil
+
+	msg, err := canonicalJSON(unsigned)
+	if err != nil {
+		return err
+	}
+	if ok, err := root.Verify(msg, c.Signature); err != nil || !ok {
+		return errors.New("certificate not signed by the admin root key")
+	}
+	if time.Now().After(c.Expiry) {
+		return errors.New("certificate expired")
+	}
+	return nil
+}
+
+/*-------------------------- FILES -----------------------------------*/
+
+// Reads the admin root public key; nil (and no error) if it was not configured at init
+func ReadAdminRoot() (crypto.PubKey, error) {
+	data, err := os.ReadFile(HomePath(adminRootFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ParsePublicKey(strings.TrimSpace(string(data)))
+}
+
+// Writes the admin root public key (base64 of the marshalled libp2p key)
+func WriteAdminRoot(encoded string) error {
+	if _, err := ParsePublicKey(encoded); err != nil {
+		return fmt.Errorf("invalid admin root key: %v", err)
+	}
+	return os.WriteFile(HomePath(adminRootFile), []byte(strings.TrimSpace(encoded)+"\n"), 0644)
+}
+
+// Reads this node's own certificate; nil (and no error) if there is none yet
+func ReadMembership() (*MembershipCert, error) {
+	data, err := os.ReadFile(HomePath(membershipFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cert := &MembershipCert{}
+	if err := json.Unmarshal(data, cert); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", membershipFile, err)
+	}
+	return cert, nil
+}
+
+// Reads the certificates of the members this node knows; none (and no error) if there is no roster yet
+func ReadMembers() ([]MembershipPresentation, error) {
+	return readMembers(HomePath(membersFile))
+}
+
+func readMembers(file string) ([]MembershipPresentation, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var members []MembershipPresentation
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", file, err)
+	}
+	return members, nil
+}
+
+// Writes the certificates of the members this node knows
+func WriteMembers(members []MembershipPresentation) error {
+	return writeMembers(HomePath(membersFile), members)
+}
+
+func writeMembers(file string, members []MembershipPresentation) error {
+	data, err := json.MarshalIndent(members, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// base64 of a marshalled libp2p public key (the format of ID.json's public_key)
+func ParsePublicKey(encoded string) (crypto.PubKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPublicKey(raw)
+}
+
+/*-------------------------- GATER -----------------------------------*/
+
+/*
+Loads the admin root key and this node's own certificate into a new gater.
+
+Returns a nil gater (membership checks disabled) if no root key was configured at init.
+*/
+func LoadMemberGater(self peer.ID) (*MemberGater, error) {
+	root, err := ReadAdminRoot()
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %v", adminRootFile, err)
+	}
+	if root == nil {
+		fmt.Println("⚠️ No admin root key configured (init --admin-root), membership checks are disabled")
+		return nil, nil
+	}
+
+	own, err := ReadMembership()
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ReadSuccessionChain()
+	if err != nil {
+		return nil, err
+	}
+
+	var presentation *MembershipPresentation
+	if own == nil {
+		fmt.Printf("⚠️ No %s, other members will drop this node\n", membershipFile)
+	} else {
+		if own.PeerID != self.String() || len(chain) > 0 {
+			if err := VerifySuccessionChain(chain, own.PeerID, self); err != nil {
+				return nil, fmt.Errorf("%s belongs to %s, not to this node: %v", membershipFile, own.PeerID, err)
+			}
+		}
+		if err := own.Verify(root); err != nil {
+			return nil, fmt.Errorf("own membership certificate: %v", err)
+		}
+		presentation = &MembershipPresentation{MembershipCert: *own, Succession: chain}
+	}
+
+	gater := NewMemberGater(root, presentation)
+	gater.roster = HomePath(membersFile)
+	gater.reloadRoster()
+	return gater, nil
+}
+
+// Connection gater admitting only peers with a valid membership certificate
+type MemberGater struct {
+	root crypto.PubKey
+	own  *MembershipPresentation
+
+	mu      sync.RWMutex
+	members map[peer.ID]*MembershipPresentation
+
+	roster     string // Members.json, "" to keep members in memory only
+	rosterTime time.Time
+
+	h host.Host // set by Start
+}
+
+// Creates the gater from the admin root key and what this node presents
+func NewMemberGater(root crypto.PubKey, own *MembershipPresentation) *MemberGater {
+	return &MemberGater{
+		root:    root,
+		own:     own,
+		members: make(map[peer.ID]*MembershipPresentation),
+	}
+}
+
+// true if we hold a certificate of the peer that is still valid
+func (g *MemberGater) IsMember(p peer.ID) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	pres, ok := g.members[p]
+	return ok && time.Now().Before(pres.Expiry)
+}
+
+// role of a member, empty if the peer is not one
+func (g *MemberGater) Role(p peer.ID) string {
+	if !g.IsMember(p) {
+		return ""
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.members[p].Role
+}
+
+// Checks that a presentation proves p is a member: the certificate and the succession chain from its peer ID to p
+func (pres *MembershipPresentation) VerifyFor(root crypto.PubKey, p peer.ID) error {
+	if pres.PeerID != p.String() || len(pres.Succession) > 0 {
+		if err := VerifySuccessionChain(pres.Succession, pres.PeerID, p); err != nil {
+			return fmt.Errorf("certificate belongs to another peer: %v", err)
+		}
+	}
+	return pres.MembershipCert.Verify(root)
+}
+
+// checks a presented certificate (and succession chain) and records the peer as a member
+func (g *MemberGater) Admit(p peer.ID, pres *MembershipPresentation) error {
+	if err := pres.VerifyFor(g.root, p); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members[p] = pres
+	return nil
+}
+
+/*
+Admits the members in a list of certificates, ignoring the invalid ones, and saves the
+roster if any was new. Returns how many were new.
+*/
+func (g *MemberGater) Learn(members []MembershipPresentation) int {
+	learned := 0
+	for i := range members {
+		pres := members[i]
+		p, err := pres.Holder()
+		if err != nil || g.IsMember(p) && !g.renews(p, &pres) {
+			continue
+		}
+		if err := g.Admit(p, &pres); err != nil {
+			fmt.Printf("Ignoring the certificate of %s: %v\n", p, err)
+			continue
+		}
+		learned++
+	}
+
+	if learned > 0 && g.roster != "" {
+		if err := writeMembers(g.roster, g.Known()); err != nil {
+			fmt.Println("Error saving the members roster:", err)
+		} else if info, err := os.Stat(g.roster); err == nil {
+			g.mu.Lock()
+			g.rosterTime = info.ModTime()
+			g.mu.Unlock()
+		}
+	}
+	return learned
+}
+
+// true if pres lasts longer than the certificate we hold for p
+func (g *MemberGater) renews(p peer.ID, pres *MembershipPresentation) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return pres.Expiry.After(g.members[p].Expiry)
+}
+
+// the certificates of every member that are still valid
+func (g *MemberGater) Known() []MembershipPresentation {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var known []MembershipPresentation
+	for _, pres := range g.members {
+		if time.Now().Before(pres.Expiry) {
+			known = append(known, *pres)
+		}
+	}
+	return known
+}
+
+// learns the certificates in Members.json if it changed since it was last read (e.g. by add-member)
+func (g *MemberGater) reloadRoster() {
+	if g.roster == "" {
+		return
+	}
+	info, err := os.Stat(g.roster)
+	if err != nil {
+		return
+	}
+	g.mu.Lock()
+	changed := !info.ModTime().Equal(g.rosterTime)
+	g.rosterTime = info.ModTime()
+	g.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	members, err := readMembers(g.roster)
+	if err != nil {
+		fmt.Println("Error reading the members roster:", err)
+		return
+	}
+	g.Learn(members)
+}
+
+// true if p is a member, looking at the roster again when it isn't known yet
+func (g *MemberGater) admitted(p peer.ID) bool {
+	if g.IsMember(p) {
+		return true
+	}
+	g.reloadRoster()
+	return g.IsMember(p)
+}
+
+func (g *MemberGater) InterceptPeerDial(p peer.ID) bool {
+	return g.admitted(p)
+}
+
+func (g *MemberGater) InterceptAddrDial(p peer.ID, _ multiaddr.Multiaddr) bool {
+	return g.admitted(p)
+}
+
+func (g *MemberGater) InterceptAccept(_ network.ConnMultiaddrs) bool {
+	return true
+}
+
+// drops every peer we don't hold a valid certificate of at the handshake
+func (g *MemberGater) InterceptSecured(dir network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	if g.admitted(p) {
+		return true
+	}
+	if dir == network.DirInbound {
+		fmt.Println("⛔ Dropping non-member peer:", p)
+	}
+	return false
+}
+
+func (g *MemberGater) InterceptUpgraded(_ network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+/*-------------------------- PRESENTATION -----------------------------------*/
+
+/*
+Starts exchanging certificates: answers the membership protocol and, on every new
+connection, presents our own certificate along with the ones of the members we know.
+*/
+func (g *MemberGater) Start(h host.Host) {
+	g.h = h
+	h.SetStreamHandler(MEMBERSHIP_PROTOCOL, g.handler)
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			go g.present(c.RemotePeer())
+		},
+	})
+}
+
+// what goes over the membership protocol: a presentation and the certificates of the members the sender knows
+type MembershipHello struct {
+	MembershipPresentation
+	Members []MembershipPresentation `json:"members,omitempty"`
+}
+
+type MembershipReply struct {
+	Error   string                   `json:"error,omitempty"`
+	Members []MembershipPresentation `json:"members,omitempty"`
+}
+
+// handler for incoming certificate presentations
+func (g *MemberGater) handler(s network.Stream) {
+	defer s.Close()
+
+	hello := &MembershipHello{}
+	if err := readJSON(s, hello); err != nil {
+		if errors.Is(err, ErrTooLarge) {
+			writeJSON(s, MembershipReply{Error: REPLY_TOO_LARGE})
+			return
+		}
+		writeJSON(s, MembershipReply{Error: "invalid certificate"})
+		return
+	}
+	//renewed certificates and successions replace what we held
+	if err := g.Admit(s.Conn().RemotePeer(), &hello.MembershipPresentation); err != nil {
+		writeJSON(s, MembershipReply{Error: err.Error()})
+		return
+	}
+	writeJSON(s, MembershipReply{Members: g.Known()})
+	g.spread(g.Learn(hello.Members))
+}
+
+// presents our own certificate and the members we know to a peer
+func (g *MemberGater) present(p peer.ID) {
+	if g.own == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), MEMBERSHIP_TIMEOUT)
+	defer cancel()
+
+	s, err := g.h.NewStream(ctx, p, MEMBERSHIP_PROTOCOL)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+
+	reply := MembershipReply{}
+	if writeJSON(s, MembershipHello{MembershipPresentation: *g.own, Members: g.Known()}) != nil || readJSON(s, &reply) != nil {
+		return
+	}
+	if reply.Error != "" {
+		fmt.Printf("Peer %s rejected our membership certificate: %s\n", p, reply.Error)
+	}
+	g.spread(g.Learn(reply.Members))
+}
+
+// passes newly learned certificates on to the connected peers, so a new member is known everywhere
+func (g *MemberGater) spread(learned int) {
+	if learned == 0 || g.h == nil {
+		return
+	}
+	for _, p := range g.h.Network().Peers() {
+		go g.present(p)
+	}
+}
+
+// wraps a protocol handler so that streams from peers that are no longer members (e.g. their certificate expired) are reset
+func (g *MemberGater) Guard(id protocol.ID, handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		if !g.IsMember(s.Conn().RemotePeer()) {
+			fmt.Printf("Refused %s stream from non-member %s\n", id, s.Conn().RemotePeer())
+			s.Reset()
+			return
+		}
+		handler(s)
+	}
+}
+
+/*
+Wraps a host so that every stream handler set through it is guarded, meant for services
+that register their own handlers (the DHT).
+*/
+func (g *MemberGater) GateHost(h host.Host) host.Host {
+	return &gatedHost{Host: h, gater: g}
+}
+
+type gatedHost struct {
+	host.Host
+	gater *MemberGater
+}
+
+func (h *gatedHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, h.gater.Guard(pid, handler))
+}
+
+func (h *gatedHost) SetStreamHandlerMatch(pid protocol.ID, match func(protocol.ID) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, match, h.gater.Guard(pid, handler))
+}
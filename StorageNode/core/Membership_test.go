@@ -0,0 +1,81 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestMemberGaterHandshake(t *testing.T) {
+	root, member := testKey(t), testKey(t)
+	memberID, _ := peer.IDFromPrivateKey(member)
+	g := NewMemberGater(root.GetPublic(), nil)
+
+	for _, dir := range []network.Direction{network.DirInbound, network.DirOutbound} {
+		if g.InterceptSecured(dir, memberID, nil) {
+			t.Errorf("%s: let in a peer without a certificate", dir)
+		}
+	}
+
+	g.Learn([]MembershipPresentation{*testPresentation(t, root, member, ROLE_STORAGE)})
+	if !g.InterceptSecured(network.DirInbound, memberID, nil) || g.Role(memberID) != ROLE_STORAGE {
+		t.Error("member refused at the handshake")
+	}
+	if g.InterceptSecured(network.DirInbound, testPeerID(t), nil) {
+		t.Error("let in a non-member")
+	}
+}
+
+func TestMemberGaterLearn(t *testing.T) {
+	root := testKey(t)
+	g := NewMemberGater(root.GetPublic(), nil)
+
+	cert, err := SignMembership(root, testPeerID(t), ROLE_STORAGE, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	learned := g.Learn([]MembershipPresentation{
+		*testPresentation(t, root, testKey(t), ROLE_STORAGE),
+		*testPresentation(t, testKey(t), testKey(t), ROLE_STORAGE), //other root
+		{MembershipCert: *cert},                                    //expired
+	})
+	if learned != 1 || len(g.Known()) != 1 {
+		t.Errorf("learned %d, knows %d", learned, len(g.Known()))
+	}
+	if again := g.Learn(g.Known()); again != 0 {
+		t.Errorf("learned %d known members again", again)
+	}
+}
+
+func TestMemberGaterRoster(t *testing.T) {
+	root, member := testKey(t), testKey(t)
+	memberID, _ := peer.IDFromPrivateKey(member)
+
+	g := NewMemberGater(root.GetPublic(), nil)
+	g.roster = filepath.Join(t.TempDir(), membersFile)
+	if g.InterceptSecured(network.DirInbound, memberID, nil) {
+		t.Fatal("let in a peer without a certificate")
+	}
+
+	//add-member while the node runs
+	if err := writeMembers(g.roster, []MembershipPresentation{*testPresentation(t, root, member, ROLE_STORAGE)}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(g.roster, later, later)
+	if !g.InterceptSecured(network.DirInbound, memberID, nil) {
+		t.Fatal("member added to the roster refused")
+	}
+
+	//learned members are saved for the next start
+	g.Learn([]MembershipPresentation{*testPresentation(t, root, testKey(t), ROLE_STORAGE)})
+	saved, err := readMembers(g.roster)
+	if err != nil || len(saved) != 2 {
+		t.Errorf("roster holds %d members, %v", len(saved), err)
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/json"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -44,3 +45,62 @@ type SimpleData struct {
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
 }
+
+// UploadPayload is what the admin node sends through the upload protocol.
+type UploadPayload struct {
+	UID      string          `json:"UID"`             // user identifier
+	UserData json.RawMessage `json:"user_data"`       // user information, stored encrypted
+	MPC      bool            `json:"mpc"`             // also secret-share single attributes for MPC evaluation
+	Owner    string          `json:"owner,omitempty"` // did:key of the user, required to sign consent tokens
+	ACL      *ACL            `json:"acl,omitempty"`   // first access control list, signed by the owner
+	// owner claim on the record (see SignOwnerClaim), required with an owner
+	OwnerSignature []byte `json:"owner_signature,omitempty"`
+}
+
+// RotationState tracks a key rotation in progress, so it can be resumed if interrupted.
+// It never holds key material: only public manifests and where pieces were sent.
+type RotationState struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	ManifestID string             `bson:"manifest_id" json:"manifest_id"`
+	Step       string             `bson:"step" json:"step"`           // last completed step, see Rotation.go
+	Old        Manifest           `bson:"old" json:"old"`             // manifest being replaced
+	New        *Manifest          `bson:"new" json:"new"`             // replacement manifest, once fully placed
+	Pending    []Placement        `bson:"pending" json:"pending"`     // pieces sent (or being sent) for the replacement
+	Leftovers  []Placement        `bson:"leftovers" json:"leftovers"` // pieces of interrupted attempts still to be erased
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// a DHT record this node keeps published (see RepublishRecords)
+type PublishedRecord struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Key       string             `bson:"key" json:"key"`
+	Value     []byte             `bson:"value" json:"value"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// UserInfo is the identity data a user uploads (same shape as the web portal's UserInfo).
+type UserInfo struct {
+	Name    string `json:"Name"`
+	Gender  string `json:"Gender"`
+	DOB     DOB    `json:"DOB"`
+	Address string `json:"Address"`
+}
+
+type DOB struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Day   int `json:"day"`
+}
+
+// Rule is one condition of a provider's criteria, e.g. {"Field": "DOB.year", "Type": "less", "value": 2007}.
+type Rule struct {
+	Field string      `json:"Field"`
+	Type  string      `json:"Type"` // "equal", "greater", "less" or "in"
+	Value interface{} `json:"value"`
+}
+
+// Criteria is what a provider asks to verify about a user: every rule in All and at least one in Any.
+type Criteria struct {
+	All []Rule `json:"All"`
+	Any []Rule `json:"Any"`
+}
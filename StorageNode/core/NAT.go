@@ -0,0 +1,116 @@
+/*
+# NAT.go
+
+NAT traversal, for nodes behind home and office routers. Everything is off unless the
+network.nat section of config.yaml turns it on:
+
+	autonat        -> find out whether we are reachable (AutoNAT v2), and answer the probes of others
+	port_mapping   -> ask the router for a port mapping (UPnP / NAT-PMP)
+	relay_client   -> when unreachable, reserve a slot on one of the relays and announce
+	                  the /p2p-circuit address
+	relay_service  -> act as a circuit relay v2 for other nodes (designated, reachable nodes;
+	                  always on for the relay role)
+	hole_punching  -> upgrade relayed connections to direct ones (DCUtR)
+	relays         -> relay multiaddrs (with /p2p/<peer ID>) used by relay_client
+
+The reachability found by AutoNAT is shown in the node status line (see Connections.go).
+*/
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+type NATConfig struct {
+	AutoNAT      bool     `yaml:"autonat"`
+	PortMapping  bool     `yaml:"port_mapping"`
+	RelayClient  bool     `yaml:"relay_client"`
+	RelayService bool     `yaml:"relay_service"`
+	HolePunching bool     `yaml:"hole_punching"`
+	Relays       []string `yaml:"relays"`
+}
+
+// libp2p options for the NAT traversal features turned on in the config
+func NATOptions(cfg NATConfig) ([]libp2p.Option, error) {
+	var opts []libp2p.Option
+	if cfg.AutoNAT {
+		opts = append(opts, libp2p.EnableNATService(), libp2p.EnableAutoNATv2())
+	}
+	if cfg.PortMapping {
+		opts = append(opts, libp2p.NATPortMap())
+	}
+	if cfg.RelayClient {
+		relays, err := relayInfos(cfg.Relays)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, libp2p.EnableRelay(), libp2p.EnableAutoRelayWithStaticRelays(relays))
+	}
+	if cfg.RelayService {
+		opts = append(opts, libp2p.EnableRelay(), libp2p.EnableRelayService())
+	}
+	if cfg.HolePunching {
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+	return opts, nil
+}
+
+// parses relay multiaddrs, merging the addresses of the same relay
+func relayInfos(addrs []string) ([]peer.AddrInfo, error) {
+	var maddrs []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay address %s: %v", addr, err)
+		}
+		maddrs = append(maddrs, ma)
+	}
+	return peer.AddrInfosFromP2pAddrs(maddrs...)
+}
+
+// true for relayed (/p2p-circuit) addresses
+func isCircuitAddr(addr multiaddr.Multiaddr) bool {
+	return strings.Contains(addr.String(), "/p2p-circuit")
+}
+
+/*-------------------------- REACHABILITY -----------------------------------*/
+
+// last reachability reported by AutoNAT
+var reachability atomic.Value
+
+// Follows the reachability changes of the host, printing them with our current addresses
+func WatchReachability(h host.Host) {
+	reachability.Store(network.ReachabilityUnknown)
+
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		fmt.Println("Error watching reachability:", err)
+		return
+	}
+	go func() {
+		defer sub.Close()
+		for e := range sub.Out() {
+			r := e.(event.EvtLocalReachabilityChanged).Reachability
+			reachability.Store(r)
+			fmt.Printf("\n📡 Reachability: %s, addresses: %v\n", r, h.Addrs())
+		}
+	}()
+}
+
+// reachability for the status line: Unknown, Public or Private
+func Reachability() string {
+	if r, ok := reachability.Load().(network.Reachability); ok {
+		return r.String()
+	}
+	return network.ReachabilityUnknown.String()
+}
@@ -20,69 +20,97 @@ import (
 
 	// "github.com/libp2p/go-libp2p-record"
 
-	tls "github.com/libp2p/go-libp2p/p2p/security/tls"
-	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
-	tcp "github.com/libp2p/go-libp2p/p2p/transport/tcp"
-
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 	"github.com/multiformats/go-multiaddr"
 )
 
 // Starts the p2p node listening in the passed address and creates a new custom namespace
-func NodeCreate(priv crypto.PrivKey, custom_namespace string) (context.Context, host.Host, *dht.IpfsDHT, []string) {
-	//create context
-	ctx := context.Background()
+//
+// Everything started in the background stops with ctx.
+// If gater is not nil, only peers with a valid membership certificate are let in.
+// The mDNS service is nil unless network.mdns is on, it is closed on shutdown (see CloseOnShutdown).
+func NodeCreate(ctx context.Context, priv crypto.PrivKey, cfg *Config, gater *MemberGater) (context.Context, host.Host, *dht.IpfsDHT, *AddressBook, mdns.Service) {
+	custom_namespace := cfg.Network.Namespace
 
 	//Get priv key from ID file (specifically, from node's private key)
 	// priv := readPrivateKeyFromFile("ID.json")
 
-	//Start new node host, specifying constant ID and listening address
-	h, err := libp2p.New(
-		libp2p.Identity(priv),
-		libp2p.ListenAddrStrings("/ip4/127.0.0.1/udp/4001/quic-v1"),
-		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/4001"),
-		//quic transpot, with tcp+tls as a fallback
-		libp2p.Transport(quic.NewTransport),
-		libp2p.Transport(tcp.NewTCPTransport),
-		libp2p.Security(tls.ID, tls.New),
-	)
+	//Start new node host, specifying constant ID and listening address (private network if there is a swarm key)
+	transports, err := TransportOptions(cfg.Network.Listen)
+	if err != nil {
+		panic(err)
+	}
+	limits, err := ResourceManagerOption()
+	if err != nil {
+		panic(err)
+	}
+	opts := append([]libp2p.Option{libp2p.Identity(priv), limits}, transports...)
+	if gater != nil {
+		opts = append(opts, libp2p.ConnectionGater(gater))
+	}
+	if announce := announceAddrs(cfg.Network.Announce); announce != nil {
+		//relayed addresses still have to be announced
+		opts = append(opts, libp2p.AddrsFactory(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			out := append([]multiaddr.Multiaddr{}, announce...)
+			for _, addr := range addrs {
+				if isCircuitAddr(addr) {
+					out = append(out, addr)
+				}
+			}
+			return out
+		}))
+	}
+	connections, err := ConnManagerOption(cfg.Network.Connections)
 	if err != nil {
 		panic(err)
 	}
+	opts = append(opts, connections)
+	nat, err := NATOptions(cfg.NATSettings())
+	if err != nil {
+		panic(err)
+	}
+	opts = append(opts, nat...)
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		panic(err)
+	}
+	WatchReachability(h)
+
+	//find nodes on the local network
+	var local mdns.Service
+	if cfg.Network.MDNS {
+		if local, err = StartMDNS(ctx, h, custom_namespace); err != nil {
+			fmt.Println("Error starting mDNS discovery:", err)
+		}
+	}
+
+	//exchange membership certificates before anything else happens
+	if gater != nil {
+		gater.Start(h)
+	}
 
-	//get bootstrap peers from file
-	bootstrapPeers := ReadBootstrapPeers()
+	//known peers, with Bootstrap.txt merged in
+	book := OpenAddressBook(h.ID())
 
-	//create DHT
+	//create DHT, only serving members (and taking manifests signed by admins) when membership checks are on
+	dhtHost := h
+	validator := RecordValidator{Pins: OpenSuccessionPins()}
+	if gater != nil {
+		dhtHost = gater.GateHost(h)
+		validator.Root = gater.root
+	}
 	kadDHT, err := dht.New(
 		ctx,
-		h,
+		dhtHost,
 		//IMPORTANT! Use ModeAutoServer. Will function as Server by defaul, allowing to receive and send requests/responses
 		dht.Mode(dht.ModeAutoServer),
 		//Bootstrap know nodes in DHT
-		dht.BootstrapPeers(func() []peer.AddrInfo {
-			var bootstrap_addresses []peer.AddrInfo
-
-			for p := range bootstrapPeers {
-				ma, err := multiaddr.NewMultiaddr(bootstrapPeers[p])
-				if err != nil {
-					panic(err)
-				}
-
-				pi, err := peer.AddrInfoFromP2pAddr(ma)
-				if err != nil {
-					panic(err)
-				}
-				bootstrap_addresses = append(bootstrap_addresses, *pi)
-			}
-
-			return bootstrap_addresses
-		}()...),
+		dht.BootstrapPeers(book.Peers()...),
 		//Pass custom validator for custom prefix
-		dht.NamespacedValidator(custom_namespace, LazyValidator{}),
+		dht.NamespacedValidator(custom_namespace, validator),
 		//Establish protocol prefix
 		dht.ProtocolPrefix(protocol.ID(fmt.Sprintf("/%s", custom_namespace))),
 	)
@@ -93,11 +121,23 @@ func NodeCreate(priv crypto.PrivKey, custom_namespace string) (context.Context,
 	fmt.Println("✅ Node ID:", h.ID())
 	fmt.Println("🌐 Listening on:", h.Addrs())
 
-	//add self to bootstrap list
-	if len(h.Addrs()) > 0 {
-		selfAddr := fmt.Sprintf("%s/p2p/%s", h.Addrs()[0].String(), h.ID().String())
-		AddPeerToBootstrap(selfAddr)
+	//export the book and our addresses to Bootstrap.txt
+	if err := book.Save(h.Addrs(), true); err != nil {
+		fmt.Println("Error saving address book:", err)
 	}
 
-	return ctx, h, kadDHT, bootstrapPeers
+	return ctx, h, kadDHT, book, local
+}
+
+// parsed announce addresses, nil to advertise the listen ones
+func announceAddrs(addrs []string) []multiaddr.Multiaddr {
+	var announce []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid announce address %s: %v", addr, err))
+		}
+		announce = append(announce, ma)
+	}
+	return announce
 }
@@ -0,0 +1,442 @@
+/*
+# Roles.go
+
+Node roles and their advertisement.
+
+A node serves the roles listed in config.yaml, and only registers the protocols of those
+roles (plus print):
+
+	storage   -> holds data: store, retrieve, delete, and answers decrypt and MPC requests
+	             for the fragments and shares it holds
+	gateway   -> takes uploads and places the pieces on storage nodes
+	verifier  -> trusted to rebuild records: verify and credential
+	relay     -> circuit relay v2 for nodes behind NATs (see NAT.go), no protocols of its own
+
+The admin node has the admin role, which no storage node declares.
+
+Every node publishes a role record in the DHT record store, under the node's custom namespace:
+	/
+	├── <namespace>/
+	│     ├── roles/
+	│     │     ├── <peer ID> : role record json
+
+The record holds the peer ID, a timestamp and a body listing its roles, addresses and
+capabilities (free disk space, the protocols it answers with their versions, its region),
+signed with the peer key over
+
+	dsn-roles/1\n<peer ID>\n<timestamp>\n<body json>
+
+RecordValidator only takes records signed by the key of their peer ID and younger than
+ROLE_RECORD_TTL, so nodes republish theirs every ROLE_REPUBLISH, and look up the record
+of every peer they get connected to. A record claiming the admin role must carry an
+admin membership certificate of its peer, signed by the admin root key: with membership
+checks off there is no root, and nobody can claim it.
+
+Admins (discovered or in config.yaml) are never picked to store data, and pieces go to
+storage nodes with room for them.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	ROLE_STORAGE  = "storage"
+	ROLE_GATEWAY  = "gateway"
+	ROLE_VERIFIER = "verifier"
+	ROLE_RELAY    = "relay"
+	ROLE_ADMIN    = "admin"
+
+	// how long a role record is believed after it was signed
+	ROLE_RECORD_TTL = time.Hour
+
+	// how often our record is published again, and the ones we know looked up again
+	ROLE_REPUBLISH = ROLE_RECORD_TTL / 4
+
+	// time between retries while our record is not published or a peer's not found
+	ROLE_RETRY = time.Minute
+)
+
+// roles a node can declare in config.yaml
+var NODE_ROLES = []string{ROLE_STORAGE, ROLE_GATEWAY, ROLE_VERIFIER, ROLE_RELAY}
+
+// protocols served by each role
+func roleProtocols(role string) []Protocol {
+	switch role {
+	case ROLE_STORAGE:
+		return []Protocol{&StoreProtocol{}, &DecryptProtocol{}, &RetrieveProtocol{}, &DeleteProtocol{}, &MPCProtocol{}}
+	case ROLE_GATEWAY:
+		return []Protocol{&UploadProtocol{}}
+	case ROLE_VERIFIER:
+		return []Protocol{&CredentialProtocol{}, &VerifyProtocol{}}
+	}
+	return nil
+}
+
+// print and the protocols of the roles
+func ProtocolsFor(roles []string) []Protocol {
+	protocols := []Protocol{&PrintProtocol{}}
+	for _, role := range roles {
+		protocols = append(protocols, roleProtocols(role)...)
+	}
+	return protocols
+}
+
+// what a node advertises about itself
+type RoleInfo struct {
+	Roles        []string     `json:"roles"`
+	Addrs        []string     `json:"addrs"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+type Capabilities struct {
+	FreeSpace uint64   `json:"free_space"` // bytes, 0 if unknown
+	Protocols []string `json:"protocols"`  // protocol IDs it answers, with their versions
+	Region    string   `json:"region,omitempty"`
+}
+
+// true if the capabilities fit a piece of size bytes sent over proto
+func (c Capabilities) fits(proto string, size uint64) bool {
+	if c.FreeSpace != 0 && c.FreeSpace < size {
+		return false
+	}
+	return proto == "" || contains(c.Protocols, proto)
+}
+
+type RoleRecord struct {
+	PeerID    string                  `json:"peer_id"`
+	Timestamp int64                   `json:"timestamp"` // unix milliseconds
+	Body      json.RawMessage         `json:"body"`      // RoleInfo, signed verbatim
+	Signature []byte                  `json:"signature"`
+	Cert      *MembershipPresentation `json:"cert,omitempty"` // admin certificate, for the admin role
+}
+
+// Signs a role record for the key owner
+func SignRoleRecord(priv crypto.PrivKey, info RoleInfo) (*RoleRecord, error) {
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &RoleRecord{PeerID: id.String(), Timestamp: time.Now().UnixMilli(), Body: body}
+	rec.Signature, err = priv.Sign(rec.signingBytes())
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+/*
+Checks the signature (with the key of the record's peer ID), the age of the record and,
+when it claims the admin role, its admin certificate under root. Returns the peer and its
+advertised info.
+*/
+func (r *RoleRecord) Verify(root crypto.PubKey) (peer.ID, *RoleInfo, error) {
+	id, err := peer.Decode(r.PeerID)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid peer ID: %v", err)
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return "", nil, fmt.Errorf("peer key: %v", err)
+	}
+	if ok, err := pub.Verify(r.signingBytes(), r.Signature); err != nil || !ok {
+		return "", nil, errors.New("bad role record signature")
+	}
+
+	signed := time.UnixMilli(r.Timestamp)
+	if d := time.Since(signed); d > ROLE_RECORD_TTL || d < -ENVELOPE_WINDOW {
+		return "", nil, errors.New("stale role record")
+	}
+
+	info := &RoleInfo{}
+	if err := json.Unmarshal(r.Body, info); err != nil {
+		return "", nil, fmt.Errorf("invalid role record: %v", err)
+	}
+
+	if hasRole(info.Roles, ROLE_ADMIN) {
+		switch {
+		case root == nil:
+			return "", nil, errors.New("admin role claimed without membership checks")
+		case r.Cert == nil || r.Cert.Role != ROLE_ADMIN:
+			return "", nil, errors.New("admin role claimed without an admin certificate")
+		}
+		if err := r.Cert.VerifyFor(root, id); err != nil {
+			return "", nil, fmt.Errorf("admin certificate: %v", err)
+		}
+	}
+	return id, info, nil
+}
+
+func (r *RoleRecord) signingBytes() []byte {
+	header := fmt.Sprintf("dsn-roles/1\n%s\n%d\n", r.PeerID, r.Timestamp)
+	return append([]byte(header), r.Body...)
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+/*-------------------------- DHT RECORDS -----------------------------------*/
+
+func roleKey(namespace string, id peer.ID) string {
+	return fmt.Sprintf("/%s/roles/%s", namespace, id)
+}
+
+// Puts a signed role record in the DHT record store
+func PublishRoleRecord(ctx context.Context, kadDHT *dht.IpfsDHT, namespace string, rec *RoleRecord) error {
+	id, err := peer.Decode(rec.PeerID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return kadDHT.PutValue(ctx, roleKey(namespace, id), data)
+}
+
+// Gets the role record of a peer, nil (and no error) if there is none
+func FetchRoleRecord(ctx context.Context, kadDHT *dht.IpfsDHT, namespace string, id peer.ID) (*RoleRecord, error) {
+	data, err := kadDHT.GetValue(ctx, roleKey(namespace, id))
+	if err != nil {
+		return nil, nil
+	}
+	rec := &RoleRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("invalid role record for %s: %v", id, err)
+	}
+	return rec, nil
+}
+
+/*-------------------------- ROLE BOOK -----------------------------------*/
+
+// Roles of the peers we found a record for
+type RoleBook struct {
+	ctx       context.Context // stops the republishing
+	h         host.Host
+	dht       *dht.IpfsDHT
+	namespace string
+	priv      crypto.PrivKey
+	self      func() RoleInfo // what we advertise, the addresses are filled in
+	root      crypto.PubKey   // admin root key, nil when membership checks are off
+	lookup    time.Duration   // timeout of one DHT operation
+
+	mu      sync.RWMutex
+	records map[peer.ID]*RoleRecord
+	infos   map[peer.ID]*RoleInfo
+}
+
+/*
+Starts advertising our roles: publishes our record now and every ROLE_REPUBLISH, and
+looks up the record of every peer we get connected to (including the ones already
+connected), again when it gets old. Stops with ctx.
+*/
+func StartRoles(ctx context.Context, h host.Host, kadDHT *dht.IpfsDHT, namespace string, self func() RoleInfo, gater *MemberGater, lookup time.Duration) *RoleBook {
+	b := &RoleBook{
+		ctx:       ctx,
+		h:         h,
+		dht:       kadDHT,
+		namespace: namespace,
+		priv:      h.Peerstore().PrivKey(h.ID()),
+		self:      self,
+		lookup:    lookup,
+		records:   make(map[peer.ID]*RoleRecord),
+		infos:     make(map[peer.ID]*RoleInfo),
+	}
+	if gater != nil {
+		b.root = gater.root
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if b.ctx.Err() == nil {
+				go b.refresh(c.RemotePeer())
+			}
+		},
+	})
+	go b.run()
+	return b
+}
+
+// publishes our record and refreshes the ones of our peers until b.ctx is done
+func (b *RoleBook) run() {
+	ticker := time.NewTicker(ROLE_RETRY)
+	defer ticker.Stop()
+	var published time.Time
+	for {
+		if time.Since(published) >= ROLE_REPUBLISH {
+			if err := b.publish(); err != nil {
+				fmt.Println("Error publishing our role record:", err)
+			} else {
+				published = time.Now()
+			}
+		}
+		for _, p := range b.h.Network().Peers() {
+			if b.age(p) >= ROLE_REPUBLISH {
+				b.refresh(p)
+			}
+		}
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// our own record, signed now with our current addresses, put in the DHT
+func (b *RoleBook) publish() error {
+	info := b.self()
+	info.Addrs = nil
+	for _, a := range b.h.Addrs() {
+		info.Addrs = append(info.Addrs, a.String())
+	}
+	rec, err := SignRoleRecord(b.priv, info)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, b.lookup)
+	defer cancel()
+	return PublishRoleRecord(ctx, b.dht, b.namespace, rec)
+}
+
+// how long ago the record we hold for p was signed, ROLE_RECORD_TTL if we have none
+func (b *RoleBook) age(p peer.ID) time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	rec, ok := b.records[p]
+	if !ok {
+		return ROLE_RECORD_TTL
+	}
+	return time.Since(time.UnixMilli(rec.Timestamp))
+}
+
+// looks up the record of p and remembers it
+func (b *RoleBook) refresh(p peer.ID) {
+	ctx, cancel := context.WithTimeout(b.ctx, b.lookup)
+	defer cancel()
+
+	rec, err := FetchRoleRecord(ctx, b.dht, b.namespace, p)
+	if err != nil || rec == nil {
+		return
+	}
+	if err := b.learn(p, rec); err != nil {
+		fmt.Printf("Invalid role record for %s: %v\n", p, err)
+		return
+	}
+	if b.HasRole(p, ROLE_ADMIN) {
+		fmt.Println("🛡️  Admin node:", p)
+	}
+}
+
+// checks the record found for p (the DHT validator does too) and remembers it
+func (b *RoleBook) learn(p peer.ID, rec *RoleRecord) error {
+	id, info, err := rec.Verify(b.root)
+	if err != nil {
+		return err
+	}
+	if id != p {
+		return errors.New("role record of another peer")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.records[id]; ok && old.Timestamp >= rec.Timestamp {
+		return nil
+	}
+	b.records[id] = rec
+	b.infos[id] = info
+	return nil
+}
+
+// true when the record of p (still fresh) advertises role
+func (b *RoleBook) HasRole(p peer.ID, role string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	info, ok := b.infos[p]
+	if !ok || time.Since(time.UnixMilli(b.records[p].Timestamp)) > ROLE_RECORD_TTL {
+		return false
+	}
+	return hasRole(info.Roles, role)
+}
+
+// admins among the peers we know the role of
+func (b *RoleBook) Admins() map[peer.ID]bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	admins := make(map[peer.ID]bool)
+	for p, info := range b.infos {
+		if hasRole(info.Roles, ROLE_ADMIN) {
+			admins[p] = true
+		}
+	}
+	return admins
+}
+
+// peers whose record advertises other roles only, never picked for role
+func (b *RoleBook) Lacking(role string) map[peer.ID]bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	lacking := make(map[peer.ID]bool)
+	for p, info := range b.infos {
+		if !hasRole(info.Roles, role) {
+			lacking[p] = true
+		}
+	}
+	return lacking
+}
+
+/*
+Picks a connected peer with role whose capabilities fit size bytes over proto, skipping
+exclude. Peers in region are preferred when there is one. Returns "" if none fits.
+*/
+func (b *RoleBook) Pick(role string, proto string, size uint64, region string, exclude map[peer.ID]bool) peer.ID {
+	b.mu.RLock()
+	var fit, near []peer.ID
+	for p, info := range b.infos {
+		if exclude[p] || !hasRole(info.Roles, role) || !info.Capabilities.fits(proto, size) ||
+			time.Since(time.UnixMilli(b.records[p].Timestamp)) > ROLE_RECORD_TTL ||
+			b.h.Network().Connectedness(p) != network.Connected {
+			continue
+		}
+		fit = append(fit, p)
+		if region != "" && info.Capabilities.Region == region {
+			near = append(near, p)
+		}
+	}
+	b.mu.RUnlock()
+
+	if len(near) > 0 {
+		fit = near
+	}
+	if len(fit) == 0 {
+		return ""
+	}
+	return fit[rand.Intn(len(fit))]
+}
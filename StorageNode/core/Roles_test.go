@@ -0,0 +1,103 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// a role record of priv advertising roles, with cert attached
+func testRoleRecord(t *testing.T, priv crypto.PrivKey, cert *MembershipPresentation, roles ...string) *RoleRecord {
+	t.Helper()
+	rec, err := SignRoleRecord(priv, RoleInfo{Roles: roles})
+	if err != nil {
+		t.Fatalf("SignRoleRecord: %v", err)
+	}
+	rec.Cert = cert
+	return rec
+}
+
+func TestRoleRecordSignature(t *testing.T) {
+	priv := testKey(t)
+	id, info, err := testRoleRecord(t, priv, nil, ROLE_STORAGE).Verify(nil)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if want, _ := peer.IDFromPrivateKey(priv); id != want || !hasRole(info.Roles, ROLE_STORAGE) {
+		t.Errorf("Verify = %s %+v", id, info)
+	}
+
+	cases := map[string]func(rec *RoleRecord){
+		"body":      func(rec *RoleRecord) { rec.Body = json.RawMessage(`{"roles":["gateway"]}`) },
+		"peer":      func(rec *RoleRecord) { rec.PeerID = testPeerID(t).String() },
+		"timestamp": func(rec *RoleRecord) { rec.Timestamp++ },
+		"stale":     func(rec *RoleRecord) { rec.Timestamp = time.Now().Add(-2 * ROLE_RECORD_TTL).UnixMilli() },
+	}
+	for name, tamper := range cases {
+		rec := testRoleRecord(t, priv, nil, ROLE_STORAGE)
+		tamper(rec)
+		if _, _, err := rec.Verify(nil); err == nil {
+			t.Errorf("%s: tampered role record verified", name)
+		}
+	}
+}
+
+func TestRoleRecordAdmin(t *testing.T) {
+	root, admin := testKey(t), testKey(t)
+	cert := testPresentation(t, root, admin, ROLE_ADMIN)
+
+	if _, _, err := testRoleRecord(t, admin, cert, ROLE_ADMIN).Verify(root.GetPublic()); err != nil {
+		t.Fatalf("admin with its certificate: %v", err)
+	}
+	if _, _, err := testRoleRecord(t, admin, cert, ROLE_ADMIN).Verify(nil); err == nil {
+		t.Error("admin believed without membership checks")
+	}
+
+	for name, pres := range map[string]*MembershipPresentation{
+		"no certificate":   nil,
+		"storage member":   testPresentation(t, root, admin, ROLE_STORAGE),
+		"other root":       testPresentation(t, testKey(t), admin, ROLE_ADMIN),
+		"other peer's one": testPresentation(t, root, testKey(t), ROLE_ADMIN),
+	} {
+		if _, _, err := testRoleRecord(t, admin, pres, ROLE_ADMIN).Verify(root.GetPublic()); err == nil {
+			t.Errorf("%s: admin role believed", name)
+		}
+	}
+}
+
+func TestRoleRecordValidator(t *testing.T) {
+	priv := testKey(t)
+	id, _ := peer.IDFromPrivateKey(priv)
+	key := roleKey("ns", id)
+	v := RecordValidator{}
+
+	older := testRoleRecord(t, priv, nil, ROLE_STORAGE)
+	older.Timestamp -= 1000
+	older.Signature, _ = priv.Sign(older.signingBytes())
+	olderRaw, _ := json.Marshal(older)
+	newerRaw, _ := json.Marshal(testRoleRecord(t, priv, nil, ROLE_STORAGE, ROLE_GATEWAY))
+
+	for _, value := range [][]byte{olderRaw, newerRaw} {
+		if err := v.Validate(key, value); err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+	}
+	if best, err := v.Select(key, [][]byte{olderRaw, newerRaw}); err != nil || best != 1 {
+		t.Errorf("Select = %d, %v", best, err)
+	}
+
+	//a valid record of another peer, under our key
+	otherRaw, _ := json.Marshal(testRoleRecord(t, testKey(t), nil, ROLE_STORAGE))
+	if err := v.Validate(key, otherRaw); err == nil {
+		t.Error("accepted the role record of another peer")
+	}
+
+	//admin claims without membership checks
+	adminRaw, _ := json.Marshal(testRoleRecord(t, priv, nil, ROLE_ADMIN))
+	if err := v.Validate(key, adminRaw); err == nil {
+		t.Error("accepted an admin claim without a root")
+	}
+}
@@ -0,0 +1,256 @@
+/*
+# Rotation.go
+
+Key rotation for stored identity records.
+
+Rotating a manifest decrypts the record, encrypts it again under a fresh AES key,
+wraps that key under a fresh threshold key placed on new peers, erases the old data
+block and fragments and finally signs (see SignManifest) and publishes the new manifest
+version.
+
+The old pieces are erased while the old manifest is still the published one: holders
+only erase pieces that belong to the record they are asked about (see authorizeHolder).
+
+Progress is saved in the "rotations" collection after every step, so an interrupted
+rotation picks up where it stopped:
+
+	prepared  -> old manifest saved, pieces of the replacement are tracked in Pending
+	placed    -> replacement fully stored, its manifest saved (not yet published)
+	erased    -> old pieces erased, replacement manifest still to be published
+
+Key material is never saved: if the node dies before "placed", the pending pieces
+are erased and the record is placed again from scratch. A piece is added to Pending
+before it is sent, erasing one that never arrived is harmless. Pieces that could not
+be erased are kept in Leftovers and the rotation is not done until they are gone
+(fragment hashes repeat across attempts, so leftovers that the replacement placed
+again on the same peer are kept).
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// rotation steps
+const (
+	ROTATION_PREPARED = "prepared"
+	ROTATION_PLACED   = "placed"
+	ROTATION_ERASED   = "erased"
+)
+
+// where rotations are saved, implemented by Database
+type rotationStore interface {
+	RetrieveRotation(manifestID string) (*RotationState, error)
+	SaveRotation(state RotationState) error
+	DeleteRotation(manifestID string) error
+}
+
+// what a rotation does on the network, implemented by StreamsMaster
+type rotationNetwork interface {
+	fetchManifest(ctx context.Context, manifestID string) (*Manifest, error)
+	placeReplacement(ctx context.Context, old *Manifest, onSending func(Placement) error) (*Manifest, error)
+	erasePlacements(ctx context.Context, manifestID string, placements []Placement) []Placement
+	publishReplacement(ctx context.Context, m *Manifest) error
+}
+
+// Rotates the keys of a manifest, resuming a previous attempt if there is one
+func (sm *StreamsMaster) RotateManifest(ctx context.Context, manifestID string) error {
+	return rotate(ctx, sm.db, sm, manifestID)
+}
+
+// the rotation state machine, see the header
+func rotate(ctx context.Context, db rotationStore, net rotationNetwork, manifestID string) error {
+	state, err := db.RetrieveRotation(manifestID)
+	if err != nil {
+		return err
+	}
+
+	if state == nil {
+		old, err := net.fetchManifest(ctx, manifestID)
+		if err != nil {
+			return err
+		}
+		state = &RotationState{ManifestID: manifestID, Step: ROTATION_PREPARED, Old: *old}
+		if err := db.SaveRotation(*state); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Resuming rotation of %s from step %q\n", manifestID, state.Step)
+	}
+
+	if state.Step == ROTATION_PREPARED {
+		if err := placeRotation(ctx, db, net, state); err != nil {
+			return err
+		}
+	}
+
+	if state.Step == ROTATION_PLACED {
+		failed := net.erasePlacements(ctx, state.ManifestID, state.Old.Placements())
+		if len(failed) > 0 {
+			//keep the state around so the next attempt retries only what is left
+			state.Old.Block = Placement{}
+			state.Old.Fragments = failed
+			state.Old.MPC = nil
+			if err := db.SaveRotation(*state); err != nil {
+				return err
+			}
+			return fmt.Errorf("could not erase %d old pieces, run the rotation again", len(failed))
+		}
+		state.Step = ROTATION_ERASED
+		if err := db.SaveRotation(*state); err != nil {
+			return err
+		}
+	}
+
+	if state.Step == ROTATION_ERASED {
+		if err := net.publishReplacement(ctx, state.New); err != nil {
+			return fmt.Errorf("publish manifest: %v", err)
+		}
+	}
+
+	//pieces of interrupted attempts, not part of any published manifest
+	if len(state.Leftovers) > 0 {
+		state.Leftovers = net.erasePlacements(ctx, state.ManifestID, withoutPlacements(state.Leftovers, state.New.Placements()))
+		if len(state.Leftovers) > 0 {
+			if err := db.SaveRotation(*state); err != nil {
+				return err
+			}
+			return fmt.Errorf("rotated to version %d, but %d pieces of an interrupted attempt could not be erased, run the rotation again", state.New.Version, len(state.Leftovers))
+		}
+	}
+
+	fmt.Printf("🔑 Rotated %s to version %d\n", manifestID, state.New.Version)
+	return db.DeleteRotation(manifestID)
+}
+
+// Resumes every rotation that was interrupted, meant to run at start up
+func (sm *StreamsMaster) ResumeRotations(ctx context.Context) {
+	states, err := sm.db.PendingRotations()
+	if err != nil {
+		fmt.Println("Error loading pending rotations:", err)
+		return
+	}
+
+	for _, state := range states {
+		if err := sm.RotateManifest(ctx, state.ManifestID); err != nil {
+			fmt.Printf("Error resuming rotation of %s: %v\n", state.ManifestID, err)
+		}
+	}
+}
+
+// places the record again under new keys, after erasing what an interrupted attempt left
+func placeRotation(ctx context.Context, db rotationStore, net rotationNetwork, state *RotationState) error {
+	//leftovers of an interrupted attempt are useless, their keys are gone
+	if len(state.Pending) > 0 {
+		failed := net.erasePlacements(ctx, state.ManifestID, state.Pending)
+		if len(failed) > 0 {
+			fmt.Printf("Warning: %d pieces of an interrupted rotation could not be erased yet\n", len(failed))
+		}
+		state.Leftovers = append(state.Leftovers, failed...)
+		state.Pending = nil
+		if err := db.SaveRotation(*state); err != nil {
+			return err
+		}
+	}
+
+	//every piece is saved as pending before it is sent, so a crash can't lose track of it
+	replacement, err := net.placeReplacement(ctx, &state.Old, func(p Placement) error {
+		state.Pending = append(state.Pending, p)
+		if err := db.SaveRotation(*state); err != nil {
+			return fmt.Errorf("save rotation progress: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("place replacement: %v", err)
+	}
+
+	state.New = replacement
+	state.Pending = nil
+	state.Step = ROTATION_PLACED
+	return db.SaveRotation(*state)
+}
+
+// placements not in skip
+func withoutPlacements(placements, skip []Placement) []Placement {
+	var kept []Placement
+	for _, p := range placements {
+		found := false
+		for _, s := range skip {
+			if p == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+func (sm *StreamsMaster) fetchManifest(ctx context.Context, manifestID string) (*Manifest, error) {
+	return FetchManifest(ctx, sm.dht, sm.namespace, manifestID)
+}
+
+// decrypts the old record and places it again under new keys on new peers
+func (sm *StreamsMaster) placeReplacement(ctx context.Context, old *Manifest, onSending func(Placement) error) (*Manifest, error) {
+	//no user in the loop: holders only accept this from admin members, see Consent.go
+	plaintext, err := sm.OpenRecord(ctx, old, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	//avoid the current holders, they may be the reason for the rotation
+	exclude := map[peer.ID]bool{}
+	for _, f := range old.Placements() {
+		if pid, err := sm.holder(ctx, f); err == nil {
+			exclude[pid] = true
+		}
+	}
+
+	replacement, err := sm.PlaceRecord(ctx, old.ID, old.Version+1, plaintext, exclude, onSending)
+	if err != nil {
+		return nil, err
+	}
+
+	//same record, only its gateway or an admin (this node) can sign the new version
+	replacement.Gateway = old.Gateway
+	replacement.Format = old.Format
+	return replacement, nil
+}
+
+// signs and publishes the new manifest version
+func (sm *StreamsMaster) publishReplacement(ctx context.Context, m *Manifest) error {
+	if err := sm.signManifest(m); err != nil {
+		return fmt.Errorf("sign manifest: %v", err)
+	}
+	return sm.publishManifest(ctx, m)
+}
+
+// erases stored pieces from their holders, returns the ones that could not be erased
+func (sm *StreamsMaster) erasePlacements(ctx context.Context, manifestID string, placements []Placement) []Placement {
+	var failed []Placement
+	for _, p := range placements {
+		if p.Hash == "" {
+			continue
+		}
+
+		pid, err := sm.holder(ctx, p)
+		if err != nil {
+			fmt.Println("Error finding the holder of an old piece:", err)
+			failed = append(failed, p)
+			continue
+		}
+
+		if err := sm.DeleteSend(ctx, pid, HashRequest{ManifestID: manifestID, Hash: p.Hash}); err != nil {
+			fmt.Println("Error erasing old piece:", err)
+			failed = append(failed, p)
+		}
+	}
+	return failed
+}
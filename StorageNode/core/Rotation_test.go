@@ -0,0 +1,251 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var errCrashed = errors.New("node crashed")
+
+// a node running rotations: saved state, stored pieces and the published manifest,
+// failing every operation from the crashAt-th one on, as if it died there
+type fakeRotationNode struct {
+	t *testing.T
+
+	saved     []byte          // the persisted RotationState, nil if none
+	stored    map[string]bool // peer/hash of every piece on the network
+	published Manifest
+
+	unreachable map[string]bool // peers that refuse to erase
+	attempts    int             // placements started, block hashes change with the keys
+	ops         int
+	crashAt     int // 0 never crashes
+}
+
+func newFakeRotationNode(t *testing.T) *fakeRotationNode {
+	f := &fakeRotationNode{t: t, stored: map[string]bool{}, unreachable: map[string]bool{}}
+	f.published = Manifest{
+		ID:        "manifest",
+		Version:   1,
+		Block:     Placement{Hash: "block-v1", Peer: "old-0"},
+		Fragments: []Placement{{Hash: fragmentHash("manifest", 1, 0), Peer: "old-1"}, {Hash: fragmentHash("manifest", 1, 1), Peer: "old-2"}},
+		MPC:       []MPCPlacement{{Attribute: "age", Holders: []Placement{{Hash: "mpc-v1", Peer: "old-3"}}}},
+	}
+	for _, p := range f.published.Placements() {
+		f.stored[p.Peer+"/"+p.Hash] = true
+	}
+	return f
+}
+
+func (f *fakeRotationNode) crashed() bool {
+	f.ops++
+	return f.crashAt > 0 && f.ops >= f.crashAt
+}
+
+// restarts the node: nothing but what was persisted survives
+func (f *fakeRotationNode) restart() {
+	f.ops, f.crashAt = 0, 0
+}
+
+func (f *fakeRotationNode) RetrieveRotation(manifestID string) (*RotationState, error) {
+	if f.crashed() {
+		return nil, errCrashed
+	}
+	if f.saved == nil {
+		return nil, nil
+	}
+	state := &RotationState{}
+	if err := json.Unmarshal(f.saved, state); err != nil {
+		f.t.Fatal(err)
+	}
+	return state, nil
+}
+
+func (f *fakeRotationNode) SaveRotation(state RotationState) error {
+	if f.crashed() {
+		return errCrashed
+	}
+	f.saved, _ = json.Marshal(state)
+	return nil
+}
+
+func (f *fakeRotationNode) DeleteRotation(manifestID string) error {
+	if f.crashed() {
+		return errCrashed
+	}
+	f.saved = nil
+	return nil
+}
+
+func (f *fakeRotationNode) fetchManifest(ctx context.Context, manifestID string) (*Manifest, error) {
+	if f.crashed() {
+		return nil, errCrashed
+	}
+	m := f.published
+	return &m, nil
+}
+
+// places a block, two fragments and an MPC share on the new-* peers; like PlaceRecord,
+// only the block hash changes between attempts
+func (f *fakeRotationNode) placeReplacement(ctx context.Context, old *Manifest, onSending func(Placement) error) (*Manifest, error) {
+	f.attempts++
+	version := old.Version + 1
+	m := &Manifest{ID: old.ID, Version: version}
+
+	send := func(p Placement) error {
+		if err := onSending(p); err != nil {
+			return err
+		}
+		if f.crashed() {
+			return errCrashed
+		}
+		f.stored[p.Peer+"/"+p.Hash] = true
+		return nil
+	}
+
+	m.Block = Placement{Hash: fmt.Sprintf("block-v%d-%d", version, f.attempts), Peer: "new-0"}
+	if err := send(m.Block); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 2; i++ {
+		p := Placement{Hash: fragmentHash(old.ID, version, i), Peer: fmt.Sprintf("new-%d", i+1)}
+		if err := send(p); err != nil {
+			return nil, err
+		}
+		m.Fragments = append(m.Fragments, p)
+	}
+	share := Placement{Hash: fmt.Sprintf("mpc-v%d", version), Peer: "new-3"}
+	if err := send(share); err != nil {
+		return nil, err
+	}
+	m.MPC = []MPCPlacement{{Attribute: "age", Holders: []Placement{share}}}
+	return m, nil
+}
+
+func (f *fakeRotationNode) erasePlacements(ctx context.Context, manifestID string, placements []Placement) []Placement {
+	var failed []Placement
+	for _, p := range placements {
+		if p.Hash == "" {
+			continue
+		}
+		if f.crashed() || f.unreachable[p.Peer] {
+			failed = append(failed, p)
+			continue
+		}
+		delete(f.stored, p.Peer+"/"+p.Hash)
+	}
+	return failed
+}
+
+func (f *fakeRotationNode) publishReplacement(ctx context.Context, m *Manifest) error {
+	if f.crashed() {
+		return errCrashed
+	}
+	f.published = *m
+	return nil
+}
+
+// step of the persisted rotation, "" if there is none
+func (f *fakeRotationNode) savedStep() string {
+	if f.saved == nil {
+		return ""
+	}
+	state := RotationState{}
+	json.Unmarshal(f.saved, &state)
+	return state.Step
+}
+
+// the rotation is over: version 2 published, exactly its pieces stored, nothing saved
+func (f *fakeRotationNode) checkRotated(t *testing.T) {
+	t.Helper()
+	if f.saved != nil {
+		t.Errorf("rotation still saved at step %q", f.savedStep())
+	}
+	if f.published.Version != 2 {
+		t.Fatalf("published version %d", f.published.Version)
+	}
+
+	want := map[string]bool{}
+	for _, p := range f.published.Placements() {
+		want[p.Peer+"/"+p.Hash] = true
+		if !f.stored[p.Peer+"/"+p.Hash] {
+			t.Errorf("lost %s", p.Peer+"/"+p.Hash)
+		}
+	}
+	for piece := range f.stored {
+		if !want[piece] {
+			t.Errorf("left behind %s", piece)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	f := newFakeRotationNode(t)
+	if err := rotate(context.Background(), f, f, "manifest"); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	f.checkRotated(t)
+}
+
+// kills the node at every operation of a rotation, then restarts it
+func TestRotationResume(t *testing.T) {
+	resumed := map[string]bool{}
+	for crashAt := 1; ; crashAt++ {
+		f := newFakeRotationNode(t)
+		f.crashAt = crashAt
+		err := rotate(context.Background(), f, f, "manifest")
+		if f.ops < crashAt {
+			//the rotation is shorter than crashAt, every point was covered
+			if err != nil {
+				t.Fatalf("rotate: %v", err)
+			}
+			break
+		}
+		if err == nil && f.saved != nil {
+			t.Fatalf("crash at %d: rotation succeeded but is still saved", crashAt)
+		}
+
+		resumed[f.savedStep()] = true
+		f.restart()
+		if err := rotate(context.Background(), f, f, "manifest"); err != nil {
+			t.Fatalf("crash at %d, step %q: resume: %v", crashAt, f.savedStep(), err)
+		}
+		t.Run(fmt.Sprintf("crash at %d", crashAt), f.checkRotated)
+	}
+
+	for _, step := range []string{ROTATION_PREPARED, ROTATION_PLACED, ROTATION_ERASED} {
+		if !resumed[step] {
+			t.Errorf("never resumed from %q", step)
+		}
+	}
+}
+
+// pieces of an interrupted attempt that can't be erased keep the rotation open
+func TestRotationLeftovers(t *testing.T) {
+	f := newFakeRotationNode(t)
+	f.crashAt = 9 //dies while sending the second fragment of the first attempt
+	if err := rotate(context.Background(), f, f, "manifest"); err == nil {
+		t.Fatal("rotate survived the crash")
+	}
+
+	f.restart()
+	f.unreachable["new-0"] = true
+	f.unreachable["new-1"] = true
+	if err := rotate(context.Background(), f, f, "manifest"); err == nil {
+		t.Fatal("rotation done with pieces left behind")
+	}
+	if f.savedStep() != ROTATION_ERASED || f.published.Version != 2 {
+		t.Fatalf("step %q, published version %d", f.savedStep(), f.published.Version)
+	}
+
+	//the first attempt's fragment on new-1 was placed again: it must not be erased
+	delete(f.unreachable, "new-0")
+	delete(f.unreachable, "new-1")
+	if err := rotate(context.Background(), f, f, "manifest"); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	f.checkRotated(t)
+}
@@ -0,0 +1,437 @@
+/*
+# SDJWT.go
+
+Selective-disclosure credentials (SD-JWT) issued over the stored UserInfo.
+
+The node signs a JWT (EdDSA, with its libp2p identity key) that only contains the
+digests of the claims. Every claim travels next to it as a "disclosure":
+
+	base64url(["<salt>", "<claim name>", <claim value>])
+
+so the user can hand a provider the JWT plus only the disclosures its Criteria asks
+for. The digests are sorted and mixed with SDJWT_DECOYS random ones, so the JWT does
+not tell which claims, or how many, are behind them.
+
+The JWT names the record it was issued over ("sub", the manifest ID) and is bound to
+the key of the peer it was issued to ("cnf", an Ed25519 JWK). Whoever presents it
+must prove they hold that key with a key-binding JWT over the presentation, the
+audience and a nonce chosen by the verifier:
+
+	<issuer signed jwt>~<disclosure>~...~                  (as issued)
+	<issuer signed jwt>~<disclosure>~...~<key binding jwt>  (as presented)
+
+The issuer is the node's peer ID, which embeds its Ed25519 public key, so a provider
+can check the signature offline.
+*/
+
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// how long an issued SD-JWT is valid
+	SDJWT_TTL = 24 * time.Hour
+	// how old a key-binding JWT may be
+	SDJWT_KB_WINDOW = 5 * time.Minute
+	// random digests added to the real ones
+	SDJWT_DECOYS = 3
+)
+
+type sdjwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type sdjwtPayload struct {
+	Iss   string    `json:"iss"`
+	Sub   string    `json:"sub"` // manifest ID of the record the claims come from
+	Iat   int64     `json:"iat"`
+	Exp   int64     `json:"exp"`
+	Cnf   *sdjwtCnf `json:"cnf"`
+	SdAlg string    `json:"_sd_alg"`
+	Sd    []string  `json:"_sd"`
+}
+
+// confirmation key: the holder key the presentations must be signed with
+type sdjwtCnf struct {
+	JWK sdjwtJWK `json:"jwk"`
+}
+
+type sdjwtJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+}
+
+// payload of the key-binding JWT appended to a presentation
+type kbPayload struct {
+	Iat    int64  `json:"iat"`
+	Aud    string `json:"aud"`
+	Nonce  string `json:"nonce"`
+	SdHash string `json:"sd_hash"` // digest of the presentation it is appended to
+}
+
+var b64url = base64.RawURLEncoding
+
+/*
+Issues an SD-JWT over the fields of info (from the record manifestID), signed with the
+node's private key and bound to holder, which must be an Ed25519 key.
+
+Every field (Name, Gender, DOB, Address) is a separately disclosable claim.
+*/
+func IssueSDJWT(priv crypto.PrivKey, info UserInfo, manifestID string, holder crypto.PubKey) (string, error) {
+	issuer, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	if holder == nil || holder.Type() != crypto.Ed25519 {
+		return "", errors.New("holder key must be Ed25519")
+	}
+	x, err := holder.Raw()
+	if err != nil {
+		return "", err
+	}
+
+	claims := []struct {
+		name  string
+		value interface{}
+	}{
+		{"Name", info.Name},
+		{"Gender", info.Gender},
+		{"DOB", info.DOB},
+		{"Address", info.Address},
+	}
+
+	now := time.Now().UTC()
+	payload := sdjwtPayload{
+		Iss:   issuer.String(),
+		Sub:   manifestID,
+		Iat:   now.Unix(),
+		Exp:   now.Add(SDJWT_TTL).Unix(),
+		Cnf:   &sdjwtCnf{JWK: sdjwtJWK{Kty: "OKP", Crv: "Ed25519", X: b64url.EncodeToString(x)}},
+		SdAlg: "sha-256",
+	}
+
+	var disclosures []string
+	for _, c := range claims {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		raw, err := json.Marshal([]interface{}{b64url.EncodeToString(salt), c.name, c.value})
+		if err != nil {
+			return "", err
+		}
+		disclosure := b64url.EncodeToString(raw)
+
+		disclosures = append(disclosures, disclosure)
+		payload.Sd = append(payload.Sd, disclosureDigest(disclosure))
+	}
+
+	//decoys look like the digest of a disclosure nobody has
+	for i := 0; i < SDJWT_DECOYS; i++ {
+		decoy := make([]byte, 32)
+		if _, err := rand.Read(decoy); err != nil {
+			return "", err
+		}
+		payload.Sd = append(payload.Sd, disclosureDigest(b64url.EncodeToString(decoy)))
+	}
+	sort.Strings(payload.Sd)
+
+	jwt, err := signJWT(priv, sdjwtHeader{Alg: "EdDSA", Typ: "dc+sd-jwt"}, payload)
+	if err != nil {
+		return "", err
+	}
+
+	return jwt + "~" + strings.Join(disclosures, "~") + "~", nil
+}
+
+/*
+Drops the disclosures of every claim not in claims from an issued token.
+
+The signature stays valid, the provider just can't see the claims left out.
+*/
+func DiscloseSDJWT(token string, claims []string) (string, error) {
+	jwt, disclosures, _, err := splitSDJWT(token)
+	if err != nil {
+		return "", err
+	}
+
+	wanted := make(map[string]bool)
+	for _, c := range claims {
+		wanted[c] = true
+	}
+
+	kept := []string{jwt}
+	for _, d := range disclosures {
+		name, _, err := decodeDisclosure(d)
+		if err != nil {
+			return "", err
+		}
+		if wanted[name] {
+			kept = append(kept, d)
+		}
+	}
+
+	return strings.Join(kept, "~") + "~", nil
+}
+
+/*
+Builds a presentation of the token for audience: only the given claims are disclosed,
+and a key-binding JWT signed with holder (the key in the token's "cnf") proves the
+presenter holds the token. nonce is the one the verifier asked for.
+*/
+func PresentSDJWT(token string, claims []string, holder crypto.PrivKey, audience string, nonce string) (string, error) {
+	disclosed, err := DiscloseSDJWT(token, claims)
+	if err != nil {
+		return "", err
+	}
+
+	kb, err := signJWT(holder, sdjwtHeader{Alg: "EdDSA", Typ: "kb+jwt"}, kbPayload{
+		Iat:    time.Now().UTC().Unix(),
+		Aud:    audience,
+		Nonce:  nonce,
+		SdHash: disclosureDigest(disclosed),
+	})
+	if err != nil {
+		return "", err
+	}
+	return disclosed + kb, nil
+}
+
+// Returns the claims a criteria needs disclosed (the part of each rule's Field before any '.')
+func ClaimsForCriteria(c Criteria) []string {
+	seen := make(map[string]bool)
+	var claims []string
+	for _, r := range append(append([]Rule{}, c.All...), c.Any...) {
+		name := strings.SplitN(r.Field, ".", 2)[0]
+		if name != "" && !seen[name] {
+			seen[name] = true
+			claims = append(claims, name)
+		}
+	}
+	return claims
+}
+
+/*
+Verifies a presentation made for audience with nonce, and returns the disclosed claims,
+the issuer and the manifest ID the claims come from.
+
+Checks the issuer signature, the expiry, that every disclosure was signed by the issuer,
+and the key-binding JWT against the holder key in "cnf".
+*/
+func VerifySDJWT(token string, audience string, nonce string) (map[string]interface{}, peer.ID, string, error) {
+	jwt, disclosures, kb, err := splitSDJWT(token)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	payload := sdjwtPayload{}
+	issuer, err := verifyJWT(jwt, &payload)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if payload.SdAlg != "sha-256" {
+		return nil, "", "", fmt.Errorf("unsupported _sd_alg %q", payload.SdAlg)
+	}
+	if time.Now().Unix() > payload.Exp {
+		return nil, "", "", errors.New("credential expired")
+	}
+	if err := verifyKeyBinding(token[:len(token)-len(kb)], kb, payload.Cnf, audience, nonce); err != nil {
+		return nil, "", "", err
+	}
+
+	signed := make(map[string]bool)
+	for _, digest := range payload.Sd {
+		signed[digest] = true
+	}
+
+	claims := make(map[string]interface{})
+	for _, d := range disclosures {
+		if !signed[disclosureDigest(d)] {
+			return nil, "", "", errors.New("disclosure not signed by the issuer")
+		}
+		name, value, err := decodeDisclosure(d)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if _, dup := claims[name]; dup {
+			return nil, "", "", fmt.Errorf("claim %q disclosed twice", name)
+		}
+		claims[name] = value
+	}
+
+	return claims, issuer, payload.Sub, nil
+}
+
+// checks the key-binding JWT kb appended to presentation
+func verifyKeyBinding(presentation string, kb string, cnf *sdjwtCnf, audience string, nonce string) error {
+	if kb == "" {
+		return errors.New("missing key binding")
+	}
+	if cnf == nil || cnf.JWK.Kty != "OKP" || cnf.JWK.Crv != "Ed25519" {
+		return errors.New("unsupported holder key")
+	}
+	x, err := b64url.DecodeString(cnf.JWK.X)
+	if err != nil {
+		return errors.New("invalid holder key")
+	}
+	holder, err := crypto.UnmarshalEd25519PublicKey(x)
+	if err != nil {
+		return fmt.Errorf("invalid holder key: %v", err)
+	}
+
+	payload := kbPayload{}
+	if err := verifyJWS(kb, holder, "kb+jwt", &payload); err != nil {
+		return fmt.Errorf("key binding: %v", err)
+	}
+	if payload.Aud != audience || payload.Nonce != nonce {
+		return errors.New("key binding is for another verifier")
+	}
+	if payload.SdHash != disclosureDigest(presentation) {
+		return errors.New("key binding is for another presentation")
+	}
+	if iat := time.Unix(payload.Iat, 0); time.Since(iat) > SDJWT_KB_WINDOW || time.Until(iat) > SDJWT_KB_WINDOW {
+		return errors.New("key binding expired")
+	}
+	return nil
+}
+
+/*-------------------------- HELPERS -----------------------------------*/
+
+func disclosureDigest(disclosure string) string {
+	sum := sha256.Sum256([]byte(disclosure))
+	return b64url.EncodeToString(sum[:])
+}
+
+func decodeDisclosure(disclosure string) (string, interface{}, error) {
+	raw, err := b64url.DecodeString(disclosure)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid disclosure: %v", err)
+	}
+
+	var parts []interface{}
+	if err := json.Unmarshal(raw, &parts); err != nil || len(parts) != 3 {
+		return "", nil, errors.New("invalid disclosure")
+	}
+	name, ok := parts[1].(string)
+	if !ok {
+		return "", nil, errors.New("invalid disclosure claim name")
+	}
+	return name, parts[2], nil
+}
+
+// issuer jwt, disclosures and key-binding jwt ("" when the token has none)
+func splitSDJWT(token string) (string, []string, string, error) {
+	parts := strings.Split(token, "~")
+	if len(parts) < 2 || parts[0] == "" {
+		return "", nil, "", errors.New("invalid SD-JWT")
+	}
+
+	var disclosures []string
+	for _, d := range parts[1 : len(parts)-1] {
+		if d == "" {
+			return "", nil, "", errors.New("invalid SD-JWT")
+		}
+		disclosures = append(disclosures, d)
+	}
+	return parts[0], disclosures, parts[len(parts)-1], nil
+}
+
+// compact JWS signed with the libp2p key
+func signJWT(priv crypto.PrivKey, header interface{}, payload interface{}) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	input := b64url.EncodeToString(h) + "." + b64url.EncodeToString(p)
+	sig, err := priv.Sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + b64url.EncodeToString(sig), nil
+}
+
+// checks a compact JWS whose "iss" is a peer ID and decodes its payload
+func verifyJWT(jwt string, payload interface{}) (peer.ID, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return "", errors.New("invalid JWT")
+	}
+
+	raw, err := b64url.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("invalid JWT payload")
+	}
+	var iss struct {
+		Iss string `json:"iss"`
+	}
+	if err := json.Unmarshal(raw, &iss); err != nil {
+		return "", errors.New("invalid JWT payload")
+	}
+
+	issuer, err := peer.Decode(iss.Iss)
+	if err != nil {
+		return "", fmt.Errorf("invalid issuer: %v", err)
+	}
+	pub, err := issuer.ExtractPublicKey()
+	if err != nil {
+		return "", fmt.Errorf("issuer key: %v", err)
+	}
+
+	if err := verifyJWS(jwt, pub, "dc+sd-jwt", payload); err != nil {
+		return "", err
+	}
+	return issuer, nil
+}
+
+// checks a compact JWS of type typ signed by pub and decodes its payload
+func verifyJWS(jwt string, pub crypto.PubKey, typ string, payload interface{}) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return errors.New("invalid JWT")
+	}
+
+	header := sdjwtHeader{}
+	rawHeader, err := b64url.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil {
+		return errors.New("invalid JWT header")
+	}
+	if header.Alg != "EdDSA" || header.Typ != typ {
+		return fmt.Errorf("unexpected JWT type %q", header.Typ)
+	}
+
+	sig, err := b64url.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("invalid JWT signature")
+	}
+	ok, err := pub.Verify([]byte(parts[0]+"."+parts[1]), sig)
+	if err != nil || !ok {
+		return errors.New("bad signature")
+	}
+
+	raw, err := b64url.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, payload) != nil {
+		return errors.New("invalid JWT payload")
+	}
+	return nil
+}
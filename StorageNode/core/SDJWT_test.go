@@ -0,0 +1,143 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+func testKey(t *testing.T) crypto.PrivKey {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+// an SD-JWT issued by a fresh node key over a fixed UserInfo, bound to holder
+func issueTestSDJWT(t *testing.T, holder crypto.PrivKey) string {
+	t.Helper()
+	info := UserInfo{Name: "Ada Lovelace", Gender: "F", DOB: DOB{Year: 1815, Month: 12, Day: 10}, Address: "12 St James's Square, London"}
+	token, err := IssueSDJWT(testKey(t), info, "manifest-1", holder.GetPublic())
+	if err != nil {
+		t.Fatalf("IssueSDJWT: %v", err)
+	}
+	return token
+}
+
+func TestSDJWTPresentation(t *testing.T) {
+	holder := testKey(t)
+	token := issueTestSDJWT(t, holder)
+
+	presentation, err := PresentSDJWT(token, []string{"Gender"}, holder, "provider", "n-1")
+	if err != nil {
+		t.Fatalf("PresentSDJWT: %v", err)
+	}
+	claims, _, sub, err := VerifySDJWT(presentation, "provider", "n-1")
+	if err != nil {
+		t.Fatalf("VerifySDJWT: %v", err)
+	}
+	if sub != "manifest-1" {
+		t.Errorf("sub = %q", sub)
+	}
+	if len(claims) != 1 || claims["Gender"] != "F" {
+		t.Errorf("disclosed claims = %v", claims)
+	}
+}
+
+func TestSDJWTDecoys(t *testing.T) {
+	token := issueTestSDJWT(t, testKey(t))
+	jwt, disclosures, _, err := splitSDJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := b64url.DecodeString(strings.Split(jwt, ".")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := sdjwtPayload{}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Sd) != len(disclosures)+SDJWT_DECOYS {
+		t.Fatalf("%d digests for %d disclosures", len(payload.Sd), len(disclosures))
+	}
+	for i := 1; i < len(payload.Sd); i++ {
+		if payload.Sd[i-1] > payload.Sd[i] {
+			t.Fatal("digests are in claim order")
+		}
+	}
+}
+
+func TestSDJWTKeyBinding(t *testing.T) {
+	holder := testKey(t)
+	token := issueTestSDJWT(t, holder)
+
+	disclosed, err := DiscloseSDJWT(token, []string{"DOB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := VerifySDJWT(disclosed, "provider", "n-1"); err == nil {
+		t.Error("accepted a presentation without key binding")
+	}
+
+	stolen, err := PresentSDJWT(token, []string{"DOB"}, testKey(t), "provider", "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := VerifySDJWT(stolen, "provider", "n-1"); err == nil {
+		t.Error("accepted a presentation signed by another key")
+	}
+
+	presentation, err := PresentSDJWT(token, []string{"DOB"}, holder, "provider", "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := VerifySDJWT(presentation, "other provider", "n-1"); err == nil {
+		t.Error("accepted a presentation made for another audience")
+	}
+	if _, _, _, err := VerifySDJWT(presentation, "provider", "n-2"); err == nil {
+		t.Error("accepted a replayed nonce")
+	}
+
+	//adding a disclosure after the holder signed breaks sd_hash
+	_, all, _, _ := splitSDJWT(token)
+	kb := presentation[strings.LastIndex(presentation, "~")+1:]
+	widened := strings.TrimSuffix(presentation, kb) + all[0] + "~" + kb
+	if _, _, _, err := VerifySDJWT(widened, "provider", "n-1"); err == nil {
+		t.Error("accepted a disclosure added after key binding")
+	}
+}
+
+func TestSDJWTForgedDisclosure(t *testing.T) {
+	holder := testKey(t)
+	token := issueTestSDJWT(t, holder)
+
+	forged, err := json.Marshal([]interface{}{"c2FsdA", "Gender", "M"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt, _, _, _ := splitSDJWT(token)
+	tampered, err := PresentSDJWT(jwt+"~"+b64url.EncodeToString(forged)+"~", []string{"Gender"}, holder, "provider", "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := VerifySDJWT(tampered, "provider", "n-1"); err == nil {
+		t.Error("accepted a disclosure the issuer did not sign")
+	}
+}
+
+func TestSDJWTHolderKeyType(t *testing.T) {
+	secp, _, err := crypto.GenerateSecp256k1Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueSDJWT(testKey(t), UserInfo{}, "manifest-1", secp.GetPublic()); err == nil {
+		t.Error("issued a token bound to a non Ed25519 key")
+	}
+}
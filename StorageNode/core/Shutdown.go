@@ -0,0 +1,109 @@
+/*
+# Shutdown.go
+
+Graceful shutdown of a running node.
+
+Once the root context is cancelled (SIGINT/SIGTERM, see exec/start.go), the node stops
+accepting streams, lets the requests being handled finish for up to timeouts.shutdown,
+records itself as inactive and closes the audit log, the services handed to CloseOnShutdown
+(mDNS), the DHT, the host and the database, in that order. The background loops (role
+records, audit checkpoints, rate limiters) stop with the root context itself.
+*/
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// node status values kept in the nodes collection
+const (
+	STATUS_ACTIVE   = "active"
+	STATUS_INACTIVE = "inactive"
+)
+
+// wraps a handler so shutdown can refuse new streams and wait for running ones
+func (sm *StreamsMaster) track(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		sm.drain.RLock()
+		if sm.closing {
+			sm.drain.RUnlock()
+			s.Reset()
+			return
+		}
+		sm.inflight.Add(1)
+		sm.drain.RUnlock()
+		defer sm.inflight.Done()
+
+		handler(s)
+	}
+}
+
+// records the node status with its first address
+func (sm *StreamsMaster) SetStatus(status string) {
+	addr := ""
+	if addrs := sm.h.Addrs(); len(addrs) > 0 {
+		addr = fmt.Sprintf("%s/p2p/%s", addrs[0], sm.h.ID())
+	}
+	if err := sm.db.UpdateNodeStatus(sm.h.ID().String(), addr, status); err != nil {
+		fmt.Println("Error updating node status:", err)
+	}
+}
+
+// closes c on shutdown, before the DHT; nil is ignored
+func (sm *StreamsMaster) CloseOnShutdown(c io.Closer) {
+	if c != nil {
+		sm.closers = append(sm.closers, c)
+	}
+}
+
+/*
+Stops accepting streams, waits up to timeout for the running handlers, records the node
+as inactive and closes everything. Returns false when handlers were still running.
+*/
+func (sm *StreamsMaster) Shutdown(timeout time.Duration) bool {
+	sm.drain.Lock()
+	sm.closing = true
+	sm.drain.Unlock()
+	for _, p := range sm.protocols {
+		sm.h.RemoveStreamHandler(p.Name())
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		sm.inflight.Wait()
+		close(drained)
+	}()
+	clean := true
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		fmt.Println("⚠️  Requests still running after", timeout, "- closing anyway")
+		clean = false
+	}
+
+	sm.SetStatus(STATUS_INACTIVE)
+
+	if err := sm.audit.Close(); err != nil {
+		fmt.Println("Error closing audit log:", err)
+	}
+	for _, c := range sm.closers {
+		if err := c.Close(); err != nil {
+			fmt.Println("Error closing service:", err)
+		}
+	}
+	if err := sm.dht.Close(); err != nil {
+		fmt.Println("Error closing DHT:", err)
+	}
+	if err := sm.h.Close(); err != nil {
+		fmt.Println("Error closing host:", err)
+	}
+	if err := sm.db.Close(); err != nil {
+		fmt.Println("Error closing database:", err)
+	}
+	return clean
+}
@@ -14,11 +14,14 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"strconv"
+	"math/big"
+	"sync"
 	"time"
 
+	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -35,34 +38,146 @@ type Protocol interface {
 
 // main object to use protocols
 type StreamsMaster struct {
-	h         host.Host
-	protocols []Protocol
+	h          host.Host
+	dht        *dht.IpfsDHT
+	db         *Database
+	namespace  string
+	cfg        *Config
+	admins     map[peer.ID]bool
+	gater      *MemberGater
+	nonces     *NonceCache
+	successors *SuccessorCache
+	audit      *AuditLog
+	limiter    *RateLimiter
+	roles      *RoleBook
+	protocols  []Protocol
+	closers    []io.Closer // closed on shutdown before the DHT (see CloseOnShutdown)
+
+	drain    sync.RWMutex   // held for writing once shutting down
+	closing  bool           // no more streams are accepted
+	inflight sync.WaitGroup // handlers still running
 }
 
 // Function to initialize stream master and set all handlers
-func HandlersInit(h host.Host) *StreamsMaster {
+//
+// If gater is not nil, streams from non-members are refused. Background loops stop with ctx.
+func HandlersInit(ctx context.Context, h host.Host, kadDHT *dht.IpfsDHT, db *Database, cfg *Config, gater *MemberGater) *StreamsMaster {
 	//create new stream master
 	sm := &StreamsMaster{
-		h: h,
+		h:          h,
+		dht:        kadDHT,
+		db:         db,
+		namespace:  cfg.Network.Namespace,
+		cfg:        cfg,
+		admins:     cfg.AdminIDs(),
+		gater:      gater,
+		nonces:     NewNonceCache(),
+		successors: NewSuccessorCache(cfg.Timeouts.Lookup),
+		limiter:    NewRateLimiter(),
 	}
 
-	//include all protocols
-	sm.protocols = []Protocol{
-		&PrintProtocol{},
-		&UploadProtocol{},
-		&StoreProtocol{},
-		// &OtherProtocol{},
+	//every access to stored pieces is logged
+	audit, err := OpenAuditLog(HomePath(auditFile), h.Peerstore().PrivKey(h.ID()))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to open %s: %v", auditFile, err))
 	}
+	sm.audit = audit
+	go audit.Run(ctx)
+	go sm.limiter.Run(ctx)
+
+	//include the protocols of our roles (see Roles.go)
+	sm.protocols = ProtocolsFor(cfg.Roles)
 
 	//set them all
 	for _, p := range sm.protocols {
-		h.SetStreamHandler(p.Name(), p.Handler(sm))
+		handler := sm.limiter.Guard(p.Name(), sm.track(p.Handler(sm)))
+		if gater != nil {
+			handler = gater.Guard(p.Name(), handler)
+		}
+		h.SetStreamHandler(p.Name(), handler)
 	}
 
+	//advertise our roles and capabilities in the DHT, and learn the ones of our peers
+	sm.roles = StartRoles(ctx, h, kadDHT, sm.namespace, sm.advertised, gater, cfg.Timeouts.Lookup)
+
 	//return stream master
 	return sm
 }
 
+// roles and capabilities we advertise to our peers
+func (sm *StreamsMaster) advertised() RoleInfo {
+	free, err := DiskFree(HomePath("."))
+	if err != nil {
+		fmt.Println("Error reading free disk space:", err)
+	}
+	var protocols []string
+	for _, p := range sm.protocols {
+		protocols = append(protocols, string(p.Name()))
+	}
+	return RoleInfo{
+		Roles:        sm.cfg.Roles,
+		Capabilities: Capabilities{FreeSpace: free, Protocols: protocols, Region: sm.cfg.Region},
+	}
+}
+
+// admins from config.yaml and the ones that advertised the role, never picked to store data
+func (sm *StreamsMaster) adminPeers() map[peer.ID]bool {
+	admins := sm.roles.Admins()
+	for p := range sm.admins {
+		admins[p] = true
+	}
+	return admins
+}
+
+/*
+Picks the node to hold a piece of size bytes: a storage node with room for it, avoiding
+exclude. Without one, any peer that is not known to be an admin or to lack the storage role.
+Returns "" when every connected peer is ruled out.
+*/
+func (sm *StreamsMaster) pickHolder(exclude map[peer.ID]bool, size int) peer.ID {
+	skip := sm.adminPeers()
+	for p := range exclude {
+		skip[p] = true
+	}
+	if p := sm.roles.Pick(ROLE_STORAGE, STORE_PROTOCOL, uint64(size), "", skip); p != "" {
+		return p
+	}
+
+	for p := range sm.roles.Lacking(ROLE_STORAGE) {
+		skip[p] = true
+	}
+	return GetRandomPeer(sm.h, skip)
+}
+
+/*
+Picks n distinct holders for pieces of size bytes, so that no peer holds two shares of the
+same secret. Peers in exclude are avoided when possible; fails when fewer than n distinct
+peers are available.
+*/
+func (sm *StreamsMaster) pickHolders(n int, exclude map[peer.ID]bool, size int) ([]peer.ID, error) {
+	chosen := make(map[peer.ID]bool)
+	var holders []peer.ID
+	for len(holders) < n {
+		avoid := make(map[peer.ID]bool)
+		for p := range exclude {
+			avoid[p] = true
+		}
+		for p := range chosen {
+			avoid[p] = true
+		}
+		p := sm.pickHolder(avoid, size)
+		if p == "" {
+			p = sm.pickHolder(chosen, size)
+		}
+		if p == "" {
+			return nil, fmt.Errorf("only %d distinct storage peers available for %d pieces", len(holders), n)
+		}
+		chosen[p] = true
+		holders = append(holders, p)
+	}
+	return holders, nil
+}
+
 /*-------------------------- PRINT PROTOCOL -----------------------------------*/
 
 type PrintProtocol struct{}
@@ -80,14 +195,13 @@ func (p *PrintProtocol) Handler(sm *StreamsMaster) network.StreamHandler {
 	return func(s network.Stream) {
 		defer s.Close()
 
-		reader := bufio.NewReader(s)
-		msg, err := reader.ReadString('\n')
-		if err != nil && err != io.EOF {
+		msg, err := readLimited(s)
+		if err != nil {
 			fmt.Println("Error reading:", err)
 			return
 		}
 
-		fmt.Println("Received message:", msg)
+		fmt.Println("Received message:", string(msg))
 
 		//How to reply
 		//remotePeer := s.Conn().RemotePeer()
@@ -135,57 +249,39 @@ func (p *UploadProtocol) Handler(sm *StreamsMaster) network.StreamHandler {
 		defer s.Close()
 
 		// 1. Read Payload
-		reader := bufio.NewReader(s)
-		raw, err := reader.ReadBytes('\n')
-		if err != nil && err != io.EOF {
-			fmt.Println("Read error:", err)
+		var raw json.RawMessage
+		origin, err := sm.readRequest(s, &raw)
+		if err != nil {
+			fmt.Println("Rejected upload:", err)
+			writeJSON(s, ErrorReply{Error: requestError(err)})
 			return
 		}
 
-		fmt.Printf("\nIncoming data: %s", raw)
+		fmt.Printf("\nIncoming data from %s: %s\n", origin, raw)
 
-		// 3. Encrypt Data
-		cipher, key, err := Encrypt(raw)
-		if err != nil {
-			fmt.Println("Encrypt error:", err)
+		payload := UploadPayload{}
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			fmt.Println("Invalid upload payload:", err)
 			return
 		}
 
-		// 4. Generate Hash
-		cid := CidHash([]byte("1-Santiago-Test")).String()
-
-		// 5. Create Encrypted Data
-		blob := SimpleData{
-			Hash: cid,
-			Data: base64.StdEncoding.EncodeToString(cipher),
+		// 2. Encrypt, split and send to the storage network
+		manifest, err := sm.PlaceRecord(context.Background(), ManifestID(payload.UID), 1, raw, nil, nil)
+		if err != nil {
+			fmt.Println("Error placing record:", err)
+			return
 		}
 
-		fmt.Printf("\nGenerated encrypted data: %s\n", blob.Data)
-
-		// Send to Blob storage network
-		if err := sm.StoreSend(context.Background(), GetRandomPeer(sm.h), blob); err != nil {
-			fmt.Println("Error handling off DataBlock:", err)
+		// 3. Sign and publish manifest
+		if err := sm.signManifest(manifest); err != nil {
+			fmt.Println("Error signing manifest:", err)
+			return
 		}
-
-		// 6. Split Key
-		const total = 5
-		const threshold = 3
-		shares := SplitKey(key, total, threshold)
-
-		for i, share := range shares {
-			cid := CidHash([]byte("fragment#" + strconv.Itoa(i))).String()
-			fp := SimpleData{
-				Hash: cid,
-				Data: base64.StdEncoding.EncodeToString(share),
-			}
-
-			fmt.Printf("\nKey fragment: %s\n", fp.Data)
-
-			// Send fragments to storage network
-			if err := sm.StoreSend(context.Background(), GetRandomPeer(sm.h), fp); err != nil {
-				fmt.Printf("Error sending fragment %d: %v\n", i+1, err)
-			}
+		if err := sm.publishManifest(context.Background(), manifest); err != nil {
+			fmt.Println("Error publishing manifest:", err)
+			return
 		}
+		fmt.Println("Published manifest:", manifest.ID)
 		// fmt.Println("Uploaded Data")
 	}
 }
@@ -201,6 +297,12 @@ type StoreProtocol struct{}
 
 const STORE_PROTOCOL = "/store/1.0.0"
 
+// a piece to store, and the manifest it belongs to (for the audit log)
+type StoreRequest struct {
+	SimpleData
+	ManifestID string `json:"manifest_id,omitempty"`
+}
+
 // name getter
 func (p *StoreProtocol) Name() protocol.ID {
 	return STORE_PROTOCOL
@@ -211,27 +313,22 @@ func (p *StoreProtocol) Handler(sm *StreamsMaster) network.StreamHandler {
 	return func(s network.Stream) {
 		defer s.Close()
 
-		reader := bufio.NewReader(s)
-		raw, err := reader.ReadBytes('\n')
-		if err != nil && err != io.EOF {
-			fmt.Println("Read error:", err)
-			return
-		}
-
-		simpleData := SimpleData{}
-		err = json.Unmarshal(raw, &simpleData)
+		req := StoreRequest{}
+		origin, err := sm.readRequest(s, &req)
 		if err != nil {
-			panic("Error parsing json to object")
+			fmt.Println("Rejected store request:", err)
+			sm.audit.Record(s.Conn().RemotePeer(), req.Hash, req.ManifestID, AUDIT_STORE, err)
+			writeJSON(s, ErrorReply{Error: requestError(err)})
+			return
 		}
 
-		fmt.Printf("\nI received a data block or key fragment: %s\n", simpleData.Data)
-
-		db, err := NewDatabase("mongodb://localhost:27017")
+		fmt.Printf("\nI received a data block or key fragment: %s\n", req.Data)
 
-		err = db.StoreSimple(simpleData)
+		err = sm.db.StoreSimple(req.SimpleData)
 		if err != nil {
 			fmt.Printf("Error storing data: %s", err)
 		}
+		sm.audit.Record(origin, req.Hash, req.ManifestID, AUDIT_STORE, err)
 
 	}
 }
@@ -245,14 +342,802 @@ func (sm *StreamsMaster) StoreSend(ctx context.Context, peerID peer.ID, payload
 	}
 	defer s.Close()
 
-	// 4. Send the JSON
-	data, err := json.Marshal(payload)
+	// 4. Send the JSON, signed
+	return sm.writeRequest(s, payload)
+}
+
+/*------------------------------------DECRYPT PROTOCOL ----------------------------------------------*/
+
+type DecryptProtocol struct{}
+
+const DECRYPT_PROTOCOL = "/decrypt/1.0.0"
+
+// asks a fragment holder for its partial decryption of a wrapped key
+type DecryptRequest struct {
+	ManifestID string    `json:"manifest_id"`
+	Hash       string    `json:"hash"`              // hash the threshold share was stored under
+	Ephemeral  []byte    `json:"ephemeral"`         // ephemeral point of the wrapped key
+	Session    []byte    `json:"session"`           // verifier session public key, the partial is sealed to it
+	Request    *Envelope `json:"request,omitempty"` // verification request being served, see Consent.go
+}
+
+type DecryptReply struct {
+	X      int    `json:"x"`
+	Sealed []byte `json:"sealed,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// name getter
+func (p *DecryptProtocol) Name() protocol.ID {
+	return DECRYPT_PROTOCOL
+}
+
+// handler for incoming partial decryption requests
+func (p *DecryptProtocol) Handler(sm *StreamsMaster) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+
+		req := DecryptRequest{}
+		origin, err := sm.readRequest(s, &req)
+		reply := func(r DecryptReply) {
+			sm.audit.Record(origin, req.Hash, req.ManifestID, AUDIT_DECRYPT, replyError(r.Error))
+			writeJSON(s, r)
+		}
+		if err != nil {
+			origin = s.Conn().RemotePeer()
+			reply(DecryptReply{Error: requestError(err)})
+			return
+		}
+
+		if err := sm.authorizeHolder(context.Background(), origin, ACL_VERIFY, req.ManifestID, req.Hash, req.Request, ""); err != nil {
+			fmt.Printf("Refused partial decryption for %s: %v\n", origin, err)
+			reply(DecryptReply{Error: err.Error()})
+			return
+		}
+
+		stored, err := sm.db.RetrieveSimple(req.Hash)
+		if err != nil {
+			reply(DecryptReply{Error: "fragment not found"})
+			return
+		}
+		share, err := base64.StdEncoding.DecodeString(stored.Data)
+		if err != nil {
+			reply(DecryptReply{Error: "corrupted fragment"})
+			return
+		}
+
+		x, partial, err := PartialDecrypt(share, req.Ephemeral)
+		if err != nil {
+			reply(DecryptReply{Error: err.Error()})
+			return
+		}
+
+		sealed, err := SealPartial(req.Session, partial)
+		if err != nil {
+			reply(DecryptReply{Error: err.Error()})
+			return
+		}
+
+		reply(DecryptReply{X: x, Sealed: sealed})
+	}
+}
+
+// asks one fragment holder for its sealed partial decryption
+func (sm *StreamsMaster) DecryptSend(ctx context.Context, peerID peer.ID, req DecryptRequest) (*DecryptReply, error) {
+	reply := &DecryptReply{}
+	if err := sm.request(ctx, peerID, DECRYPT_PROTOCOL, req, reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("%s: %s", peerID, reply.Error)
+	}
+	return reply, nil
+}
+
+/*
+Unwraps the data key of a manifest inside a fresh verifier session.
+
+Fragment holders only ever see the ephemeral point and the session public key, and answer
+with partials sealed to the session, so the key only exists here. request (the verification
+request being served, nil for key rotation) is forwarded to them, see Consent.go.
+*/
+func (sm *StreamsMaster) RecoverDataKey(ctx context.Context, m *Manifest, request *Envelope) ([]byte, error) {
+	session, sessionPub, err := NewSession()
 	if err != nil {
+		return nil, err
+	}
+	defer session.Zero()
+
+	partials := make(map[int][]byte)
+	for _, f := range m.Fragments {
+		if len(partials) == m.Threshold {
+			break
+		}
+
+		pid, err := sm.holder(ctx, f)
+		if err != nil {
+			continue
+		}
+
+		reply, err := sm.DecryptSend(ctx, pid, DecryptRequest{
+			ManifestID: m.ID,
+			Hash:       f.Hash,
+			Ephemeral:  m.WrappedKey.Ephemeral,
+			Session:    sessionPub,
+			Request:    request,
+		})
+		if err != nil {
+			fmt.Println("Partial decryption failed:", err)
+			continue
+		}
+
+		partial, err := OpenPartial(session, reply.Sealed)
+		if err != nil {
+			fmt.Println("Invalid sealed partial:", err)
+			continue
+		}
+		partials[reply.X] = partial
+	}
+
+	if len(partials) < m.Threshold {
+		return nil, fmt.Errorf("only %d of %d partial decryptions available", len(partials), m.Threshold)
+	}
+
+	return CombinePartials(partials, &m.WrappedKey)
+}
+
+/*------------------------------------RETRIEVE PROTOCOL ----------------------------------------------*/
+
+type RetrieveProtocol struct{}
+
+const RETRIEVE_PROTOCOL = "/retrieve/1.0.0"
+
+// asks a holder for a stored data block (or for a deletion, in the delete protocol)
+type HashRequest struct {
+	ManifestID string    `json:"manifest_id"` // record the piece belongs to
+	Hash       string    `json:"hash"`
+	Request    *Envelope `json:"request,omitempty"` // when reading as part of a verification, see Consent.go
+}
+
+type RetrieveReply struct {
+	Data  *SimpleData `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// name getter
+func (p *RetrieveProtocol) Name() protocol.ID {
+	return RETRIEVE_PROTOCOL
+}
+
+// handler for incoming retrieve requests
+func (p *RetrieveProtocol) Handler(sm *StreamsMaster) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+
+		req := HashRequest{}
+		origin, err := sm.readRequest(s, &req)
+		reply := func(r RetrieveReply) {
+			sm.audit.Record(origin, req.Hash, req.ManifestID, AUDIT_RETRIEVE, replyError(r.Error))
+			writeJSON(s, r)
+		}
+		if err != nil {
+			origin = s.Conn().RemotePeer()
+			reply(RetrieveReply{Error: requestError(err)})
+			return
+		}
+
+		if err := sm.authorizeHolder(context.Background(), origin, ACL_RETRIEVE, req.ManifestID, req.Hash, req.Request, ""); err != nil {
+			fmt.Printf("Refused retrieval for %s: %v\n", origin, err)
+			reply(RetrieveReply{Error: err.Error()})
+			return
+		}
+
+		data, err := sm.db.RetrieveSimple(req.Hash)
+		if err != nil {
+			reply(RetrieveReply{Error: "not found"})
+			return
+		}
+
+		reply(RetrieveReply{Data: data})
+	}
+}
+
+// gets a stored block back from its holder
+func (sm *StreamsMaster) RetrieveSend(ctx context.Context, peerID peer.ID, req HashRequest) (*SimpleData, error) {
+	reply := RetrieveReply{}
+	if err := sm.request(ctx, peerID, RETRIEVE_PROTOCOL, req, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("%s: %s", peerID, reply.Error)
+	}
+	return reply.Data, nil
+}
+
+/*------------------------------------DELETE PROTOCOL ----------------------------------------------*/
+
+type DeleteProtocol struct{}
+
+const DELETE_PROTOCOL = "/delete/1.0.0"
+
+type DeleteReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// name getter
+func (p *DeleteProtocol) Name() protocol.ID {
+	return DELETE_PROTOCOL
+}
+
+// handler for incoming delete requests
+func (p *DeleteProtocol) Handler(sm *StreamsMaster) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+
+		req := HashRequest{}
+		origin, err := sm.readRequest(s, &req)
+		reply := func(r DeleteReply) {
+			sm.audit.Record(origin, req.Hash, req.ManifestID, AUDIT_DELETE, replyError(r.Error))
+			writeJSON(s, r)
+		}
+		if err != nil {
+			origin = s.Conn().RemotePeer()
+			reply(DeleteReply{Error: requestError(err)})
+			return
+		}
+
+		if err := sm.authorizeHolder(context.Background(), origin, ACL_DELETE, req.ManifestID, req.Hash, nil, ""); err != nil {
+			fmt.Printf("Refused deletion for %s: %v\n", origin, err)
+			reply(DeleteReply{Error: err.Error()})
+			return
+		}
+
+		//deleting something that is already gone is not an error, retries depend on it
+		if _, err := sm.db.RetrieveSimple(req.Hash); err != nil {
+			reply(DeleteReply{})
+			return
+		}
+
+		if err := sm.db.DeleteSimple(req.Hash); err != nil {
+			reply(DeleteReply{Error: err.Error()})
+			return
+		}
+
+		reply(DeleteReply{})
+	}
+}
+
+// asks a holder to erase a stored block or fragment
+func (sm *StreamsMaster) DeleteSend(ctx context.Context, peerID peer.ID, req HashRequest) error {
+	reply := DeleteReply{}
+	if err := sm.request(ctx, peerID, DELETE_PROTOCOL, req, &reply); err != nil {
 		return err
 	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s: %s", peerID, reply.Error)
+	}
+	return nil
+}
+
+/*------------------------------------CREDENTIAL PROTOCOL ----------------------------------------------*/
+
+type CredentialProtocol struct{}
+
+const CREDENTIAL_PROTOCOL = "/credential/1.0.0"
+
+// asks a node to issue an SD-JWT over the identity data of a manifest
+type CredentialRequest struct {
+	ManifestID string        `json:"manifest_id"`
+	Criteria   Criteria      `json:"criteria"` // the claims it needs are the only ones disclosed
+	Consent    *ConsentToken `json:"consent,omitempty"`
+}
+
+type CredentialReply struct {
+	Token string `json:"token,omitempty"` // SD-JWT bound to the requester, with only the claims the criteria needs
+	Error string `json:"error,omitempty"`
+}
+
+// name getter
+func (p *CredentialProtocol) Name() protocol.ID {
+	return CREDENTIAL_PROTOCOL
+}
+
+// handler for incoming credential requests
+func (p *CredentialProtocol) Handler(sm *StreamsMaster) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
 
-	writer := bufio.NewWriter(s)
-	writer.Write(data)
-	writer.WriteString("\n")
-	return writer.Flush()
+		req := CredentialRequest{}
+		env, origin, err := sm.readEnvelope(s, &req)
+		reply := func(r CredentialReply) {
+			sm.audit.Record(origin, "", req.ManifestID, AUDIT_CREDENTIAL, replyError(r.Error))
+			writeJSON(s, r)
+		}
+		if err != nil {
+			origin = s.Conn().RemotePeer()
+			reply(CredentialReply{Error: requestError(err)})
+			return
+		}
+
+		info, err := sm.loadUserInfo(context.Background(), req.ManifestID, env)
+		if err != nil {
+			fmt.Println("Error loading user info:", err)
+			reply(CredentialReply{Error: "record unavailable: " + err.Error()})
+			return
+		}
+
+		//bound to the requesting peer, only it can present the credential
+		holder, err := origin.ExtractPublicKey()
+		if err != nil {
+			reply(CredentialReply{Error: "requester key: " + err.Error()})
+			return
+		}
+		token, err := IssueSDJWT(sm.h.Peerstore().PrivKey(sm.h.ID()), info, req.ManifestID, holder)
+		if err == nil {
+			token, err = DiscloseSDJWT(token, ClaimsForCriteria(req.Criteria))
+		}
+		if err != nil {
+			reply(CredentialReply{Error: err.Error()})
+			return
+		}
+
+		reply(CredentialReply{Token: token})
+	}
+}
+
+// asks a node for an SD-JWT over the identity data of a manifest
+func (sm *StreamsMaster) CredentialSend(ctx context.Context, peerID peer.ID, req CredentialRequest) (string, error) {
+	reply := CredentialReply{}
+	if err := sm.request(ctx, peerID, CREDENTIAL_PROTOCOL, req, &reply); err != nil {
+		return "", err
+	}
+	if reply.Error != "" {
+		return "", fmt.Errorf("%s: %s", peerID, reply.Error)
+	}
+	return reply.Token, nil
+}
+
+/*------------------------------------VERIFY PROTOCOL ----------------------------------------------*/
+
+type VerifyProtocol struct{}
+
+const VERIFY_PROTOCOL = "/verify/1.0.0"
+
+// asks a node to check a manifest's identity data against a provider's criteria
+type VerifyRequest struct {
+	ManifestID string        `json:"manifest_id"`
+	Criteria   Criteria      `json:"criteria"`
+	MPC        bool          `json:"mpc"` // evaluate over the secret-shared attributes, never decrypting the record
+	Consent    *ConsentToken `json:"consent,omitempty"`
+}
+
+type VerifyReply struct {
+	Credential *VerifiableCredential `json:"credential,omitempty"` // signed verdict
+	Error      string                `json:"error,omitempty"`
+}
+
+// name getter
+func (p *VerifyProtocol) Name() protocol.ID {
+	return VERIFY_PROTOCOL
+}
+
+// handler for incoming verification requests
+func (p *VerifyProtocol) Handler(sm *StreamsMaster) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+
+		req := VerifyRequest{}
+		env, origin, err := sm.readEnvelope(s, &req)
+		reply := func(r VerifyReply) {
+			sm.audit.Record(origin, "", req.ManifestID, AUDIT_VERIFY, replyError(r.Error))
+			writeJSON(s, r)
+		}
+		if err != nil {
+			origin = s.Conn().RemotePeer()
+			reply(VerifyReply{Error: requestError(err)})
+			return
+		}
+
+		criteriaHash, err := CriteriaHash(req.Criteria)
+		if err != nil {
+			reply(VerifyReply{Error: "invalid criteria"})
+			return
+		}
+
+		var result bool
+		if req.MPC {
+			result, err = sm.EvaluateCriteriaMPC(context.Background(), req.ManifestID, req.Criteria, env)
+		} else {
+			var info UserInfo
+			info, err = sm.loadUserInfo(context.Background(), req.ManifestID, env)
+			if err == nil {
+				result, err = EvaluateCriteria(info, req.Criteria)
+			}
+		}
+		if err != nil {
+			fmt.Println("Error evaluating criteria:", err)
+			reply(VerifyReply{Error: err.Error()})
+			return
+		}
+
+		vc, err := IssueVerificationCredential(sm.h.Peerstore().PrivKey(sm.h.ID()), req.ManifestID, criteriaHash, result)
+		if err != nil {
+			reply(VerifyReply{Error: err.Error()})
+			return
+		}
+
+		reply(VerifyReply{Credential: vc})
+	}
+}
+
+// asks a node to verify a manifest against a criteria, the verdict is checked before returning it
+func (sm *StreamsMaster) VerifySend(ctx context.Context, peerID peer.ID, req VerifyRequest) (*VerifiableCredential, error) {
+	reply := VerifyReply{}
+	if err := sm.request(ctx, peerID, VERIFY_PROTOCOL, req, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("%s: %s", peerID, reply.Error)
+	}
+	if reply.Credential == nil {
+		return nil, fmt.Errorf("%s: empty verdict", peerID)
+	}
+	if err := VerifyCredential(reply.Credential); err != nil {
+		return nil, err
+	}
+	return reply.Credential, nil
+}
+
+/*------------------------------------MPC PROTOCOL ----------------------------------------------*/
+
+type MPCProtocol struct{}
+
+const MPC_PROTOCOL = "/mpc/1.0.0"
+
+// asks a holder for its share of the verdict of one rule, see MPC.go
+type MPCRequest struct {
+	ManifestID string    `json:"manifest_id"`
+	Hash       string    `json:"hash"`              // hash the attribute shares were stored under
+	Criteria   Criteria  `json:"criteria"`          // must be the one the consent was given for
+	Rule       int       `json:"rule"`              // index of the rule to evaluate, in All then Any
+	Request    *Envelope `json:"request,omitempty"` // verification request being served, see Consent.go
+}
+
+type MPCReply struct {
+	X     int    `json:"x"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// name getter
+func (p *MPCProtocol) Name() protocol.ID {
+	return MPC_PROTOCOL
+}
+
+// handler for incoming MPC evaluation requests
+func (p *MPCProtocol) Handler(sm *StreamsMaster) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+
+		req := MPCRequest{}
+		origin, err := sm.readRequest(s, &req)
+		reply := func(r MPCReply) {
+			sm.audit.Record(origin, req.Hash, req.ManifestID, AUDIT_MPC, replyError(r.Error))
+			writeJSON(s, r)
+		}
+		if err != nil {
+			origin = s.Conn().RemotePeer()
+			reply(MPCReply{Error: requestError(err)})
+			return
+		}
+
+		//only rules of the consented criteria are evaluated, the coefficients are ours
+		criteriaHash, err := CriteriaHash(req.Criteria)
+		rules := criteriaRules(req.Criteria)
+		if err != nil || req.Rule < 0 || req.Rule >= len(rules) {
+			reply(MPCReply{Error: "invalid criteria"})
+			return
+		}
+
+		if err := sm.authorizeHolder(context.Background(), origin, ACL_VERIFY, req.ManifestID, req.Hash, req.Request, criteriaHash); err != nil {
+			fmt.Printf("Refused mpc evaluation for %s: %v\n", origin, err)
+			reply(MPCReply{Error: err.Error()})
+			return
+		}
+
+		stored, err := sm.db.RetrieveSimple(req.Hash)
+		if err != nil {
+			reply(MPCReply{Error: "shares not found"})
+			return
+		}
+		raw, err := base64.StdEncoding.DecodeString(stored.Data)
+		set := MPCShareSet{}
+		if err != nil || json.Unmarshal(raw, &set) != nil {
+			reply(MPCReply{Error: "corrupted shares"})
+			return
+		}
+
+		value, err := EvalMPCShare(&set, rules[req.Rule])
+		if err != nil {
+			reply(MPCReply{Error: err.Error()})
+			return
+		}
+
+		reply(MPCReply{X: set.X, Value: value.String()})
+	}
+}
+
+// asks one holder for its share of the verdict of a rule
+func (sm *StreamsMaster) MPCSend(ctx context.Context, peerID peer.ID, req MPCRequest) (int, *big.Int, error) {
+	reply := MPCReply{}
+	if err := sm.request(ctx, peerID, MPC_PROTOCOL, req, &reply); err != nil {
+		return 0, nil, err
+	}
+	if reply.Error != "" {
+		return 0, nil, fmt.Errorf("%s: %s", peerID, reply.Error)
+	}
+	value, ok := new(big.Int).SetString(reply.Value, 10)
+	if !ok || value.Sign() < 0 || value.Cmp(mpcPrime) >= 0 {
+		return 0, nil, fmt.Errorf("%s: invalid share", peerID)
+	}
+	return reply.X, value, nil
+}
+
+// Evaluates a criteria over the secret-shared attributes of a manifest, for the verification request in request
+func (sm *StreamsMaster) EvaluateCriteriaMPC(ctx context.Context, manifestID string, c Criteria, request *Envelope) (bool, error) {
+	if !MPCSupports(c) {
+		return false, errors.New("criteria uses attributes or rules that can't be evaluated with mpc")
+	}
+
+	m, err := FetchManifest(ctx, sm.dht, sm.namespace, manifestID)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := sm.authorizeRecord(ctx, m, request, sm.h.ID()); err != nil {
+		return false, err
+	}
+
+	for i := range c.All {
+		ok, err := sm.evaluateRuleMPC(ctx, m, c, i, request)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	if len(c.Any) == 0 {
+		return true, nil
+	}
+	for i := range c.Any {
+		ok, err := sm.evaluateRuleMPC(ctx, m, c, len(c.All)+i, request)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// opens the verdict of rule i of c (see criteriaRules) from threshold holders
+func (sm *StreamsMaster) evaluateRuleMPC(ctx context.Context, m *Manifest, c Criteria, i int, request *Envelope) (bool, error) {
+	r := criteriaRules(c)[i]
+	placement := m.MPCAttribute(r.Field)
+	if placement == nil {
+		return false, fmt.Errorf("attribute %q was not shared for mpc", r.Field)
+	}
+
+	shares := make(map[int]*big.Int)
+	for _, holder := range placement.Holders {
+		if len(shares) == placement.Threshold {
+			break
+		}
+
+		pid, err := sm.holder(ctx, holder)
+		if err != nil {
+			continue
+		}
+		x, value, err := sm.MPCSend(ctx, pid, MPCRequest{
+			ManifestID: m.ID,
+			Hash:       holder.Hash,
+			Criteria:   c,
+			Rule:       i,
+			Request:    request,
+		})
+		if err != nil {
+			fmt.Println("Error evaluating mpc share:", err)
+			continue
+		}
+		shares[x] = value
+	}
+
+	if len(shares) < placement.Threshold {
+		return false, fmt.Errorf("only %d of %d mpc shares for %q", len(shares), placement.Threshold, r.Field)
+	}
+	return MPCRuleResult(shares)
+}
+
+/*------------------------------------HELPERS ----------------------------------------------*/
+
+// error of a reply, nil if it has none
+func replyError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	return errors.New(msg)
+}
+
+// reads one json line from the stream, refusing the ones over the protocol cap (see Limits.go)
+func readJSON(s network.Stream, v interface{}) error {
+	raw, err := readLimited(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// writes one json line to the stream
+func writeJSON(s network.Stream, v interface{}) error {
+	data, err := marshalJSON(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.Write(append(data, '\n'))
+	return err
+}
+
+// reads one signed request envelope, checks it and decodes its payload into v; returns the origin
+func (sm *StreamsMaster) readRequest(s network.Stream, v interface{}) (peer.ID, error) {
+	_, origin, err := sm.readEnvelope(s, v)
+	return origin, err
+}
+
+// readRequest, also returning the envelope (verification requests are forwarded to holders)
+func (sm *StreamsMaster) readEnvelope(s network.Stream, v interface{}) (*Envelope, peer.ID, error) {
+	env := &Envelope{}
+	if err := readJSON(s, env); err != nil {
+		return nil, "", err
+	}
+	origin, err := env.Open(sm.nonces, sm.h.ID(), s.Protocol(), v)
+	return env, origin, err
+}
+
+// writes one request wrapped in an envelope signed with the node key
+func (sm *StreamsMaster) writeRequest(s network.Stream, v interface{}) error {
+	env, err := SealEnvelope(sm.h.Peerstore().PrivKey(sm.h.ID()), s.Conn().RemotePeer(), s.Protocol(), v)
+	if err != nil {
+		return err
+	}
+	return writeJSON(s, env)
+}
+
+// opens a stream, sends one signed json request and reads one json reply
+func (sm *StreamsMaster) request(ctx context.Context, peerID peer.ID, proto protocol.ID, req interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, sm.cfg.Timeouts.Request)
+	defer cancel()
+
+	s, err := sm.h.NewStream(ctx, peerID, proto)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := sm.writeRequest(s, req); err != nil {
+		return err
+	}
+	return readJSON(s, reply)
+}
+
+// peer currently holding a placed piece, following the successions of the peer it was sent to
+func (sm *StreamsMaster) holder(ctx context.Context, p Placement) (peer.ID, error) {
+	pid, err := ParseNodeRef(p.Peer)
+	if err != nil {
+		return "", err
+	}
+	return sm.successors.Resolve(ctx, sm.dht, sm.namespace, pid.String())
+}
+
+// fetches a manifest, checks the consent in the verification request, opens its record and parses the UserInfo in it
+func (sm *StreamsMaster) loadUserInfo(ctx context.Context, manifestID string, request *Envelope) (UserInfo, error) {
+	info := UserInfo{}
+
+	m, err := FetchManifest(ctx, sm.dht, sm.namespace, manifestID)
+	if err != nil {
+		return info, err
+	}
+	if _, err := sm.authorizeRecord(ctx, m, request, sm.h.ID()); err != nil {
+		return info, err
+	}
+
+	record, err := sm.OpenRecord(ctx, m, request)
+	if err != nil {
+		return info, err
+	}
+
+	payload := UploadPayload{}
+	if err := json.Unmarshal(record, &payload); err != nil {
+		return info, fmt.Errorf("stored record is not an upload: %v", err)
+	}
+	if err := json.Unmarshal(payload.UserData, &info); err != nil {
+		return info, fmt.Errorf("stored record is not a UserInfo: %v", err)
+	}
+	return info, nil
+}
+
+/*
+Checks that origin may do operation (an ACL operation) on the piece stored under hash.
+
+Admin members (key rotation) may do anything without consent. Otherwise the piece must
+belong to the manifest, and either the record ACL grants origin the operation directly,
+or (reads only) origin forwards a verification request whose consent is valid (see
+CheckConsent) and whose requester the ACL lets verify. Reads of records without an owner
+are not protected, deleting them is left to the gateway that signed the record.
+criteriaHash is the criteria the holder itself evaluates (MPC), it must be the consented one.
+*/
+func (sm *StreamsMaster) authorizeHolder(ctx context.Context, origin peer.ID, operation string, manifestID string, hash string, request *Envelope, criteriaHash string) error {
+	//rotation erases pieces of replacements that were never published
+	if request == nil && sm.gater != nil && sm.gater.Role(origin) == CONSENT_EXEMPT_ROLE {
+		return nil
+	}
+
+	m, err := FetchManifest(ctx, sm.dht, sm.namespace, manifestID)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, p := range m.Placements() {
+		found = found || p.Hash == hash
+	}
+	if !found {
+		return errors.New("piece does not belong to the record")
+	}
+
+	acl := sm.recordACL(ctx, m)
+	if acl != nil && operation != ACL_VERIFY && acl.Allows(origin.String(), operation) {
+		return nil
+	}
+	if operation == ACL_DELETE {
+		if m.Owner == "" && canonicalIdentity(m.Gateway) == origin.String() {
+			return nil
+		}
+		return errors.New("deletion not allowed by the record owner")
+	}
+
+	consented, err := sm.authorizeRecord(ctx, m, request, origin)
+	if err != nil {
+		return err
+	}
+	if consented != nil && criteriaHash != "" && consented.CriteriaHash != criteriaHash {
+		return errors.New("consent given for another criteria")
+	}
+	return nil
+}
+
+// checks the consent of a verification request sent to via for m, and that the record ACL lets its requester verify
+func (sm *StreamsMaster) authorizeRecord(ctx context.Context, m *Manifest, request *Envelope, via peer.ID) (*ConsentedRequest, error) {
+	consented, err := CheckConsent(m, request, via)
+	if err != nil || consented == nil {
+		return nil, err
+	}
+	//the node that signed the request, not the provider named in the token
+	if acl := sm.recordACL(ctx, m); acl != nil && !acl.Allows(consented.Requester.String(), ACL_VERIFY) {
+		return nil, errors.New("requester not allowed to verify by the record acl")
+	}
+	return consented, nil
+}
+
+// the ACL in force for a manifest, nil if it has none
+func (sm *StreamsMaster) recordACL(ctx context.Context, m *Manifest) *ACL {
+	if m.Owner == "" {
+		return nil
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, sm.cfg.Timeouts.Lookup)
+	defer cancel()
+	published, err := FetchACL(lookupCtx, sm.dht, sm.namespace, m.ID)
+	if err != nil {
+		fmt.Println("Ignoring published acl:", err)
+	}
+	return EffectiveACL(m, published)
 }
@@ -0,0 +1,387 @@
+/*
+# Succession.go
+
+Succession records: statements that a node identity continues under a new peer ID.
+
+When a node rotates its identity key (rotate-identity), the old key signs a statement
+naming the new peer ID, and the new key countersigns it to show it is really held.
+Both public keys are embedded in the peer IDs, so anyone can check a record offline.
+
+Records are published in the DHT record store, under the node's custom namespace:
+	/
+	├── <namespace>/
+	│     ├── succession/
+	│     │     ├── <old peer ID> : succession json
+
+Manifests keep naming the peer a piece was sent to; the holder is found by following the
+successions from there. The node also keeps its whole chain in Succession.json and
+presents it with its membership certificate, so members admit the new ID with the
+certificate of the old one.
+
+Trust model: a succession is as good as the old key. Whoever holds it (the node, or
+someone who stole it) can sign a succession, with any timestamp, so timestamps can't
+decide between two records for one ID. Instead each node pins the first succession it
+accepts for a peer ID (SuccessionPins.json, its own chain included) and refuses any
+other one for that ID from then on; records dated more than SUCCESSION_WINDOW ahead of
+our clock are refused. A stolen key is therefore useless against nodes, DHT holders
+included, that saw the real succession; it only fools a node that hears of that peer
+ID for the first time from the thief. So rotate-identity keeps no copy of the old key:
+nothing needs it once the succession is signed, and the running node keeps the chain
+published (see PublishSuccessionChain).
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// longest chain of successions followed when resolving a peer
+	SUCCESSION_MAX_HOPS = 8
+	// how long a resolved successor is remembered
+	SUCCESSION_CACHE_TTL = 10 * time.Minute
+	// how far ahead of our clock a succession may be dated
+	SUCCESSION_WINDOW = 10 * time.Minute
+)
+
+// files holding the chain of successions that lead to this node's identity, and the pinned successions
+var (
+	successionFile     = "Succession.json"
+	successionPinsFile = "SuccessionPins.json"
+)
+
+type Succession struct {
+	Old          string    `json:"old"` // peer ID being retired
+	New          string    `json:"new"` // peer ID continuing it
+	Timestamp    time.Time `json:"timestamp"`
+	OldSignature []byte    `json:"old_signature,omitempty"` // by the old key
+	NewSignature []byte    `json:"new_signature,omitempty"` // by the new key
+}
+
+// Signs the succession of oldKey by newKey with both keys
+func SignSuccession(oldKey crypto.PrivKey, newKey crypto.PrivKey) (*Succession, error) {
+	oldID, err := peer.IDFromPrivateKey(oldKey)
+	if err != nil {
+		return nil, err
+	}
+	newID, err := peer.IDFromPrivateKey(newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Succession{Old: oldID.String(), New: newID.String(), Timestamp: time.Now().UTC()}
+	msg, err := s.signingBytes()
+	if err != nil {
+		return nil, err
+	}
+	if s.OldSignature, err = oldKey.Sign(msg); err != nil {
+		return nil, err
+	}
+	if s.NewSignature, err = newKey.Sign(msg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Checks both signatures against the keys embedded in the peer IDs
+func (s *Succession) Verify() error {
+	msg, err := s.signingBytes()
+	if err != nil {
+		return err
+	}
+
+	for _, signer := range []struct {
+		id  string
+		sig []byte
+	}{{s.Old, s.OldSignature}, {s.New, s.NewSignature}} {
+		pid, err := peer.Decode(signer.id)
+		if err != nil {
+			return fmt.Errorf("invalid peer ID %s: %v", signer.id, err)
+		}
+		pub, err := pid.ExtractPublicKey()
+		if err != nil {
+			return fmt.Errorf("peer ID %s: %v", signer.id, err)
+		}
+		if ok, err := pub.Verify(msg, signer.sig); err != nil || !ok {
+			return fmt.Errorf("succession not signed by %s", signer.id)
+		}
+	}
+
+	if s.Old == s.New {
+		return errors.New("succession to the same peer ID")
+	}
+	return nil
+}
+
+func (s *Succession) signingBytes() ([]byte, error) {
+	unsigned := *s
+	unsigned.OldSignature, unsigned.NewSignature = nil, nil
+	return canonicalJSON(unsigned)
+}
+
+// Checks that chain links from (and only from) one peer ID to another
+func VerifySuccessionChain(chain []Succession, from string, to peer.ID) error {
+	current := from
+	for i := range chain {
+		if chain[i].Old != current {
+			return errors.New("broken succession chain")
+		}
+		if err := chain[i].Verify(); err != nil {
+			return err
+		}
+		current = chain[i].New
+	}
+	if current != to.String() {
+		return fmt.Errorf("succession chain ends at %s, not at %s", current, to)
+	}
+	return nil
+}
+
+/*-------------------------- DHT RECORDS -----------------------------------*/
+
+func successionKey(namespace string, old string) string {
+	return fmt.Sprintf("/%s/succession/%s", namespace, old)
+}
+
+// Puts a succession record in the DHT record store
+func PublishSuccession(ctx context.Context, kadDHT *dht.IpfsDHT, namespace string, s *Succession) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return kadDHT.PutValue(ctx, successionKey(namespace, s.Old), data)
+}
+
+// Gets the succession record of a peer ID, nil (and no error) if it was never retired
+func FetchSuccession(ctx context.Context, kadDHT *dht.IpfsDHT, namespace string, old string) (*Succession, error) {
+	data, err := kadDHT.GetValue(ctx, successionKey(namespace, old))
+	if err != nil {
+		//the DHT can't tell "no record" apart from "not found in time"
+		return nil, nil
+	}
+
+	s := &Succession{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid succession record for %s: %v", old, err)
+	}
+	if err := s.Verify(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Publishes every succession of our chain and keeps them published (see RepublishRecords)
+func (sm *StreamsMaster) PublishSuccessionChain(ctx context.Context) {
+	chain, err := ReadSuccessionChain()
+	if err != nil {
+		fmt.Println("Error reading succession chain:", err)
+		return
+	}
+	for i := range chain {
+		data, err := json.Marshal(&chain[i])
+		if err != nil {
+			continue
+		}
+		if err := sm.publishRecord(ctx, successionKey(sm.namespace, chain[i].Old), data); err != nil {
+			fmt.Printf("Error publishing succession of %s: %v\n", chain[i].Old, err)
+		}
+	}
+}
+
+/*-------------------------- FILE -----------------------------------*/
+
+// Reads the chain of successions leading to this node, empty if the identity was never rotated
+func ReadSuccessionChain() ([]Succession, error) {
+	data, err := os.ReadFile(HomePath(successionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var chain []Succession
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", successionFile, err)
+	}
+	return chain, nil
+}
+
+// Writes the chain of successions leading to this node
+func WriteSuccessionChain(chain []Succession) error {
+	return writeJSONFile(HomePath(successionFile), chain)
+}
+
+/*
+Saves the chain to use once the node has swapped to the identity it ends at, see
+FinishSuccessionChain. Staged before the swap, so the succession is never lost.
+*/
+func StageSuccessionChain(chain []Succession) error {
+	return writeJSONFile(HomePath(successionFile)+".new", chain)
+}
+
+// Completes an identity rotation: a staged chain is kept if it ends at self (the swap happened) and dropped otherwise
+func FinishSuccessionChain(self peer.ID) error {
+	staged := HomePath(successionFile) + ".new"
+	data, err := os.ReadFile(staged)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var chain []Succession
+	if err := json.Unmarshal(data, &chain); err != nil || len(chain) == 0 || chain[len(chain)-1].New != self.String() {
+		fmt.Println("⚠️ Dropping the succession of an identity rotation that did not finish")
+		return os.Remove(staged)
+	}
+	return os.Rename(staged, HomePath(successionFile))
+}
+
+// writes json through a temporary file, so a crash never leaves it half written
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+/*-------------------------- PINS -----------------------------------*/
+
+// The first succession this node accepted for each retired peer ID, see the trust model above
+type SuccessionPins struct {
+	mu   sync.Mutex
+	file string // empty keeps them in memory only
+	pins map[string]Succession
+}
+
+// Loads the pinned successions (SuccessionPins.json) and pins this node's own chain
+func OpenSuccessionPins() *SuccessionPins {
+	p := NewSuccessionPins(HomePath(successionPinsFile))
+	chain, err := ReadSuccessionChain()
+	if err != nil {
+		fmt.Println("Error reading succession chain:", err)
+	}
+	for i := range chain {
+		p.Pin(&chain[i])
+	}
+	return p
+}
+
+// Pins kept in file (loaded if it exists), or only in memory if file is empty
+func NewSuccessionPins(file string) *SuccessionPins {
+	p := &SuccessionPins{file: file, pins: make(map[string]Succession)}
+	if file == "" {
+		return p
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Error reading succession pins:", err)
+		}
+		return p
+	}
+	if err := json.Unmarshal(data, &p.pins); err != nil {
+		fmt.Printf("Invalid %s: %v\n", file, err)
+	}
+	return p
+}
+
+// Pins s if nothing is pinned for s.Old yet; false if another successor is
+func (p *SuccessionPins) Pin(s *Succession) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pinned, ok := p.pins[s.Old]; ok {
+		return pinned.New == s.New
+	}
+
+	p.pins[s.Old] = *s
+	if p.file != "" {
+		if err := writeJSONFile(p.file, p.pins); err != nil {
+			fmt.Println("Error saving succession pins:", err)
+		}
+	}
+	return true
+}
+
+// the successor pinned for a peer ID, empty if none is
+func (p *SuccessionPins) Pinned(old string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pins[old].New
+}
+
+/*-------------------------- RESOLUTION -----------------------------------*/
+
+type cachedSuccessor struct {
+	id      peer.ID
+	expires time.Time
+}
+
+// Remembers where peer IDs resolved to, a lookup of a missing record takes a while
+type SuccessorCache struct {
+	mu      sync.Mutex
+	seen    map[string]cachedSuccessor
+	timeout time.Duration // of one record lookup
+}
+
+func NewSuccessorCache(timeout time.Duration) *SuccessorCache {
+	return &SuccessorCache{seen: make(map[string]cachedSuccessor), timeout: timeout}
+}
+
+/*
+Follows the successions of a peer ID and returns the peer ID currently continuing it
+(itself if it was never retired).
+*/
+func (c *SuccessorCache) Resolve(ctx context.Context, kadDHT *dht.IpfsDHT, namespace string, id string) (peer.ID, error) {
+	c.mu.Lock()
+	cached, ok := c.seen[id]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	current := id
+	visited := map[string]bool{id: true}
+	for hop := 0; hop < SUCCESSION_MAX_HOPS; hop++ {
+		lookupCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		s, err := FetchSuccession(lookupCtx, kadDHT, namespace, current)
+		cancel()
+		if err != nil {
+			return "", err
+		}
+		if s == nil {
+			break
+		}
+		if visited[s.New] {
+			return "", fmt.Errorf("succession loop at %s", s.New)
+		}
+		visited[s.New] = true
+		current = s.New
+	}
+
+	pid, err := peer.Decode(current)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.seen[id] = cachedSuccessor{id: pid, expires: time.Now().Add(SUCCESSION_CACHE_TTL)}
+	c.mu.Unlock()
+	return pid, nil
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// runs the test from a fresh home directory
+func testHome(t *testing.T) {
+	t.Helper()
+	old := homeDir
+	homeDir = t.TempDir()
+	t.Cleanup(func() { homeDir = old })
+}
+
+func testSuccession(t *testing.T, oldKey crypto.PrivKey, newKey crypto.PrivKey) *Succession {
+	t.Helper()
+	s, err := SignSuccession(oldKey, newKey)
+	if err != nil {
+		t.Fatalf("SignSuccession: %v", err)
+	}
+	return s
+}
+
+// re-signs s with both keys after changing its timestamp, as a holder of the old key could
+func backdate(t *testing.T, s *Succession, oldKey crypto.PrivKey, newKey crypto.PrivKey, when time.Time) {
+	t.Helper()
+	s.Timestamp = when.UTC()
+	msg, err := s.signingBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.OldSignature, err = oldKey.Sign(msg); err != nil {
+		t.Fatal(err)
+	}
+	if s.NewSignature, err = newKey.Sign(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSuccessionSignatures(t *testing.T) {
+	oldKey, newKey := testKey(t), testKey(t)
+	if err := testSuccession(t, oldKey, newKey).Verify(); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	cases := map[string]func(s *Succession){
+		"new":        func(s *Succession) { s.New = testPeerID(t).String() },
+		"old":        func(s *Succession) { s.Old = testPeerID(t).String() },
+		"timestamp":  func(s *Succession) { s.Timestamp = s.Timestamp.Add(-time.Hour) },
+		"countersig": func(s *Succession) { s.NewSignature = nil },
+	}
+	for name, tamper := range cases {
+		s := testSuccession(t, oldKey, newKey)
+		tamper(s)
+		if err := s.Verify(); err == nil {
+			t.Errorf("%s: tampered succession verified", name)
+		}
+	}
+}
+
+func TestSuccessionChain(t *testing.T) {
+	a, b, c := testKey(t), testKey(t), testKey(t)
+	ab, bc := testSuccession(t, a, b), testSuccession(t, b, c)
+	from, _ := peer.IDFromPrivateKey(a)
+	to, _ := peer.IDFromPrivateKey(c)
+
+	if err := VerifySuccessionChain([]Succession{*ab, *bc}, from.String(), to); err != nil {
+		t.Fatalf("VerifySuccessionChain: %v", err)
+	}
+	if err := VerifySuccessionChain([]Succession{*bc, *ab}, from.String(), to); err == nil {
+		t.Error("accepted a chain out of order")
+	}
+	if err := VerifySuccessionChain([]Succession{*ab}, from.String(), to); err == nil {
+		t.Error("accepted a chain ending elsewhere")
+	}
+	if err := VerifySuccessionChain(nil, from.String(), from); err != nil {
+		t.Errorf("empty chain to itself: %v", err)
+	}
+}
+
+func TestSuccessionPins(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pins.json")
+	oldKey := testKey(t)
+	genuine := testSuccession(t, oldKey, testKey(t))
+	stolen := testSuccession(t, oldKey, testKey(t))
+
+	pins := NewSuccessionPins(file)
+	if !pins.Pin(genuine) {
+		t.Fatal("first succession not pinned")
+	}
+	if !pins.Pin(genuine) {
+		t.Error("the pinned succession conflicts with itself")
+	}
+	if pins.Pin(stolen) {
+		t.Error("pinned a second successor")
+	}
+
+	//pins survive a restart
+	if got := NewSuccessionPins(file).Pinned(genuine.Old); got != genuine.New {
+		t.Errorf("pinned after reload = %q, want %q", got, genuine.New)
+	}
+}
+
+func TestSuccessionValidator(t *testing.T) {
+	v := RecordValidator{Pins: NewSuccessionPins("")}
+	oldKey, newKey, thiefKey := testKey(t), testKey(t), testKey(t)
+	genuine := testSuccession(t, oldKey, newKey)
+	key := "/ns/succession/" + genuine.Old
+
+	genuineRaw, _ := json.Marshal(genuine)
+	if err := v.Validate(key, genuineRaw); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	//a thief with the old key, dating its succession before the genuine one
+	stolen := testSuccession(t, oldKey, thiefKey)
+	backdate(t, stolen, oldKey, thiefKey, genuine.Timestamp.Add(-24*time.Hour))
+	stolenRaw, _ := json.Marshal(stolen)
+	if err := v.Validate(key, stolenRaw); err == nil {
+		t.Error("accepted a backdated succession against the pinned one")
+	}
+	if best, err := v.Select(key, [][]byte{stolenRaw, genuineRaw}); err != nil || best != 1 {
+		t.Errorf("Select = %d, %v, want the pinned succession", best, err)
+	}
+
+	//dated in the future
+	future := testSuccession(t, oldKey, newKey)
+	backdate(t, future, oldKey, newKey, time.Now().Add(2*SUCCESSION_WINDOW))
+	futureRaw, _ := json.Marshal(future)
+	if err := (RecordValidator{}).Validate(key, futureRaw); err == nil {
+		t.Error("accepted a succession dated in the future")
+	}
+}
+
+func TestSuccessionStagedChain(t *testing.T) {
+	testHome(t)
+	oldKey, newKey := testKey(t), testKey(t)
+	oldID, _ := peer.IDFromPrivateKey(oldKey)
+	newID, _ := peer.IDFromPrivateKey(newKey)
+	chain := []Succession{*testSuccession(t, oldKey, newKey)}
+
+	//interrupted before the key swap: the old identity stays
+	if err := StageSuccessionChain(chain); err != nil {
+		t.Fatal(err)
+	}
+	if err := FinishSuccessionChain(oldID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ReadSuccessionChain(); len(got) != 0 {
+		t.Errorf("chain of an unfinished rotation kept: %v", got)
+	}
+
+	//interrupted after it: the chain is completed
+	if err := StageSuccessionChain(chain); err != nil {
+		t.Fatal(err)
+	}
+	if err := FinishSuccessionChain(newID); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadSuccessionChain()
+	if err != nil || len(got) != 1 || got[0].New != newID.String() {
+		t.Errorf("chain after the swap = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+# SwarmKey.go
+
+Private network (pnet) support with a pre-shared swarm key.
+
+When swarm.key exists, every connection is encrypted with it before the TLS handshake,
+so peers without the same key can't complete a connection at all (not even reach the DHT).
+The file uses the usual go-ipfs format:
+
+	/key/swarm/psk/1.0.0/
+	/base16/
+	<64 hex characters>
+
+QUIC can't be used inside a private network, so nodes with a swarm key only use TCP.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	tls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	tcp "github.com/libp2p/go-libp2p/p2p/transport/tcp"
+)
+
+// file holding the swarm key
+var swarmKeyFile = "swarm.key"
+
+// Creates a new random swarm key, in swarm.key format
+func GenerateSwarmKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return []byte("/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key) + "\n"), nil
+}
+
+// Checks a swarm key and writes it to swarm.key
+func WriteSwarmKey(data []byte) error {
+	if _, err := pnet.DecodeV1PSK(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("invalid swarm key: %v", err)
+	}
+	return os.WriteFile(HomePath(swarmKeyFile), data, 0600)
+}
+
+// Reads the swarm key; nil (and no error) if the node is not in a private network
+func ReadSwarmKey() (pnet.PSK, error) {
+	data, err := os.ReadFile(HomePath(swarmKeyFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", swarmKeyFile, err)
+	}
+	return psk, nil
+}
+
+/*
+Transport, security and private network options for a host listening on the given
+multiaddrs: QUIC with TCP+TLS as a fallback, or TCP+TLS only inside a private network
+(QUIC listen addresses are dropped then).
+*/
+func TransportOptions(listen []string) ([]libp2p.Option, error) {
+	psk, err := ReadSwarmKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if psk != nil {
+		fmt.Println("🔒 Private network enabled (", swarmKeyFile, ")")
+		privateNetwork = true
+
+		var tcpAddrs []string
+		for _, addr := range listen {
+			if strings.Contains(addr, "/quic") {
+				fmt.Println("⚠️ Not listening on", addr, ": QUIC can't be used in a private network")
+				continue
+			}
+			tcpAddrs = append(tcpAddrs, addr)
+		}
+		if len(tcpAddrs) == 0 {
+			return nil, errors.New("no TCP listen address, a private network can't use QUIC")
+		}
+		return []libp2p.Option{
+			libp2p.ListenAddrStrings(tcpAddrs...),
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.Security(tls.ID, tls.New),
+			libp2p.PrivateNetwork(psk),
+		}, nil
+	}
+
+	return []libp2p.Option{
+		libp2p.ListenAddrStrings(listen...),
+		//quic transpot, with tcp+tls as a fallback
+		libp2p.Transport(quic.NewTransport),
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Security(tls.ID, tls.New),
+	}, nil
+}
+
+/*-------------------------- MISMATCH -----------------------------------*/
+
+var (
+	privateNetwork bool
+
+	mismatchMu     sync.Mutex
+	mismatchWarned = make(map[peer.ID]bool)
+)
+
+/*
+Explains a failed dial when it looks like a swarm key mismatch (once per peer).
+
+With different keys (or only one side having one) the handshake is garbage to the other
+side, which shows up as a failed security negotiation.
+*/
+func ExplainDialError(p peer.ID, err error) {
+	if err == nil || !strings.Contains(err.Error(), "failed to negotiate security protocol") {
+		return
+	}
+
+	mismatchMu.Lock()
+	defer mismatchMu.Unlock()
+	if mismatchWarned[p] {
+		return
+	}
+	mismatchWarned[p] = true
+
+	if privateNetwork {
+		fmt.Printf("\n⛔ Could not connect to %s: it does not use our swarm key (%s), check it has the same one\n", p, swarmKeyFile)
+	} else {
+		fmt.Printf("\n⛔ Could not connect to %s: it may be in a private network, copy its %s here\n", p, swarmKeyFile)
+	}
+}
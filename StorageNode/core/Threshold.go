@@ -0,0 +1,273 @@
+/*
+# Threshold.go
+
+This file contains the threshold key wrapping used to protect the AES data keys.
+
+Instead of Shamir-splitting the AES key itself (which forces whoever reconstructs
+it to hold the full key), every record gets its own threshold ElGamal key pair
+over secp256k1:
+
+  - The private scalar x is split into shares x_i, one per storage node, and then thrown away
+  - The AES key is wrapped under the public key Y = xG (ECIES style: R = rG, S = rY)
+  - To unwrap, each holder computes a partial decryption D_i = x_i * R and seals it
+    to the verifier's session key, so only that session can combine them
+  - The session combines any k partials with Lagrange interpolation: S = sum(l_i * D_i)
+
+No storage node ever sees x, S or the AES key.
+*/
+
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// most shares a key can be split in, x-coordinates are one byte
+const MAX_SHARES = 255
+
+// AES data key wrapped under a threshold public key
+type WrappedKey struct {
+	Ephemeral []byte `json:"ephemeral"` // R = rG, compressed
+	Cipher    []byte `json:"cipher"`    // AES-GCM(sha256(rY), data key)
+}
+
+/*
+Generates a new threshold key pair and splits the private scalar in nShares shares,
+any threshold of which can be used to decrypt.
+
+Each share is 33 bytes: the 32-byte scalar followed by its x-coordinate (same layout
+as the shares returned by SplitKey).
+*/
+func NewThresholdKey(nShares int, threshold int) (pub []byte, shares [][]byte, err error) {
+	if threshold < 2 || threshold > nShares || nShares > MAX_SHARES {
+		return nil, nil, fmt.Errorf("invalid threshold %d of %d", threshold, nShares)
+	}
+
+	//random polynomial of degree threshold-1, coefficient 0 is the private scalar
+	coeffs := make([]secp256k1.ModNScalar, threshold)
+	for i := range coeffs {
+		c, err := randomScalar()
+		if err != nil {
+			return nil, nil, err
+		}
+		coeffs[i] = *c
+	}
+
+	var Y secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&coeffs[0], &Y)
+
+	for x := 1; x <= nShares; x++ {
+		var xs secp256k1.ModNScalar
+		xs.SetInt(uint32(x))
+
+		//horner's method
+		var y secp256k1.ModNScalar
+		for i := threshold - 1; i >= 0; i-- {
+			y.Mul(&xs).Add(&coeffs[i])
+		}
+
+		b := y.Bytes()
+		shares = append(shares, append(b[:], byte(x)))
+	}
+
+	for i := range coeffs {
+		coeffs[i].Zero()
+	}
+
+	return pointBytes(&Y), shares, nil
+}
+
+// Wraps the data key under the threshold public key
+func WrapKey(pub []byte, dataKey []byte) (*WrappedKey, error) {
+	Y, err := parsePoint(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Zero()
+
+	var R, S secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(r, &R)
+	secp256k1.ScalarMultNonConst(r, &Y, &S)
+
+	sealed, err := EncryptWithKey(kdf(&S), dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WrappedKey{Ephemeral: pointBytes(&R), Cipher: sealed}, nil
+}
+
+/*
+Computes this holder's partial decryption D_i = x_i * R.
+
+Returns the share's x-coordinate along with the partial, both are needed by CombinePartials.
+*/
+func PartialDecrypt(share []byte, ephemeral []byte) (int, []byte, error) {
+	if len(share) != 33 {
+		return 0, nil, errors.New("invalid threshold share")
+	}
+
+	var xi secp256k1.ModNScalar
+	if overflow := xi.SetByteSlice(share[:32]); overflow {
+		return 0, nil, errors.New("invalid threshold share")
+	}
+	defer xi.Zero()
+
+	R, err := parsePoint(ephemeral)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var D secp256k1.JacobianPoint
+	secp256k1.ScalarMultNonConst(&xi, &R, &D)
+
+	return int(share[32]), pointBytes(&D), nil
+}
+
+/*
+Combines at least threshold partial decryptions (keyed by x-coordinate) and unwraps the data key.
+
+Only meant to run inside the verifier's session, after OpenPartial.
+*/
+func CombinePartials(partials map[int][]byte, wrapped *WrappedKey) ([]byte, error) {
+	if len(partials) == 0 {
+		return nil, errors.New("no partial decryptions")
+	}
+
+	var S secp256k1.JacobianPoint
+	first := true
+	for xi, raw := range partials {
+		D, err := parsePoint(raw)
+		if err != nil {
+			return nil, fmt.Errorf("partial %d: %v", xi, err)
+		}
+
+		//lagrange coefficient at 0: prod(x_j / (x_j - x_i))
+		var num, den secp256k1.ModNScalar
+		num.SetInt(1)
+		den.SetInt(1)
+		for xj := range partials {
+			if xj == xi {
+				continue
+			}
+			var sj, diff, negi secp256k1.ModNScalar
+			sj.SetInt(uint32(xj))
+			negi.SetInt(uint32(xi)).Negate()
+			diff.Add2(&sj, &negi)
+			num.Mul(&sj)
+			den.Mul(&diff)
+		}
+		num.Mul(den.InverseNonConst())
+
+		var term secp256k1.JacobianPoint
+		secp256k1.ScalarMultNonConst(&num, &D, &term)
+
+		if first {
+			S.Set(&term)
+			first = false
+			continue
+		}
+		var sum secp256k1.JacobianPoint
+		secp256k1.AddNonConst(&S, &term, &sum)
+		S.Set(&sum)
+	}
+
+	dataKey, err := Decrypt(kdf(&S), wrapped.Cipher)
+	if err != nil {
+		return nil, errors.New("not enough valid partial decryptions")
+	}
+	return dataKey, nil
+}
+
+/*-------------------------- VERIFIER SESSIONS -----------------------------------*/
+
+// Creates a one-time session key pair for a verifier; partials are sealed to its public key
+func NewSession() (*secp256k1.PrivateKey, []byte, error) {
+	priv, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, priv.PubKey().SerializeCompressed(), nil
+}
+
+// Seals a partial decryption so only the holder of the session private key can read it
+func SealPartial(session []byte, partial []byte) ([]byte, error) {
+	pub, err := secp256k1.ParsePubKey(session)
+	if err != nil {
+		return nil, err
+	}
+
+	eph, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	defer eph.Zero()
+
+	key := sha256.Sum256(secp256k1.GenerateSharedSecret(eph, pub))
+	sealed, err := EncryptWithKey(key[:], partial)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(eph.PubKey().SerializeCompressed(), sealed...), nil
+}
+
+// Opens a partial decryption sealed with SealPartial
+func OpenPartial(session *secp256k1.PrivateKey, sealed []byte) ([]byte, error) {
+	if len(sealed) < 33 {
+		return nil, errors.New("sealed partial too short")
+	}
+
+	eph, err := secp256k1.ParsePubKey(sealed[:33])
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256(secp256k1.GenerateSharedSecret(session, eph))
+	return Decrypt(key[:], sealed[33:])
+}
+
+/*-------------------------- HELPERS -----------------------------------*/
+
+func randomScalar() (*secp256k1.ModNScalar, error) {
+	var b [32]byte
+	var s secp256k1.ModNScalar
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		if overflow := s.SetBytes(&b); overflow == 0 && !s.IsZero() {
+			return &s, nil
+		}
+	}
+}
+
+func pointBytes(p *secp256k1.JacobianPoint) []byte {
+	p.ToAffine()
+	return secp256k1.NewPublicKey(&p.X, &p.Y).SerializeCompressed()
+}
+
+func parsePoint(b []byte) (secp256k1.JacobianPoint, error) {
+	var p secp256k1.JacobianPoint
+	pub, err := secp256k1.ParsePubKey(b)
+	if err != nil {
+		return p, err
+	}
+	pub.AsJacobian(&p)
+	return p, nil
+}
+
+func kdf(S *secp256k1.JacobianPoint) []byte {
+	key := sha256.Sum256(pointBytes(S))
+	return key[:]
+}
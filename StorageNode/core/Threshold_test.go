@@ -0,0 +1,122 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+// wraps a key under a fresh 3-of-5 threshold key and returns everything needed to unwrap it
+func wrappedTestKey(t *testing.T) ([]byte, [][]byte, *WrappedKey) {
+	t.Helper()
+	pub, shares, err := NewThresholdKey(5, 3)
+	if err != nil {
+		t.Fatalf("NewThresholdKey: %v", err)
+	}
+	dataKey := bytes.Repeat([]byte{0x42}, 32)
+	wrapped, err := WrapKey(pub, dataKey)
+	if err != nil {
+		t.Fatalf("WrapKey: %v", err)
+	}
+	return dataKey, shares, wrapped
+}
+
+func partialsFor(t *testing.T, shares [][]byte, wrapped *WrappedKey, idx ...int) map[int][]byte {
+	t.Helper()
+	partials := make(map[int][]byte)
+	for _, i := range idx {
+		x, d, err := PartialDecrypt(shares[i], wrapped.Ephemeral)
+		if err != nil {
+			t.Fatalf("PartialDecrypt %d: %v", i, err)
+		}
+		partials[x] = d
+	}
+	return partials
+}
+
+func TestThresholdKeyAnyQuorum(t *testing.T) {
+	dataKey, shares, wrapped := wrappedTestKey(t)
+
+	for _, idx := range [][]int{{0, 1, 2}, {2, 3, 4}, {0, 2, 4}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		got, err := CombinePartials(partialsFor(t, shares, wrapped, idx...), wrapped)
+		if err != nil {
+			t.Fatalf("CombinePartials %v: %v", idx, err)
+		}
+		if !bytes.Equal(got, dataKey) {
+			t.Fatalf("CombinePartials %v: wrong data key", idx)
+		}
+	}
+}
+
+func TestThresholdKeyBelowThreshold(t *testing.T) {
+	_, shares, wrapped := wrappedTestKey(t)
+
+	if _, err := CombinePartials(partialsFor(t, shares, wrapped, 0, 4), wrapped); err == nil {
+		t.Fatal("2 of 3 partials unwrapped the key")
+	}
+	if _, err := CombinePartials(map[int][]byte{}, wrapped); err == nil {
+		t.Fatal("no partials unwrapped the key")
+	}
+}
+
+func TestThresholdKeyWrongPartial(t *testing.T) {
+	_, shares, wrapped := wrappedTestKey(t)
+	_, otherShares, _ := wrappedTestKey(t)
+
+	partials := partialsFor(t, shares, wrapped, 0, 1)
+	x, d, err := PartialDecrypt(otherShares[2], wrapped.Ephemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partials[x] = d
+	if _, err := CombinePartials(partials, wrapped); err == nil {
+		t.Fatal("a share of another key unwrapped the key")
+	}
+}
+
+func TestThresholdKeyParameters(t *testing.T) {
+	for _, c := range []struct{ n, k int }{{5, 1}, {5, 0}, {3, 4}, {256, 3}} {
+		if _, _, err := NewThresholdKey(c.n, c.k); err == nil {
+			t.Errorf("NewThresholdKey(%d, %d) accepted", c.n, c.k)
+		}
+	}
+	if _, _, err := PartialDecrypt(make([]byte, 32), nil); err == nil {
+		t.Error("PartialDecrypt accepted a short share")
+	}
+}
+
+func TestSealedPartials(t *testing.T) {
+	dataKey, shares, wrapped := wrappedTestKey(t)
+	session, sessionPub, err := NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partials := make(map[int][]byte)
+	for i := 0; i < 3; i++ {
+		x, d, err := PartialDecrypt(shares[i], wrapped.Ephemeral)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := SealPartial(sessionPub, d)
+		if err != nil {
+			t.Fatalf("SealPartial: %v", err)
+		}
+		if _, err := OpenPartial(other, sealed); err == nil {
+			t.Fatal("another session opened a sealed partial")
+		}
+		opened, err := OpenPartial(session, sealed)
+		if err != nil {
+			t.Fatalf("OpenPartial: %v", err)
+		}
+		partials[x] = opened
+	}
+
+	got, err := CombinePartials(partials, wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("CombinePartials after sealing: %v", err)
+	}
+}
@@ -8,7 +8,6 @@ This file will define a variety of functions utilized in different contexts.
 package core
 
 import (
-	"context"
 	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
@@ -17,18 +16,17 @@ import (
 	"math/rand"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/multiformats/go-multiaddr"
 )
 
 // struct to define json structure of keys
 type BootstrapKeys struct {
-	PrivateKey string `json:"private_key"`
-	PublicKey  string `json:"public_key"`
+	PrivateKey          string        `json:"private_key,omitempty"`
+	PublicKey           string        `json:"public_key"`
+	EncryptedPrivateKey *EncryptedKey `json:"encrypted_private_key,omitempty"` // set instead of private_key when passphrase protected
 }
 
 // path to file with list of boostrap nodes
@@ -62,9 +60,21 @@ func ReadPrivateKeyFromFile(filename string) crypto.PrivKey {
 		panic(fmt.Sprintf("Failed to parse JSON: %v", err))
 	}
 
-	privBytes, err := base64.StdEncoding.DecodeString(keys.PrivateKey)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to decode private key: %v", err))
+	var privBytes []byte
+	if keys.EncryptedPrivateKey != nil {
+		passphrase, err := ReadPassphrase(fmt.Sprintf("Passphrase for %s: ", filename), false)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to read passphrase: %v", err))
+		}
+		privBytes, err = DecryptPrivateKey(keys.EncryptedPrivateKey, passphrase)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to decrypt %s: %v", filename, err))
+		}
+	} else {
+		privBytes, err = base64.StdEncoding.DecodeString(keys.PrivateKey)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to decode private key: %v", err))
+		}
 	}
 
 	priv, err := crypto.UnmarshalPrivateKey(privBytes)
@@ -77,7 +87,7 @@ func ReadPrivateKeyFromFile(filename string) crypto.PrivKey {
 
 // gets bootstrap nodes from file, returns list of strings
 func ReadBootstrapPeers() []string {
-	data, err := os.ReadFile(bootstrapFile)
+	data, err := os.ReadFile(HomePath(bootstrapFile))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return []string{}
@@ -95,90 +105,16 @@ func ReadBootstrapPeers() []string {
 	return peers
 }
 
-// writes the node address to the bootstrap list
-func AddPeerToBootstrap(addr string) {
-	peers := ReadBootstrapPeers()
-	for _, p := range peers {
-		if p == addr {
-			return
-		}
-	}
-	f, err := os.OpenFile(bootstrapFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Println("Error writing to bootstrap file:", err)
-		return
-	}
-	defer f.Close()
-	if _, err := f.WriteString(addr + "\n"); err != nil {
-		fmt.Println("Error writing to bootstrap file:", err)
-		return
-	}
-	fmt.Println("📝 Added self to Bootstrap.txt:", addr)
-}
-
-// endlessly connects to nodes in the bootstrap list
-func ConstantConnection(ctx context.Context, h host.Host, peers []string) {
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				fmt.Println("\nconstantConnection stopped by context")
-				return
-			default:
-				conns := h.Network().Conns()
-				fmt.Printf("\rActive connections: %d", len(conns))
-				time.Sleep(1 * time.Second)
-			}
-		}
-	}()
-
-	// main connection loop
-	for {
-		select {
-		case <-ctx.Done():
-			fmt.Println("\nconstantConnection stopped by context")
-			return
-		default:
-
-			for _, addr := range peers {
-				if strings.Contains(addr, h.ID().String()) {
-					continue
-				}
-
-				ma, err := multiaddr.NewMultiaddr(addr)
-				if err != nil {
-					fmt.Println("Invalid multiaddr:", addr)
-					continue
-				}
-
-				pi, err := peer.AddrInfoFromP2pAddr(ma)
-				if err != nil {
-					fmt.Println("Invalid peer info:", addr)
-					continue
-				}
-
-				_ = h.Connect(ctx, *pi)
-			}
-
-			time.Sleep(1 * time.Second)
+// a random connected peer that is not in skip, "" when there is none
+func GetRandomPeer(h host.Host, skip map[peer.ID]bool) peer.ID {
+	var candidates []peer.ID
+	for _, p := range h.Network().Peers() {
+		if !skip[p] {
+			candidates = append(candidates, p)
 		}
 	}
-}
-
-func GetRandomPeer(h host.Host) peer.ID {
-	// Get peers
-	peers := h.Network().Peers()
-	if len(peers) == 0 {
-		fmt.Println("no peers connected to receive data")
-	}
-
-	admin, err := peer.AddrInfoFromString("/ip4/192.168.126.1/tcp/4001/p2p/12D3KooWA1eWrMTkfawiShux6WrxzFbRdyDsk5NAyL5indcWCtEG")
-	if err != nil {
-		panic("Error getting admin node")
-	}
-	selected := peers[rand.Intn(len(peers))]
-	if selected == admin.ID {
-		return GetRandomPeer(h)
+	if len(candidates) == 0 {
+		return ""
 	}
-	return selected
+	return candidates[rand.Intn(len(candidates))]
 }
@@ -8,6 +8,16 @@ This file will define validator types for the use of the DHT's Record's Store
 
 package core
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
 //Only for testing
 //
 //Validator for records inputs under a custom prefix path.
@@ -21,3 +31,171 @@ func (v LazyValidator) Validate(key string, value []byte) error {
 func (v LazyValidator) Select(key string, values [][]byte) (int, error) {
 	return 1, nil
 }
+
+// Validator for the records we put under our custom namespace (/<namespace>/<kind>/<id>).
+//
+// Each kind of record gets its own rules, unknown kinds are let in like LazyValidator does.
+type RecordValidator struct {
+	Root crypto.PubKey   // admin root key, nil when membership checks are off
+	Pins *SuccessionPins // pinned successions, nil to pin nothing
+}
+
+// returns the <kind> part of a /<namespace>/<kind>/<id> key
+func recordKind(key string) string {
+	parts := strings.SplitN(strings.TrimPrefix(key, "/"), "/", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+func (v RecordValidator) Validate(key string, value []byte) error {
+	switch recordKind(key) {
+	case "manifest":
+		m := Manifest{}
+		if err := json.Unmarshal(value, &m); err != nil {
+			return fmt.Errorf("invalid manifest record: %v", err)
+		}
+		if !strings.HasSuffix(key, "/manifest/"+m.ID) {
+			return errors.New("manifest id does not match record key")
+		}
+		if m.Version < 1 {
+			return errors.New("invalid manifest version")
+		}
+		return m.Verify(v.Root)
+	case "succession":
+		s := Succession{}
+		if err := json.Unmarshal(value, &s); err != nil {
+			return fmt.Errorf("invalid succession record: %v", err)
+		}
+		if !strings.HasSuffix(key, "/succession/"+s.Old) {
+			return errors.New("succession does not match record key")
+		}
+		if err := s.Verify(); err != nil {
+			return err
+		}
+		if s.Timestamp.After(time.Now().Add(SUCCESSION_WINDOW)) {
+			return errors.New("succession dated in the future")
+		}
+		//the first one seen is pinned, see the trust model in Succession.go
+		if v.Pins != nil && !v.Pins.Pin(&s) {
+			return fmt.Errorf("another succession of %s is pinned", s.Old)
+		}
+		return nil
+	case "did":
+		doc := DIDDocument{}
+		if err := json.Unmarshal(value, &doc); err != nil {
+			return fmt.Errorf("invalid DID document: %v", err)
+		}
+		if !strings.HasSuffix(key, "/did/"+doc.ID) {
+			return errors.New("DID document does not match record key")
+		}
+		return doc.Verify()
+	case "acl":
+		acl := ACL{}
+		if err := json.Unmarshal(value, &acl); err != nil {
+			return fmt.Errorf("invalid acl record: %v", err)
+		}
+		if !strings.HasSuffix(key, "/acl/"+acl.ManifestID) {
+			return errors.New("acl does not match record key")
+		}
+		return acl.Verify()
+	case "roles":
+		rec := RoleRecord{}
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return fmt.Errorf("invalid role record: %v", err)
+		}
+		if !strings.HasSuffix(key, "/roles/"+rec.PeerID) {
+			return errors.New("role record does not match record key")
+		}
+		//admin claims are checked against the root, without one nobody is admin
+		_, _, err := rec.Verify(v.Root)
+		return err
+	default:
+		return LazyValidator{}.Validate(key, value)
+	}
+}
+
+func (v RecordValidator) Select(key string, values [][]byte) (int, error) {
+	switch recordKind(key) {
+	case "manifest":
+		//newest manifest version wins, but only among versions of the same record: a value
+		//with another gateway, owner or format is refused, so the one already held stays
+		best, bestVersion := 0, -1
+		var first *Manifest
+		for i, value := range values {
+			m := &Manifest{}
+			if err := json.Unmarshal(value, m); err != nil {
+				continue
+			}
+			if first == nil {
+				first = m
+			} else if !first.sameRecord(m) {
+				return 0, errors.New("manifest changes the gateway or owner of the record")
+			}
+			if m.Version > bestVersion {
+				best, bestVersion = i, m.Version
+			}
+		}
+		return best, nil
+	case "succession":
+		//the pinned succession wins, a leaked key can't redirect an identity already moved;
+		//without one the earliest does
+		best := 0
+		var bestTime time.Time
+		for i, value := range values {
+			s := Succession{}
+			if err := json.Unmarshal(value, &s); err != nil {
+				continue
+			}
+			if v.Pins != nil && v.Pins.Pinned(s.Old) == s.New {
+				return i, nil
+			}
+			if bestTime.IsZero() || s.Timestamp.Before(bestTime) {
+				best, bestTime = i, s.Timestamp
+			}
+		}
+		return best, nil
+	case "did":
+		//latest signed document wins
+		best, bestUpdated := 0, ""
+		for i, value := range values {
+			doc := DIDDocument{}
+			if err := json.Unmarshal(value, &doc); err != nil {
+				continue
+			}
+			if doc.Updated > bestUpdated {
+				best, bestUpdated = i, doc.Updated
+			}
+		}
+		return best, nil
+	case "acl":
+		//newest acl version wins
+		best, bestVersion := 0, -1
+		for i, value := range values {
+			acl := ACL{}
+			if err := json.Unmarshal(value, &acl); err != nil {
+				continue
+			}
+			if acl.Version > bestVersion {
+				best, bestVersion = i, acl.Version
+			}
+		}
+		return best, nil
+	case "roles":
+		//newest role record wins
+		best, bestTimestamp := 0, int64(-1)
+		for i, value := range values {
+			rec := RoleRecord{}
+			if err := json.Unmarshal(value, &rec); err != nil {
+				continue
+			}
+			if rec.Timestamp > bestTimestamp {
+				best, bestTimestamp = i, rec.Timestamp
+			}
+		}
+		return best, nil
+	default:
+		return LazyValidator{}.Select(key, values)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+acl.go
+
+Commands for record access control lists:
+  - sign-acl: signs an ACL for a record with the user key (the record owner)
+  - publish-acl: publishes a signed ACL from this node, replacing older versions; the node
+    (and the gateway of the record) keep it published
+
+The entries file is a json list of {"identity": <DID or peer ID>, "operations": [...]},
+operations being "verify", "retrieve" and "delete". The printed ACL can go in the upload
+payload ("acl") or be published later with a higher version.
+*/
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"node/core"
+	"os"
+	"strconv"
+	"time"
+)
+
+func SignACL(keyFile string, manifestID string, version string, entriesFile string) error {
+	v, err := strconv.Atoi(version)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid version: %s", version)
+	}
+
+	data, err := os.ReadFile(entriesFile)
+	if err != nil {
+		return err
+	}
+	entries := []core.ACLEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid acl entries: %v", err)
+	}
+	for _, e := range entries {
+		for _, op := range e.Operations {
+			if op != core.ACL_VERIFY && op != core.ACL_RETRIEVE && op != core.ACL_DELETE {
+				return fmt.Errorf("unknown operation %q for %s", op, e.Identity)
+			}
+		}
+	}
+
+	acl := &core.ACL{ManifestID: manifestID, Version: v, Entries: entries}
+	if err := core.SignACL(core.ReadPrivateKeyFromFile(keyFile), acl); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(acl, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func PublishACL(aclFile string) error {
+	data, err := os.ReadFile(aclFile)
+	if err != nil {
+		return err
+	}
+	acl := &core.ACL{}
+	if err := json.Unmarshal(data, acl); err != nil {
+		return fmt.Errorf("invalid acl: %v", err)
+	}
+	if err := acl.Verify(); err != nil {
+		return err
+	}
+
+	cfg := nodeConfig()
+	priv := core.ReadPrivateKeyFromFile(core.HomePath(idFile))
+	gater := memberGater(priv)
+	ctx, h, kadDHT, book, _ := core.NodeCreate(context.Background(), priv, cfg, gater)
+
+	//connect to the local storage, where the ACL is kept to be republished
+	db, err := core.NewDatabase(mongoURI(cfg), cfg.Storage.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	core.KeepConnected(ctx, h, book, cfg)
+
+	//allow time for connection
+	time.Sleep(cfg.Timeouts.Startup)
+
+	sm := core.HandlersInit(ctx, h, kadDHT, db, cfg, gater)
+	if err := sm.PublishACL(ctx, acl); err != nil {
+		return err
+	}
+	fmt.Printf("📣 ACL version %d published for %s\n", acl.Version, acl.ManifestID)
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+audit.go
+
+Commands for the local audit log (Audit.log):
+  - audit verify: checks the hash chain and the checkpoint signatures
+  - audit export <manifest>: prints the entries about a user's record (data-subject requests)
+
+Neither needs the node to be running nor the identity passphrase.
+*/
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"node/core"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const auditFile = "Audit.log"
+
+func Audit(args []string) error {
+	auditFile := core.HomePath(auditFile)
+	if len(args) < 1 {
+		return fmt.Errorf("usage: audit verify | audit export <manifest>")
+	}
+
+	switch args[0] {
+	case "verify":
+		signers, err := auditSigners()
+		if err != nil {
+			return err
+		}
+		report, err := core.VerifyAuditLog(auditFile, signers)
+		if err != nil {
+			return fmt.Errorf("❌ %s is not intact: %v", auditFile, err)
+		}
+		fmt.Printf("✅ %s intact: %d entries, %d signed checkpoints\n", auditFile, report.Entries, report.Checkpoints)
+		if report.Unsigned > 0 {
+			fmt.Printf("⚠️ The last %d entries are not covered by a checkpoint yet\n", report.Unsigned)
+		}
+		return nil
+	case "export":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: audit export <manifest>")
+		}
+		entries, err := core.ExportAuditEntries(auditFile, args[1])
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	default:
+		return fmt.Errorf("unknown audit command %q", args[0])
+	}
+}
+
+// peer IDs allowed to sign checkpoints: the current identity and the ones it succeeded
+func auditSigners() ([]peer.ID, error) {
+	data, err := os.ReadFile(core.HomePath(idFile))
+	if err != nil {
+		return nil, err
+	}
+	keys := core.BootstrapKeys{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", idFile, err)
+	}
+	pub, err := core.ParsePublicKey(keys.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	self, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	signers := []peer.ID{self}
+	chain, err := core.ReadSuccessionChain()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range chain {
+		if old, err := peer.Decode(s.Old); err == nil {
+			signers = append(signers, old)
+		}
+	}
+	return signers, nil
+}
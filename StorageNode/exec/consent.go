@@ -0,0 +1,77 @@
+/*
+consent.go
+
+Commands for the user side of consent tokens:
+  - sign-owner: signs the claim of the user key on a record, sent in the upload payload
+  - sign-consent: signs a consent token for a verification request with the user key
+
+The user key is a key pair file made with keygen; its did:key is the "owner" sent in
+the upload payload. The requester is the did:key or peer ID of the node that will send
+the verification request (see core/Consent.go). The printed token goes with the
+verification request.
+*/
+package exec
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"node/core"
+	"os"
+	"strconv"
+	"time"
+)
+
+func SignOwner(keyFile string, uid string) error {
+	manifestID := core.ManifestID(uid)
+	sig, err := core.SignOwnerClaim(core.ReadPrivateKeyFromFile(keyFile), manifestID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("manifest:", manifestID)
+	fmt.Println("owner_signature:", base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+func SignConsent(keyFile string, requestID string, providerID string, requester string, manifestID string, criteriaFile string, days string) error {
+	n, err := strconv.Atoi(days)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid number of days: %s", days)
+	}
+	if _, err := core.ParseNodeRef(requester); err != nil {
+		return fmt.Errorf("invalid requester: %v", err)
+	}
+
+	data, err := os.ReadFile(criteriaFile)
+	if err != nil {
+		return err
+	}
+	criteria := core.Criteria{}
+	if err := json.Unmarshal(data, &criteria); err != nil {
+		return fmt.Errorf("invalid criteria: %v", err)
+	}
+	criteriaHash, err := core.CriteriaHash(criteria)
+	if err != nil {
+		return err
+	}
+
+	token := &core.ConsentToken{
+		RequestID:    requestID,
+		ProviderID:   providerID,
+		Requester:    requester,
+		ManifestID:   manifestID,
+		CriteriaHash: criteriaHash,
+		Expiry:       time.Now().Add(time.Duration(n) * 24 * time.Hour),
+	}
+	if err := core.SignConsent(core.ReadPrivateKeyFromFile(keyFile), token); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+identity.go
+
+Commands for the node identity (ID.json):
+  - encrypt-identity: migrates a plaintext key file to a passphrase protected one
+  - rotate-identity: moves the node to a new key, signing a succession record with the old one
+
+The passphrase comes from IDENTITY_PASSPHRASE, --passphrase-fd or a prompt, see core/Identity.go.
+*/
+package exec
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"node/core"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func EncryptIdentity(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	keys := core.BootstrapKeys{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("invalid %s: %v", path, err)
+	}
+	if keys.EncryptedPrivateKey != nil {
+		return fmt.Errorf("%s is already encrypted", path)
+	}
+
+	if err := sealIdentity(&keys, path); err != nil {
+		return err
+	}
+	if err := writeKeyFile(path, keys); err != nil {
+		return err
+	}
+
+	fmt.Println("✅ Private key in", path, "is now passphrase protected")
+	return nil
+}
+
+/*
+Generates a new identity key, signs the succession of the current one with both keys,
+swaps ID.json and publishes the succession. The old key is not kept anywhere: the
+succession carries both signatures, nothing needs it afterwards (see the trust model in
+core/Succession.go).
+
+The new chain is staged before ID.json is swapped with a single rename, and completed
+right after (see core.FinishSuccessionChain): a crash before the swap leaves the old
+identity untouched, one after it is completed the next time the node starts. The
+succession is only published once both are in place.
+
+Stored pieces stay in the local database; manifests still name the old peer ID and are
+resolved to the new one through the succession record. The admin does not need to sign a
+new membership certificate, the old one is presented with the succession chain.
+Stop the node first, it runs in place of it.
+*/
+func RotateIdentity() error {
+	idFile := core.HomePath(idFile)
+	oldPriv := core.ReadPrivateKeyFromFile(idFile)
+	oldID, err := peer.IDFromPrivateKey(oldPriv)
+	if err != nil {
+		return err
+	}
+	if err := core.FinishSuccessionChain(oldID); err != nil {
+		return err
+	}
+
+	chain, err := core.ReadSuccessionChain()
+	if err != nil {
+		return err
+	}
+	if len(chain) > 0 && chain[len(chain)-1].New != oldID.String() {
+		return fmt.Errorf("succession chain does not end at the current identity %s", oldID)
+	}
+
+	//new key, protected the same way as the current one
+	data, err := os.ReadFile(idFile)
+	if err != nil {
+		return err
+	}
+	keys := core.BootstrapKeys{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("invalid %s: %v", idFile, err)
+	}
+	newFile := idFile + ".new"
+	newPriv := writeIdentity(newFile, keys.EncryptedPrivateKey != nil)
+
+	newID, err := peer.IDFromPrivateKey(newPriv)
+	if err != nil {
+		return err
+	}
+
+	succession, err := core.SignSuccession(oldPriv, newPriv)
+	if err != nil {
+		return err
+	}
+	if err := core.StageSuccessionChain(append(chain, *succession)); err != nil {
+		return err
+	}
+	if err := os.Rename(newFile, idFile); err != nil {
+		return err
+	}
+	if err := core.FinishSuccessionChain(newID); err != nil {
+		return err
+	}
+	fmt.Printf("✅ Identity rotated: %s -> %s\n", succession.Old, succession.New)
+
+	//copy of an older key left by earlier versions of this command
+	if err := os.Remove(idFile + ".retired"); err == nil {
+		fmt.Printf("🗑️ Removed the old key copy %s.retired\n", idFile)
+	} else if !os.IsNotExist(err) {
+		fmt.Printf("⚠️ Could not remove the old key copy %s.retired, destroy it: %v\n", idFile, err)
+	}
+
+	//publish the succession from the new identity
+	cfg := nodeConfig()
+	gater := memberGater(newPriv)
+	ctx, h, kadDHT, book, _ := core.NodeCreate(context.Background(), newPriv, cfg, gater)
+	core.KeepConnected(ctx, h, book, cfg)
+
+	//allow time for connection
+	time.Sleep(cfg.Timeouts.Startup)
+
+	if err := core.PublishSuccession(ctx, kadDHT, cfg.Network.Namespace, succession); err != nil {
+		fmt.Println("⚠️ Succession not published yet, the node publishes it when it starts:", err)
+		return nil
+	}
+	fmt.Println("📣 Succession published")
+	return nil
+}
+
+// replaces the plaintext private key with one encrypted under a new passphrase
+func sealIdentity(keys *core.BootstrapKeys, path string) error {
+	privBytes, err := base64.StdEncoding.DecodeString(keys.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("decode private key: %v", err)
+	}
+
+	passphrase, err := core.ReadPassphrase(fmt.Sprintf("New passphrase for %s: ", path), true)
+	if err != nil {
+		return err
+	}
+	keys.EncryptedPrivateKey, err = core.EncryptPrivateKey(privBytes, passphrase)
+	if err != nil {
+		return err
+	}
+	keys.PrivateKey = ""
+	return nil
+}
+
+// writes a key file through a temporary file, so a crash never leaves it half written
+func writeKeyFile(path string, keys core.BootstrapKeys) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -17,9 +17,12 @@ If something goes wrong, do not return anithing. Use panic() instead with a erro
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
 
 	"node/core" // 如果你 zip 里的 core 包路径不是 node/core，按实际改
 
@@ -29,18 +32,45 @@ import (
 const (
 	idFile        = "ID.json"
 	bootstrapFile = "Bootstrap.txt"
+	configFile    = "config.yaml"
 )
 
 // 建议你用环境变量，方便 5 台电脑改连接串
-func mongoURI() string {
+func mongoURI(cfg *core.Config) string {
 	if v := os.Getenv("MONGO_URI"); v != "" {
 		return v
 	}
-	return "mongodb://localhost:27017"
+	return cfg.Storage.URI
 }
 
-func Init() error {
-	fmt.Println("🔧 Init start...")
+// loads config.yaml, the defaults if the node has none yet
+func nodeConfig() *core.Config {
+	configFile := core.HomePath(configFile)
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		fmt.Println("⚠️", configFile, "not found, using the default configuration (init creates it)")
+		return core.DefaultConfig()
+	}
+	cfg, err := core.LoadConfig(configFile)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid configuration: %v", err))
+	}
+	return cfg
+}
+
+func Init(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	adminRoot := flags.String("admin-root", "", "admin root public key (base64, as in ID.json) that signs membership certificates")
+	encrypt := flags.Bool("encrypt-identity", false, "protect the private key in ID.json with a passphrase")
+	swarmKey := flags.String("swarm-key", "", `private network swarm key: "generate" or a swarm.key file to import`)
+	port := flags.Int("port", 4001, "TCP and QUIC port written to a new config.yaml")
+	flags.Parse(args)
+
+	//every node file lives in the home directory
+	bootstrapFile := core.HomePath(bootstrapFile)
+	configFile := core.HomePath(configFile)
+	idFile := core.HomePath(idFile)
+
+	fmt.Println("🔧 Init start... (home:", core.Home()+")")
 
 	// 1) Bootstrap.txt
 	if _, err := os.Stat(bootstrapFile); os.IsNotExist(err) {
@@ -52,42 +82,62 @@ func Init() error {
 		fmt.Println("✅ Bootstrap.txt exists")
 	}
 
+	// 1.5) config.yaml
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		if err := core.WriteConfig(configFile, homeConfig(*port)); err != nil {
+			panic(fmt.Sprintf("Init: create %s failed: %v", configFile, err))
+		}
+		fmt.Println("✅ config.yaml created")
+	} else {
+		fmt.Println("✅ config.yaml exists")
+	}
+	cfg := nodeConfig()
+
 	// 2) ID.json
 	if _, err := os.Stat(idFile); os.IsNotExist(err) {
-		priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
-		if err != nil {
-			panic(fmt.Sprintf("Init: generate key failed: %v", err))
+		writeIdentity(idFile, *encrypt)
+		fmt.Println("✅ ID.json created")
+	} else {
+		fmt.Println("✅ ID.json exists")
+		if *encrypt {
+			fmt.Println("⚠️ --encrypt-identity only applies to new files, use encrypt-identity to migrate")
 		}
+	}
 
-		privBytes, err := crypto.MarshalPrivateKey(priv)
-		if err != nil {
-			panic(fmt.Sprintf("Init: marshal priv failed: %v", err))
+	// 2.5) Admin root key, to check membership certificates
+	if *adminRoot != "" {
+		if err := core.WriteAdminRoot(*adminRoot); err != nil {
+			panic(fmt.Sprintf("Init: %v", err))
 		}
-		pubBytes, err := crypto.MarshalPublicKey(pub)
+		fmt.Println("✅ Admin root key configured")
+	}
+
+	// 2.6) Swarm key, to keep the network private
+	switch *swarmKey {
+	case "":
+	case "generate":
+		key, err := core.GenerateSwarmKey()
 		if err != nil {
-			panic(fmt.Sprintf("Init: marshal pub failed: %v", err))
+			panic(fmt.Sprintf("Init: generate swarm key failed: %v", err))
 		}
-
-		keys := core.BootstrapKeys{
-			PrivateKey: base64.StdEncoding.EncodeToString(privBytes),
-			PublicKey:  base64.StdEncoding.EncodeToString(pubBytes),
+		if err := core.WriteSwarmKey(key); err != nil {
+			panic(fmt.Sprintf("Init: %v", err))
 		}
-
-		b, err := json.MarshalIndent(keys, "", "  ")
+		fmt.Println("✅ swarm.key generated, copy it to every node of the network")
+	default:
+		key, err := os.ReadFile(*swarmKey)
 		if err != nil {
-			panic(fmt.Sprintf("Init: marshal ID.json failed: %v", err))
+			panic(fmt.Sprintf("Init: read swarm key failed: %v", err))
 		}
-		if err := os.WriteFile(idFile, b, 0600); err != nil {
-			panic(fmt.Sprintf("Init: write ID.json failed: %v", err))
+		if err := core.WriteSwarmKey(key); err != nil {
+			panic(fmt.Sprintf("Init: %v", err))
 		}
-		fmt.Println("✅ ID.json created")
-	} else {
-		fmt.Println("✅ ID.json exists")
+		fmt.Println("✅ swarm.key imported")
 	}
 
 	// 3) MongoDB connect test (关键)
-	fmt.Println("🔌 Checking MongoDB:", mongoURI())
-	db, err := core.NewDatabase(mongoURI())
+	fmt.Println("🔌 Checking MongoDB:", mongoURI(cfg))
+	db, err := core.NewDatabase(mongoURI(cfg), cfg.Storage.Database)
 	if err != nil {
 		panic(fmt.Sprintf("Init: MongoDB connect failed: %v", err))
 	}
@@ -97,3 +147,57 @@ func Init() error {
 	fmt.Println("🎉 Init complete")
 	return nil
 }
+
+/*
+Default configuration for a new node listening on port. Nodes with their own home get
+their own database, named after the home directory, so they don't share stored pieces.
+*/
+func homeConfig(port int) *core.Config {
+	cfg := core.DefaultConfig()
+	cfg.Network.Listen = []string{
+		fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port),
+		fmt.Sprintf("/ip4/127.0.0.1/udp/%d/quic-v1", port),
+	}
+	if core.HasHome() {
+		name := strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' {
+				return r
+			}
+			return '_'
+		}, filepath.Base(core.Home()))
+		cfg.Storage.Database = cfg.Storage.Database + "_" + name
+	}
+	return cfg
+}
+
+// generates a new Ed25519 key pair and writes it in ID.json format, passphrase protected if encrypt is set
+func writeIdentity(path string, encrypt bool) crypto.PrivKey {
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("Init: generate key failed: %v", err))
+	}
+
+	privBytes, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		panic(fmt.Sprintf("Init: marshal priv failed: %v", err))
+	}
+	pubBytes, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		panic(fmt.Sprintf("Init: marshal pub failed: %v", err))
+	}
+
+	keys := core.BootstrapKeys{
+		PrivateKey: base64.StdEncoding.EncodeToString(privBytes),
+		PublicKey:  base64.StdEncoding.EncodeToString(pubBytes),
+	}
+	if encrypt {
+		if err := sealIdentity(&keys, path); err != nil {
+			panic(fmt.Sprintf("Init: encrypt %s failed: %v", path, err))
+		}
+	}
+
+	if err := writeKeyFile(path, keys); err != nil {
+		panic(fmt.Sprintf("Init: write %s failed: %v", path, err))
+	}
+	return priv
+}
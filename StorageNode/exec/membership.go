@@ -0,0 +1,129 @@
+/*
+membership.go
+
+Commands for the admin side of membership certificates:
+  - keygen: creates a key pair file (ID.json format), e.g. the admin root key
+  - sign-membership: signs a certificate for a node with the admin root key
+  - add-member: adds certificates to the roster of members this node lets in
+
+The printed certificate goes in the node's Membership.json. Members drop peers whose
+certificate they don't hold at the handshake, so it also has to be added (add-member)
+to a node already in the network, which passes it on to the others; the new node
+needs the certificate of that node in its own roster to reach it.
+*/
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"node/core"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func Keygen(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	writeIdentity(path, false)
+
+	keys := core.BootstrapKeys{}
+	data, _ := os.ReadFile(path)
+	_ = json.Unmarshal(data, &keys)
+
+	fmt.Println("✅ Key pair written to", path)
+	fmt.Println("🔑 Public key:", keys.PublicKey)
+	if pub, err := core.ParsePublicKey(keys.PublicKey); err == nil {
+		if did, err := core.DIDFromPubKey(pub); err == nil {
+			fmt.Println("🪪 DID:", did)
+		}
+	}
+	return nil
+}
+
+func SignMembership(rootFile string, peerID string, role string, days string) error {
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %v", err)
+	}
+	n, err := strconv.Atoi(days)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid number of days: %s", days)
+	}
+
+	root := core.ReadPrivateKeyFromFile(rootFile)
+	cert, err := core.SignMembership(root, pid, role, time.Now().Add(time.Duration(n)*24*time.Hour))
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(cert, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func AddMember(path string) error {
+	root, err := core.ReadAdminRoot()
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return fmt.Errorf("no admin root key configured (init --admin-root)")
+	}
+
+	//one certificate, or a whole roster (e.g. the Members.json of another node)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var added []core.MembershipPresentation
+	if err := json.Unmarshal(data, &added); err != nil {
+		single := core.MembershipPresentation{}
+		if err := json.Unmarshal(data, &single); err != nil {
+			return fmt.Errorf("invalid certificate file: %v", err)
+		}
+		added = []core.MembershipPresentation{single}
+	}
+
+	known, err := core.ReadMembers()
+	if err != nil {
+		return err
+	}
+	roster := core.NewMemberGater(root, nil)
+	roster.Learn(known)
+	n := roster.Learn(added)
+	if n == 0 {
+		return fmt.Errorf("no new valid certificate in %s", path)
+	}
+	if err := core.WriteMembers(roster.Known()); err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ %d members added to the roster (a running node picks them up on its own)\n", n)
+	return nil
+}
+
+// loads the membership gater for a node identity, nil if membership is not configured
+//
+// An identity rotation interrupted after the key swap is completed first.
+func memberGater(priv crypto.PrivKey) *core.MemberGater {
+	self, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		panic(err)
+	}
+	if err := core.FinishSuccessionChain(self); err != nil {
+		panic(err)
+	}
+	gater, err := core.LoadMemberGater(self)
+	if err != nil {
+		panic(err)
+	}
+	return gater
+}
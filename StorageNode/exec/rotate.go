@@ -0,0 +1,45 @@
+/*
+rotate.go
+
+Rotates the keys of a stored identity record: the record is re-encrypted under a fresh key,
+placed on new peers, the old pieces are erased and the new manifest is published.
+
+Runs in place of the node (it uses the node identity and its listening address), so stop
+the node first. If interrupted, running it again (or just starting the node) resumes it.
+*/
+package exec
+
+import (
+	"context"
+	"fmt"
+	"node/core"
+	"time"
+)
+
+func Rotate(manifestID string) (err error) {
+
+	//Start the node
+	cfg := nodeConfig()
+	priv := core.ReadPrivateKeyFromFile(core.HomePath(idFile))
+	gater := memberGater(priv)
+	ctx, h, kadDHT, book, _ := core.NodeCreate(context.Background(), priv, cfg, gater)
+
+	//connect to the local storage
+	db, err := core.NewDatabase(mongoURI(cfg), cfg.Storage.Database)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	core.KeepConnected(ctx, h, book, cfg)
+
+	//allow time for connection
+	time.Sleep(cfg.Timeouts.Startup)
+
+	sm := core.HandlersInit(ctx, h, kadDHT, db, cfg, gater)
+
+	if err := sm.RotateManifest(ctx, manifestID); err != nil {
+		return fmt.Errorf("rotation of %s failed: %v", manifestID, err)
+	}
+	return nil
+}
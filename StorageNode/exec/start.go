@@ -11,11 +11,17 @@ The desired node behavior is as follows:
   - Will start libp2p node with preconfigured specifications
   - Will constantly try to connect with other nodes in the network in the background
   - Will set stream handlers to react to the different type of requests
+  - Will shut down gracefully on SIGINT/SIGTERM (a second signal kills it at once)
 */
 package exec
 
 import (
+	"context"
+	"fmt"
 	"node/core"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -23,17 +29,65 @@ import (
 func NodeStart() (err error) {
 
 	//Start the node
-	ctx, h, _, peers := core.NodeCreate(core.ReadPrivateKeyFromFile("ID.json"), "myapp")
+	cfg := nodeConfig()
+	priv := core.ReadPrivateKeyFromFile(core.HomePath(idFile))
+	gater := memberGater(priv)
 
-	//connects to peers indefinitely
-	go core.ConstantConnection(ctx, h, peers)
+	//the root context is cancelled by the first SIGINT/SIGTERM
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, h, kadDHT, book, local := core.NodeCreate(signalCtx, priv, cfg, gater)
+
+	//connect to the local storage
+	db, err := core.NewDatabase(mongoURI(cfg), cfg.Storage.Database)
+	if err != nil {
+		panic(err)
+	}
+
+	//keeps the known peers connected, redialing them when lost
+	connector := core.KeepConnected(ctx, h, book, cfg)
+
+	//finds the nodes that joined after the bootstrap list was written
+	if cfg.Network.Discovery.Enabled {
+		go core.DiscoverPeers(ctx, h, kadDHT, cfg.Network.Namespace, cfg.Network.Discovery)
+	}
 
 	//allow time for connection
-	time.Sleep(10 * time.Second)
+	select {
+	case <-ctx.Done():
+	case <-time.After(cfg.Timeouts.Startup):
+	}
 
 	//Initialize the stream handlers
-	_ = core.HandlersInit(h)
+	sm := core.HandlersInit(ctx, h, kadDHT, db, cfg, gater)
+	sm.CloseOnShutdown(local)
+	sm.SetStatus(core.STATUS_ACTIVE)
+
+	//finish key rotations that were interrupted
+	go sm.ResumeRotations(ctx)
+
+	//keep the manifests we placed from expiring in the DHT
+	go sm.RepublishRecords(ctx)
+
+	//keep the records pointing our old identities at this one alive
+	go sm.PublishSuccessionChain(ctx)
+
+	//publish our DID document and keep it published
+	go func() {
+		if err := sm.PublishNodeDID(ctx); err != nil {
+			fmt.Println("Error publishing DID document:", err)
+		}
+	}()
 
-	select {}
+	<-ctx.Done()
+	//from now on a second signal kills the node
+	stop()
+	fmt.Println("\n🛑 Shutting down...")
 
+	connector.Wait()
+	if !sm.Shutdown(cfg.Timeouts.Shutdown) {
+		return fmt.Errorf("shutdown timed out with requests still running")
+	}
+	fmt.Println("👋 Node stopped")
+	return nil
 }
@@ -5,20 +5,6 @@ import (
 	"time"
 
 	"context"
-	"fmt"
-
-	"github.com/libp2p/go-libp2p"
-	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/protocol"
-	"github.com/multiformats/go-multiaddr"
-
-	dht "github.com/libp2p/go-libp2p-kad-dht"
-
-	// "github.com/libp2p/go-libp2p-record"
-
-	tls "github.com/libp2p/go-libp2p/p2p/security/tls"
-	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
-	tcp "github.com/libp2p/go-libp2p/p2p/transport/tcp"
 )
 
 func TestNode(idseed string) (err error) {
@@ -30,82 +16,27 @@ func TestNode(idseed string) (err error) {
 		panic(err)
 	}
 
-	//Start the node
-	// ctx, h, _, peers := core.NodeCreate(priv, "myapp")
-
-	//create context
-	ctx := context.Background()
-
-	//Get priv key from ID file (specifically, from node's private key)
-	// priv := readPrivateKeyFromFile("ID.json")
-
-	//Start new node host, specifying constant ID and listening address
-	h, err := libp2p.New(
-		libp2p.Identity(priv),
-		libp2p.ListenAddrStrings("/ip4/127.0.0.1/udp/0/quic-v1"),
-		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
-		//quic transpot, with tcp+tls as a fallback
-		libp2p.Transport(quic.NewTransport),
-		libp2p.Transport(tcp.NewTCPTransport),
-		libp2p.Security(tls.ID, tls.New),
-	)
-	if err != nil {
-		panic(err)
-	}
-
-	//get bootstrap peers from file
-	bootstrapPeers := core.ReadBootstrapPeers()
+	gater := memberGater(priv)
+	cfg := nodeConfig()
 
-	//create DHT
-	_, err = dht.New(
-		ctx,
-		h,
-		//IMPORTANT! Use ModeAutoServer. Will function as Server by defaul, allowing to receive and send requests/responses
-		dht.Mode(dht.ModeAutoServer),
-		//Bootstrap know nodes in DHT
-		dht.BootstrapPeers(func() []peer.AddrInfo {
-			var bootstrap_addresses []peer.AddrInfo
+	//same node as run (gated DHT, admin root and succession pins), on random local ports
+	cfg.Network.Listen = []string{"/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/udp/0/quic-v1"}
+	cfg.Network.Announce = nil
+	cfg.Network.MDNS = false
+	ctx, h, kadDHT, book, _ := core.NodeCreate(context.Background(), priv, cfg, gater)
 
-			for p := range bootstrapPeers {
-				ma, err := multiaddr.NewMultiaddr(bootstrapPeers[p])
-				if err != nil {
-					panic(err)
-				}
+	//keeps the known peers connected, redialing them when lost
+	core.KeepConnected(ctx, h, book, cfg)
 
-				pi, err := peer.AddrInfoFromP2pAddr(ma)
-				if err != nil {
-					panic(err)
-				}
-				bootstrap_addresses = append(bootstrap_addresses, *pi)
-			}
+	//allow time for connection
+	time.Sleep(5 * time.Second)
 
-			return bootstrap_addresses
-		}()...),
-		//Pass custom validator for custom prefix
-		dht.NamespacedValidator("myapp", core.LazyValidator{}),
-		//Establish protocol prefix
-		dht.ProtocolPrefix(protocol.ID(fmt.Sprintf("/%s", "myapp"))),
-	)
+	db, err := core.NewDatabase(mongoURI(cfg), cfg.Storage.Database)
 	if err != nil {
 		panic(err)
 	}
 
-	fmt.Println("✅ Node ID:", h.ID())
-	fmt.Println("🌐 Listening on:", h.Addrs())
-
-	//add self to bootstrap list
-	if len(h.Addrs()) > 0 {
-		selfAddr := fmt.Sprintf("%s/p2p/%s", h.Addrs()[0].String(), h.ID().String())
-		core.AddPeerToBootstrap(selfAddr)
-	}
-
-	//connects to peers indefinitely
-	go core.ConstantConnection(ctx, h, bootstrapPeers)
-
-	//allow time for connection
-	time.Sleep(5 * time.Second)
-
-	_ = core.HandlersInit(h)
+	_ = core.HandlersInit(ctx, h, kadDHT, db, cfg, gater)
 
 	select {}
 
@@ -3,11 +3,16 @@ package main
 import (
 	"fmt"
 	"log"
+	"node/core"
 	"node/exec"
 	"os"
+	"strconv"
 )
 
 func main() {
+	passphraseFD()
+	homeDir()
+
 	if len(os.Args) < 2 {
 		usage()
 		os.Exit(1)
@@ -15,13 +20,93 @@ func main() {
 
 	switch os.Args[1] {
 	case "init":
-		if err := exec.Init(); err != nil {
+		if err := exec.Init(os.Args[2:]); err != nil {
 			log.Fatal(err)
 		}
 	case "run":
 		if err := exec.NodeStart(); err != nil {
 			log.Fatal(err)
 		}
+	case "rotate":
+		if len(os.Args) < 3 {
+			usage()
+			os.Exit(1)
+		}
+		if err := exec.Rotate(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+	case "keygen":
+		if len(os.Args) < 3 {
+			usage()
+			os.Exit(1)
+		}
+		if err := exec.Keygen(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+	case "sign-membership":
+		if len(os.Args) < 6 {
+			usage()
+			os.Exit(1)
+		}
+		if err := exec.SignMembership(os.Args[2], os.Args[3], os.Args[4], os.Args[5]); err != nil {
+			log.Fatal(err)
+		}
+	case "add-member":
+		if len(os.Args) < 3 {
+			usage()
+			os.Exit(1)
+		}
+		if err := exec.AddMember(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+	case "sign-owner":
+		if len(os.Args) < 4 {
+			usage()
+			os.Exit(1)
+		}
+		if err := exec.SignOwner(os.Args[2], os.Args[3]); err != nil {
+			log.Fatal(err)
+		}
+	case "sign-consent":
+		if len(os.Args) < 9 {
+			usage()
+			os.Exit(1)
+		}
+		if err := exec.SignConsent(os.Args[2], os.Args[3], os.Args[4], os.Args[5], os.Args[6], os.Args[7], os.Args[8]); err != nil {
+			log.Fatal(err)
+		}
+	case "sign-acl":
+		if len(os.Args) < 6 {
+			usage()
+			os.Exit(1)
+		}
+		if err := exec.SignACL(os.Args[2], os.Args[3], os.Args[4], os.Args[5]); err != nil {
+			log.Fatal(err)
+		}
+	case "publish-acl":
+		if len(os.Args) < 3 {
+			usage()
+			os.Exit(1)
+		}
+		if err := exec.PublishACL(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+	case "encrypt-identity":
+		path := core.HomePath("ID.json")
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		if err := exec.EncryptIdentity(path); err != nil {
+			log.Fatal(err)
+		}
+	case "rotate-identity":
+		if err := exec.RotateIdentity(); err != nil {
+			log.Fatal(err)
+		}
+	case "audit":
+		if err := exec.Audit(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
 	case "test":
 		if len(os.Args) < 3 {
 			usage()
@@ -41,7 +126,65 @@ func usage() {
 		`Usage: ./main [option]
 
 Options:
-  init			Run one-time initialization
+  --passphrase-fd <fd>	Reads the identity passphrase from a file descriptor (else IDENTITY_PASSPHRASE or a prompt)
+  --home <dir>		Node directory holding identity, peer list, config and keys (else NODE_HOME or the working directory)
+
+  init			Run one-time initialization (creates config.yaml with the default settings)
+    --admin-root <key>	Admin root public key that signs membership certificates
+    --encrypt-identity	Protects the private key in ID.json with a passphrase
+    --swarm-key <generate|file>	Generates or imports the private network swarm key
+    --port <port>	Port written to a new config.yaml (default 4001)
   run			Start libp2p node
+  rotate <manifest>	Rotates the keys of a stored record (resumes an interrupted rotation)
+  keygen <file>		Creates a key pair file (e.g. the admin root key)
+  sign-membership <root key file> <peer ID> <role> <days>
+			Signs a membership certificate with the admin root key
+  add-member <certificate file>
+			Lets in the member(s) in a certificate file or another node's Members.json
+  sign-owner <user key file> <UID>
+			Signs the claim of the user key on a record (owner_signature in the upload payload)
+  sign-consent <user key file> <request ID> <provider ID> <requester> <manifest> <criteria file> <days>
+			Signs a user consent token for a verification request
+  sign-acl <user key file> <manifest> <version> <entries file>
+			Signs the access control list of a record with the user key
+  publish-acl <acl file>	Publishes a signed access control list, replacing older versions
+  encrypt-identity [file]	Protects the private key of an existing key file (default ID.json) with a passphrase
+  rotate-identity	Moves the node to a new identity key, publishing a succession record signed by the old one
+  audit verify		Checks the integrity of the local audit log (Audit.log)
+  audit export <manifest>	Prints the audit entries about a stored record
   test <seed>	Runs a test node with deterministic PeerID generated from given <seed>`)
 }
+
+// takes --passphrase-fd <fd> out of the arguments, it applies to every option
+func passphraseFD() {
+	for i := 1; i < len(os.Args)-1; i++ {
+		if os.Args[i] != "--passphrase-fd" {
+			continue
+		}
+		fd, err := strconv.Atoi(os.Args[i+1])
+		if err != nil || fd < 0 {
+			log.Fatalf("invalid --passphrase-fd: %s", os.Args[i+1])
+		}
+		core.PassphraseFD = fd
+		os.Args = append(os.Args[:i], os.Args[i+2:]...)
+		return
+	}
+}
+
+// takes --home <dir> out of the arguments (or reads NODE_HOME), it applies to every option
+func homeDir() {
+	dir := os.Getenv(core.HOME_ENV)
+	for i := 1; i < len(os.Args)-1; i++ {
+		if os.Args[i] == "--home" {
+			dir = os.Args[i+1]
+			os.Args = append(os.Args[:i], os.Args[i+2:]...)
+			break
+		}
+	}
+	if dir == "" {
+		return
+	}
+	if err := core.SetHome(dir); err != nil {
+		log.Fatalf("invalid --home: %v", err)
+	}
+}
@@ -95,7 +95,8 @@ CREATE TABLE public.requests (
     companyname character varying(255) NOT NULL,
     userid uuid,
     datarequests jsonb NOT NULL,
-    status character varying(50) NOT NULL
+    status character varying(50) NOT NULL,
+    consent jsonb
 );
 
 